@@ -9,10 +9,14 @@ import (
 	"time"
 
 	"github.com/ideamans/lightfile6-insights-gateway/internal/api"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/auth"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/metrics"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/s3"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/shutdown"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/validation"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/worker"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
@@ -41,18 +45,38 @@ func main() {
 
 	// Initialize cache manager
 	cacheManager := cache.NewManager(cfg.CacheDir)
+	if cfg.Cache.Mode == config.CacheModeSegments {
+		cacheManager.UseSegments(cfg.Cache)
+	}
+	cacheManager.SetAggregationThresholds(cfg.Aggregation)
 	if err := cacheManager.Init(); err != nil {
 		log.Fatal().Err(err).Msg("Failed to initialize cache manager")
 	}
 
-	// Initialize S3 client
-	s3Client, err := s3.NewClient(cfg)
+	// Initialize storage sink
+	storage, err := newSink(cfg, cacheManager)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to create storage sink")
+	}
+
+	// Initialize token store
+	tokens, err := auth.NewFileTokenStore(cfg.Auth.TokensFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to load token file")
+	}
+
+	// Initialize record validation
+	validator, err := validation.NewValidator(cfg.Validation)
 	if err != nil {
-		log.Fatal().Err(err).Msg("Failed to create S3 client")
+		log.Fatal().Err(err).Msg("Failed to load validation schemas")
 	}
 
+	// Initialize metrics
+	storage = metrics.NewInstrumentedSink(storage)
+	metrics.Registry.MustRegister(metrics.NewCacheCollector(cacheManager))
+
 	// Initialize worker
-	workerManager := worker.NewManager(cacheManager, s3Client, cfg)
+	workerManager := worker.NewManager(cacheManager, storage, cfg)
 
 	// Create context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
@@ -61,8 +85,11 @@ func main() {
 	// Start worker
 	workerManager.Start(ctx)
 
+	// Reload tokens on change
+	go tokens.Watch(ctx, cfg.Auth.ReloadInterval)
+
 	// Initialize and start HTTP server
-	server := api.NewServer(port, cacheManager, s3Client, cfg)
+	server := api.NewServer(port, cacheManager, storage, workerManager, tokens, validator, cfg)
 	
 	// Setup graceful shutdown
 	graceful := shutdown.NewGracefulShutdown()
@@ -112,4 +139,19 @@ func main() {
 		log.Info().Msg("Graceful shutdown completed")
 		return nil
 	})
-}
\ No newline at end of file
+}
+
+// newSink creates the storage sink selected in the configuration
+func newSink(cfg *config.Config, cacheManager *cache.Manager) (sink.Sink, error) {
+	switch cfg.Storage.Type {
+	case config.StorageLocal:
+		log.Info().Str("dir", cfg.Storage.LocalDir).Msg("Using local storage sink")
+		return sink.NewLocalSink(cfg), nil
+	default:
+		s3Client, err := s3.NewClient(cfg, cacheManager)
+		if err != nil {
+			return nil, err
+		}
+		return s3Client, nil
+	}
+}
@@ -0,0 +1,131 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/metrics"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// Batch line statuses
+const (
+	lineAccepted = "accepted"
+	lineRejected = "rejected"
+)
+
+// BatchLineResult is the outcome of a single NDJSON line
+type BatchLineResult struct {
+	Line       int      `json:"line"`
+	Status     string   `json:"status"`
+	Violations []string `json:"violations,omitempty"`
+}
+
+// BatchResponse is returned by the batch endpoints
+type BatchResponse struct {
+	Accepted int               `json:"accepted"`
+	Rejected int               `json:"rejected"`
+	Results  []BatchLineResult `json:"results"`
+}
+
+// handleUsageBatch handles NDJSON batches of usage reports
+func (s *Server) handleUsageBatch(c echo.Context) error {
+	return s.handleBatch(c, "usage", s.cacheManager.SaveUsage)
+}
+
+// handleErrorBatch handles NDJSON batches of error reports
+func (s *Server) handleErrorBatch(c echo.Context) error {
+	return s.handleBatch(c, "error", s.cacheManager.SaveError)
+}
+
+// handleBatch validates each line of an NDJSON body and saves the accepted
+// lines to a single cache file
+func (s *Server) handleBatch(c echo.Context, dataType string, save func(user string, data []byte) error) error {
+	user := c.Get("user").(string)
+
+	maxBytes := s.config.Limits.ForEndpoint(c.Path())
+	body, err := requestBodyReader(c, s.config.Decompression, maxBytes)
+	if err != nil {
+		log.Error().Err(err).Str("user", user).Str("type", dataType).Msg("Failed to read batch request body")
+		return bodyError(err, maxBytes)
+	}
+	defer body.Close()
+
+	lines, response, err := parseBatch(body, func(line []byte) []string {
+		// Each NDJSON line must be JSON, even without a schema
+		if !json.Valid(line) {
+			return []string{"record is not valid JSON"}
+		}
+		return s.validator.Validate(dataType, line)
+	})
+	if err != nil {
+		log.Error().Err(err).Str("user", user).Str("type", dataType).Msg("Failed to read batch request body")
+		return bodyError(err, maxBytes)
+	}
+
+	if response.Rejected > 0 {
+		metrics.ValidationRejections.WithLabelValues(dataType, user).Add(float64(response.Rejected))
+	}
+	if response.Accepted == 0 {
+		return c.JSON(http.StatusBadRequest, response)
+	}
+
+	lines, err = s.enrich(c, user, lines...)
+	if err != nil {
+		log.Error().Err(err).Str("user", user).Str("type", dataType).Msg("Failed to enrich batch data")
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save data")
+	}
+
+	// The aggregator writes each record of the file as its own line
+	data := bytes.Join(lines, []byte("\n"))
+	if err := save(user, data); err != nil {
+		log.Error().Err(err).Str("user", user).Str("type", dataType).Msg("Failed to save batch data")
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save data")
+	}
+
+	metrics.IngestedBytes.WithLabelValues(dataType).Add(float64(len(data)))
+	log.Info().
+		Str("user", user).
+		Str("type", dataType).
+		Int("accepted", response.Accepted).
+		Int("rejected", response.Rejected).
+		Msg("Batch data saved")
+	return c.JSON(http.StatusOK, response)
+}
+
+// parseBatch splits an NDJSON body into lines, keeping the lines without
+// violations. Blank lines are ignored.
+func parseBatch(body io.Reader, validate func(line []byte) []string) ([][]byte, BatchResponse, error) {
+	response := BatchResponse{Results: []BatchLineResult{}}
+	var lines [][]byte
+
+	reader := bufio.NewReader(body)
+	for number := 1; ; number++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, response, err
+		}
+
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if violations := validate(trimmed); len(violations) > 0 {
+				response.Rejected++
+				response.Results = append(response.Results, BatchLineResult{Line: number, Status: lineRejected, Violations: violations})
+			} else {
+				response.Accepted++
+				response.Results = append(response.Results, BatchLineResult{Line: number, Status: lineAccepted})
+				lines = append(lines, trimmed)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		}
+	}
+
+	return lines, response, nil
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_HandleUsageBatch(t *testing.T) {
+	server, cacheManager, _ := setupTestServer(t)
+
+	body := strings.Join([]string{
+		`{"event": "start"}`,
+		`not json`,
+		``,
+		`{"event": "stop"}`,
+		`[1, 2]`,
+		`{"event": "broken"`,
+	}, "\n")
+
+	req := httptest.NewRequest(http.MethodPost, "/usage/batch", strings.NewReader(body))
+	req.Header.Set("USER_TOKEN", "testuser")
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	server.echo.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var response BatchResponse
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	assert.Equal(t, 3, response.Accepted)
+	assert.Equal(t, 2, response.Rejected)
+	assert.Equal(t, []BatchLineResult{
+		{Line: 1, Status: "accepted"},
+		{Line: 2, Status: "rejected", Violations: []string{"record is not valid JSON"}},
+		{Line: 4, Status: "accepted"},
+		{Line: 5, Status: "accepted"},
+		{Line: 6, Status: "rejected", Violations: []string{"record is not valid JSON"}},
+	}, response.Results)
+
+	// All accepted lines are stored in a single cache file
+	files, err := cacheManager.GetUsageFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	content, err := cacheManager.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "{\"event\": \"start\"}\n{\"event\": \"stop\"}\n[1, 2]", string(content))
+}
+
+func TestServer_HandleErrorBatchGzip(t *testing.T) {
+	server, cacheManager, _ := setupTestServer(t)
+
+	var body bytes.Buffer
+	gzWriter := gzip.NewWriter(&body)
+	_, err := gzWriter.Write([]byte("{\"error\": \"a\"}\r\n{\"error\": \"b\"}\n"))
+	require.NoError(t, err)
+	require.NoError(t, gzWriter.Close())
+
+	req := httptest.NewRequest(http.MethodPost, "/error/batch", &body)
+	req.Header.Set("USER_TOKEN", "testuser")
+	req.Header.Set("Content-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	server.echo.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"accepted":2`)
+
+	files, err := cacheManager.GetErrorFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	content, err := cacheManager.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "{\"error\": \"a\"}\n{\"error\": \"b\"}", string(content))
+}
+
+func TestServer_HandleBatchRejected(t *testing.T) {
+	server, cacheManager, _ := setupTestServer(t)
+
+	t.Run("no valid lines", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/usage/batch", strings.NewReader("oops\n"))
+		req.Header.Set("USER_TOKEN", "testuser")
+		rec := httptest.NewRecorder()
+		server.echo.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"rejected":1`)
+	})
+
+	t.Run("invalid gzip", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPost, "/usage/batch", strings.NewReader(`{"event": "start"}`))
+		req.Header.Set("USER_TOKEN", "testuser")
+		req.Header.Set("Content-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		server.echo.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code)
+	})
+
+	files, err := cacheManager.GetUsageFiles()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
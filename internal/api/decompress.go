@@ -0,0 +1,152 @@
+package api
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/labstack/echo/v4"
+)
+
+// Request body errors
+var (
+	ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+	ErrBodyTooLarge        = errors.New("request body too large")
+	ErrCompressionRatio    = errors.New("request body compression ratio too high")
+)
+
+// minRatioCheckBytes is the decompressed size below which the compression
+// ratio is not checked, so small but repetitive bodies are not rejected
+const minRatioCheckBytes = 1 << 20
+
+// requestBodyReader returns the request body, decoding it according to
+// Content-Encoding. The decoded body is limited to maxBytes (0 for no limit)
+// and compressed bodies are guarded against decompression bombs.
+func requestBodyReader(c echo.Context, cfg config.DecompressionConfig, maxBytes int64) (io.ReadCloser, error) {
+	req := c.Request()
+	encoding := strings.ToLower(strings.TrimSpace(req.Header.Get(echo.HeaderContentEncoding)))
+
+	if encoding == "" || encoding == "identity" {
+		if maxBytes > 0 && req.ContentLength > maxBytes {
+			return nil, ErrBodyTooLarge
+		}
+		return &bodyGuard{r: req.Body, maxBytes: maxBytes}, nil
+	}
+
+	if cfg.MaxBytes > 0 && (maxBytes == 0 || cfg.MaxBytes < maxBytes) {
+		maxBytes = cfg.MaxBytes
+	}
+
+	compressed := &countingReader{r: req.Body}
+	var decoded io.ReadCloser
+	switch encoding {
+	case "gzip", "x-gzip":
+		gzReader, err := gzip.NewReader(compressed)
+		if err != nil {
+			return nil, err
+		}
+		decoded = gzReader
+	case "deflate":
+		deflateReader, err := newDeflateReader(compressed)
+		if err != nil {
+			return nil, err
+		}
+		decoded = deflateReader
+	case "zstd":
+		options := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+		if maxBytes > 0 {
+			options = append(options, zstd.WithDecoderMaxMemory(uint64(maxBytes)))
+		}
+		zstdReader, err := zstd.NewReader(compressed, options...)
+		if err != nil {
+			return nil, err
+		}
+		decoded = zstdReader.IOReadCloser()
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+	}
+
+	return &bodyGuard{
+		r:          decoded,
+		compressed: compressed,
+		maxBytes:   maxBytes,
+		maxRatio:   cfg.MaxRatio,
+	}, nil
+}
+
+// newDeflateReader accepts both zlib-wrapped deflate, as specified for HTTP,
+// and the raw deflate streams some clients send instead
+func newDeflateReader(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+	header, err := buffered.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+	if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+		return zlib.NewReader(buffered)
+	}
+	return flate.NewReader(buffered), nil
+}
+
+// bodyError converts a request body error to an HTTP error
+func bodyError(err error, maxBytes int64) *echo.HTTPError {
+	switch {
+	case errors.Is(err, ErrUnsupportedEncoding):
+		return echo.NewHTTPError(http.StatusUnsupportedMediaType, "Unsupported Content-Encoding")
+	case errors.Is(err, ErrCompressionRatio):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "Request body compression ratio too high")
+	case errors.Is(err, ErrBodyTooLarge), errors.Is(err, zstd.ErrDecoderSizeExceeded):
+		return echo.NewHTTPError(http.StatusRequestEntityTooLarge, map[string]any{
+			"message":   "Request body too large",
+			"max_bytes": maxBytes,
+		})
+	default:
+		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+	}
+}
+
+// countingReader counts the bytes read from the underlying reader
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// bodyGuard limits the decoded size of a body and, for compressed bodies,
+// the compression ratio
+type bodyGuard struct {
+	r          io.ReadCloser
+	compressed *countingReader
+	n          int64
+	maxBytes   int64
+	maxRatio   int64
+}
+
+func (b *bodyGuard) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	b.n += int64(n)
+	if b.maxBytes > 0 && b.n > b.maxBytes {
+		return n, ErrBodyTooLarge
+	}
+	if b.compressed != nil && b.maxRatio > 0 && b.n > minRatioCheckBytes && b.n > b.maxRatio*max(b.compressed.n, 1) {
+		return n, ErrCompressionRatio
+	}
+	return n, err
+}
+
+func (b *bodyGuard) Close() error {
+	return b.r.Close()
+}
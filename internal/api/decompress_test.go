@@ -0,0 +1,167 @@
+package api
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compress(t *testing.T, encoding string, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "zstd":
+		w, err = zstd.NewWriter(&buf)
+	}
+	require.NoError(t, err)
+
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestServer_CompressedBodies(t *testing.T) {
+	data := []byte(`{"event": "compressed"}`)
+
+	tests := []struct {
+		name     string
+		encoding string
+		header   string
+	}{
+		{name: "gzip", encoding: "gzip", header: "gzip"},
+		{name: "deflate", encoding: "deflate", header: "deflate"},
+		{name: "raw deflate", encoding: "raw-deflate", header: "deflate"},
+		{name: "zstd", encoding: "zstd", header: "zstd"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cacheManager, _ := setupTestServer(t)
+
+			req := httptest.NewRequest(http.MethodPut, "/usage", bytes.NewReader(compress(t, tt.encoding, data)))
+			req.Header.Set("USER_TOKEN", "testuser")
+			req.Header.Set("Content-Encoding", tt.header)
+			rec := httptest.NewRecorder()
+			server.echo.ServeHTTP(rec, req)
+
+			require.Equal(t, http.StatusNoContent, rec.Code)
+
+			files, err := cacheManager.GetUsageFiles()
+			require.NoError(t, err)
+			require.Len(t, files, 1)
+
+			content, err := cacheManager.ReadFile(files[0])
+			require.NoError(t, err)
+			assert.Equal(t, data, content)
+		})
+	}
+}
+
+func TestServer_CompressedBodyErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     config.DecompressionConfig
+		encoding   string
+		body       []byte
+		raw        bool
+		wantStatus int
+	}{
+		{
+			name:       "unsupported encoding",
+			encoding:   "br",
+			body:       []byte(`{}`),
+			raw:        true,
+			wantStatus: http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "corrupt body",
+			encoding:   "gzip",
+			body:       []byte(`{}`),
+			raw:        true,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "decompressed size exceeded",
+			limits:     config.DecompressionConfig{MaxBytes: 1024},
+			encoding:   "gzip",
+			body:       bytes.Repeat([]byte("a"), 2048),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "zstd decompressed size exceeded",
+			limits:     config.DecompressionConfig{MaxBytes: 1024},
+			encoding:   "zstd",
+			body:       bytes.Repeat([]byte("a"), 2048),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "compression ratio exceeded",
+			limits:     config.DecompressionConfig{MaxBytes: 64 << 20, MaxRatio: 100},
+			encoding:   "gzip",
+			body:       bytes.Repeat([]byte("a"), 4<<20),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, cacheManager, _ := setupTestServer(t)
+			server.config.Decompression = tt.limits
+
+			body := tt.body
+			if !tt.raw {
+				body = compress(t, tt.encoding, tt.body)
+			}
+
+			req := httptest.NewRequest(http.MethodPut, "/error", bytes.NewReader(body))
+			req.Header.Set("USER_TOKEN", "testuser")
+			req.Header.Set("Content-Encoding", tt.encoding)
+			rec := httptest.NewRecorder()
+			server.echo.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+
+			files, err := cacheManager.GetErrorFiles()
+			require.NoError(t, err)
+			assert.Empty(t, files)
+		})
+	}
+}
+
+func TestServer_CompressedBatch(t *testing.T) {
+	server, cacheManager, _ := setupTestServer(t)
+
+	body := compress(t, "zstd", []byte("{\"event\": \"a\"}\n{\"event\": \"b\"}\n"))
+	req := httptest.NewRequest(http.MethodPost, "/usage/batch", bytes.NewReader(body))
+	req.Header.Set("USER_TOKEN", "testuser")
+	req.Header.Set("Content-Encoding", "zstd")
+	rec := httptest.NewRecorder()
+	server.echo.ServeHTTP(rec, req)
+
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `"accepted":2`)
+
+	files, err := cacheManager.GetUsageFiles()
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+)
+
+// gatewayKey is the record key holding the enrichment fields
+const gatewayKey = "_gateway"
+
+// gatewayInfo holds the server-side fields added to each record
+type gatewayInfo struct {
+	ReceivedAt string `json:"received_at,omitempty"`
+	RequestID  string `json:"request_id,omitempty"`
+	RemoteIP   string `json:"remote_ip,omitempty"`
+	User       string `json:"user,omitempty"`
+	UserAgent  string `json:"user_agent,omitempty"`
+}
+
+// newGatewayInfo collects the configured enrichment fields of a request
+func newGatewayInfo(c echo.Context, user string, cfg config.EnrichmentConfig) gatewayInfo {
+	var info gatewayInfo
+	for _, field := range cfg.Fields {
+		switch field {
+		case config.EnrichReceivedAt:
+			info.ReceivedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		case config.EnrichRequestID:
+			info.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+		case config.EnrichRemoteIP:
+			info.RemoteIP = c.RealIP()
+		case config.EnrichUser:
+			info.User = user
+		case config.EnrichUserAgent:
+			info.UserAgent = c.Request().UserAgent()
+		}
+	}
+	return info
+}
+
+// enrichRecord sets the _gateway object of each JSON object in a record,
+// replacing any _gateway member sent by the client. Everything else is kept
+// byte for byte. Other JSON values have no field to hold it, and records that
+// are not valid JSON cannot be enriched; both are returned unchanged.
+func enrichRecord(record []byte, info gatewayInfo) ([]byte, error) {
+	gateway, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	member := append([]byte(`"`+gatewayKey+`":`), gateway...)
+
+	var enriched []byte
+	var offset int64
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	for {
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err == io.EOF {
+			break
+		} else if err != nil {
+			return record, nil
+		}
+
+		end := decoder.InputOffset()
+		enriched = append(enriched, record[offset:end-int64(len(value))]...)
+		if value[0] == '{' {
+			object, err := spliceGateway(value, member)
+			if err != nil {
+				return nil, err
+			}
+			value = object
+		}
+		enriched = append(enriched, value...)
+		offset = end
+	}
+	return append(enriched, record[offset:]...), nil
+}
+
+// spliceGateway drops any _gateway member of a JSON object and adds member
+// before its closing brace, copying the other members as they are
+func spliceGateway(object []byte, member []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(object))
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	last := decoder.InputOffset()
+	enriched := append([]byte(nil), object[:last]...)
+	kept := false
+	for decoder.More() {
+		// Between members there is only whitespace and a comma
+		previous := last
+		key, err := decoder.Token()
+		if err != nil {
+			return nil, err
+		}
+		keyStart := previous + int64(bytes.IndexByte(object[previous:], '"'))
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return nil, err
+		}
+		last = decoder.InputOffset()
+
+		if key == gatewayKey {
+			continue
+		}
+		separator := object[previous:keyStart]
+		if !kept {
+			separator = bytes.Replace(separator, []byte(","), nil, 1)
+		}
+		enriched = append(enriched, separator...)
+		enriched = append(enriched, object[keyStart:last]...)
+		kept = true
+	}
+	if _, err := decoder.Token(); err != nil {
+		return nil, err
+	}
+
+	if kept {
+		enriched = append(enriched, ',')
+	}
+	enriched = append(enriched, member...)
+	return append(enriched, object[last:]...), nil
+}
+
+// enrich adds the _gateway object to each record when enrichment is enabled
+func (s *Server) enrich(c echo.Context, user string, records ...[]byte) ([][]byte, error) {
+	if !s.config.Enrichment.Enabled {
+		return records, nil
+	}
+
+	info := newGatewayInfo(c, user, s.config.Enrichment)
+	enriched := make([][]byte, 0, len(records))
+	for _, record := range records {
+		data, err := enrichRecord(record, info)
+		if err != nil {
+			return nil, err
+		}
+		enriched = append(enriched, data)
+	}
+	return enriched, nil
+}
@@ -0,0 +1,127 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnrichRecord(t *testing.T) {
+	info := gatewayInfo{User: "testuser", RemoteIP: "192.0.2.1"}
+	gateway := `"_gateway":{"remote_ip":"192.0.2.1","user":"testuser"}`
+
+	tests := []struct {
+		name   string
+		record string
+		want   string
+	}{
+		{
+			name:   "other fields are kept byte for byte",
+			record: `{ "z": "<b>&</b>", "a": {"y": 1.50, "x": 12345678901234567890}, "a": 2 }`,
+			want:   `{ "z": "<b>&</b>", "a": {"y": 1.50, "x": 12345678901234567890}, "a": 2,` + gateway + ` }`,
+		},
+		{
+			name:   "client _gateway is replaced",
+			record: `{"_gateway": {"user": "spoofed"}, "event": "start", "_g\u0061teway": 1}`,
+			want:   `{ "event": "start",` + gateway + `}`,
+		},
+		{
+			name:   "empty object",
+			record: "{}\n",
+			want:   "{" + gateway + "}\n",
+		},
+		{
+			name:   "each object of a multi-value body",
+			record: "{\"event\":\"a\"}\n[\"b\"]\n{\"event\":\"c\"}",
+			want:   "{\"event\":\"a\"," + gateway + "}\n[\"b\"]\n{\"event\":\"c\"," + gateway + "}",
+		},
+		{
+			name:   "values that are not objects",
+			record: `["start"]`,
+			want:   `["start"]`,
+		},
+		{
+			name:   "invalid JSON",
+			record: `{"event": "start"} not json`,
+			want:   `{"event": "start"} not json`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enriched, err := enrichRecord([]byte(tt.record), info)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, string(enriched))
+		})
+	}
+}
+
+func TestServer_Enrichment(t *testing.T) {
+	server, cacheManager, _ := setupTestServer(t)
+	server.config.Enrichment = config.EnrichmentConfig{
+		Enabled: true,
+		Fields:  config.EnrichmentFields,
+	}
+
+	req := httptest.NewRequest(http.MethodPut, "/usage", bytes.NewReader([]byte(`{"event": "start"}`)))
+	req.Header.Set("USER_TOKEN", "testuser")
+	req.Header.Set(echo.HeaderXRealIP, "192.0.2.10")
+	req.Header.Set("User-Agent", "lightfile6/1.0")
+	rec := httptest.NewRecorder()
+	server.echo.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusNoContent, rec.Code)
+
+	files, err := cacheManager.GetUsageFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	content, err := cacheManager.ReadFile(files[0])
+	require.NoError(t, err)
+
+	var record struct {
+		Event   string      `json:"event"`
+		Gateway gatewayInfo `json:"_gateway"`
+	}
+	require.NoError(t, json.Unmarshal(content, &record))
+	assert.Equal(t, "start", record.Event)
+	assert.Equal(t, "testuser", record.Gateway.User)
+	assert.Equal(t, "192.0.2.10", record.Gateway.RemoteIP)
+	assert.Equal(t, "lightfile6/1.0", record.Gateway.UserAgent)
+	assert.Equal(t, rec.Header().Get(echo.HeaderXRequestID), record.Gateway.RequestID)
+	receivedAt, err := time.Parse(time.RFC3339Nano, record.Gateway.ReceivedAt)
+	require.NoError(t, err)
+	assert.WithinDuration(t, time.Now(), receivedAt, 10*time.Second)
+}
+
+func TestServer_EnrichmentSelectedFields(t *testing.T) {
+	server, cacheManager, _ := setupTestServer(t)
+	server.config.Enrichment = config.EnrichmentConfig{
+		Enabled: true,
+		Fields:  []string{config.EnrichUser},
+	}
+
+	body := "{\"event\": \"a\"}\n{\"event\": \"b\"}\n"
+	req := httptest.NewRequest(http.MethodPost, "/error/batch", strings.NewReader(body))
+	req.Header.Set("USER_TOKEN", "testuser")
+	rec := httptest.NewRecorder()
+	server.echo.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	files, err := cacheManager.GetErrorFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	content, err := cacheManager.ReadFile(files[0])
+	require.NoError(t, err)
+
+	assert.Equal(t,
+		"{\"event\": \"a\",\"_gateway\":{\"user\":\"testuser\"}}\n{\"event\": \"b\",\"_gateway\":{\"user\":\"testuser\"}}",
+		string(content))
+}
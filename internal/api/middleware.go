@@ -1,15 +1,24 @@
 package api
 
 import (
+	"bytes"
+	"io"
+	"math"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/ideamans/lightfile6-insights-gateway/internal/auth"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/metrics"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/ratelimit"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 )
 
-// AuthMiddleware validates the USER_TOKEN header
-func AuthMiddleware() echo.MiddlewareFunc {
+// AuthMiddleware authenticates the USER_TOKEN header against the token store
+func AuthMiddleware(tokens auth.TokenStore) echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
 		return func(c echo.Context) error {
 			token := c.Request().Header.Get("USER_TOKEN")
@@ -17,13 +26,169 @@ func AuthMiddleware() echo.MiddlewareFunc {
 				return echo.NewHTTPError(http.StatusUnauthorized, "USER_TOKEN header is required")
 			}
 
-			// For now, USER_TOKEN is the username
-			c.Set("user", token)
+			identity, err := tokens.Lookup(token)
+			if err != nil {
+				log.Warn().Err(err).Str("remote_ip", c.RealIP()).Msg("Rejected USER_TOKEN")
+				return echo.NewHTTPError(http.StatusUnauthorized, "Invalid USER_TOKEN")
+			}
+
+			if !identity.Allows(c.Path()) {
+				log.Warn().Str("user", identity.User).Str("endpoint", c.Path()).Msg("Token not allowed for endpoint")
+				return echo.NewHTTPError(http.StatusForbidden, "USER_TOKEN is not allowed for this endpoint")
+			}
+
+			c.Set("user", identity.User)
+			c.Set("identity", identity)
+			return next(c)
+		}
+	}
+}
+
+// SignatureMiddleware verifies HMAC request signatures for identities with a
+// signing secret. It must run after AuthMiddleware and before any per-user
+// accounting, so forged or replayed requests cannot use up a user's limits.
+// Signed bodies are buffered to be hashed, up to the endpoint's size limit.
+func SignatureMiddleware(cfg config.SigningConfig, limits config.LimitsConfig) echo.MiddlewareFunc {
+	nonces := auth.NewNonceCache(2 * cfg.MaxClockSkew)
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity, _ := c.Get("identity").(*auth.Identity)
+			if identity == nil || identity.SigningSecret == "" {
+				return next(c)
+			}
+
+			req := c.Request()
+			maxBytes := limits.ForEndpoint(c.Path())
+			var reader io.Reader = req.Body
+			if maxBytes > 0 {
+				reader = io.LimitReader(req.Body, maxBytes+1)
+			}
+			body, err := io.ReadAll(reader)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+			}
+			if maxBytes > 0 && int64(len(body)) > maxBytes {
+				return bodyError(ErrBodyTooLarge, maxBytes)
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+
+			signed := auth.SignedRequest{
+				Method:    req.Method,
+				URI:       req.URL.RequestURI(),
+				Timestamp: req.Header.Get(auth.HeaderTimestamp),
+				Nonce:     req.Header.Get(auth.HeaderNonce),
+				Body:      body,
+			}
+			now := time.Now()
+			err = auth.Verify(identity.SigningSecret, signed, req.Header.Get(auth.HeaderSignature), now, cfg.MaxClockSkew)
+			if err == nil && !nonces.Add(identity.User+"\n"+signed.Nonce, now) {
+				err = auth.ErrSignatureReplayed
+			}
+			if err != nil {
+				log.Warn().Err(err).Str("user", identity.User).Str("remote_ip", c.RealIP()).Msg("Rejected request signature")
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// BackpressureMiddleware refuses requests with 503 while the cache directory
+// is above its high water mark
+func BackpressureMiddleware(backpressure *cache.Backpressure) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if backpressure.Engaged() {
+				c.Response().Header().Set("Retry-After", retryAfterSeconds(backpressure.RetryAfter()))
+				return echo.NewHTTPError(http.StatusServiceUnavailable, "Cache is full, retry later")
+			}
 			return next(c)
 		}
 	}
 }
 
+// RateLimitMiddleware enforces per-user request rates and daily quotas. It
+// must run after AuthMiddleware and SignatureMiddleware. Only accepted (2xx)
+// requests count against the daily quotas, with bytes counted as received on
+// the wire.
+func RateLimitMiddleware(limiter *ratelimit.Limiter, quotas *ratelimit.Quotas) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			user, _ := c.Get("user").(string)
+
+			if ok, retryAfter := limiter.Allow(user, c.RealIP()); !ok {
+				metrics.RateLimited.WithLabelValues("rate", user).Inc()
+				return tooManyRequests(c, retryAfter, "Rate limit exceeded")
+			}
+			if ok, retryAfter := quotas.Check(user); !ok {
+				metrics.RateLimited.WithLabelValues("quota", user).Inc()
+				log.Warn().Str("user", user).Msg("Daily quota exceeded")
+				return tooManyRequests(c, retryAfter, "Daily quota exceeded")
+			}
+
+			req := c.Request()
+			body := &countingReader{r: req.Body}
+			req.Body = struct {
+				io.Reader
+				io.Closer
+			}{body, req.Body}
+
+			err := next(c)
+			if status := c.Response().Status; err == nil && status >= 200 && status < 300 {
+				quotas.Add(user, body.n)
+			}
+			return err
+		}
+	}
+}
+
+// tooManyRequests returns a 429 error with a Retry-After header
+func tooManyRequests(c echo.Context, retryAfter time.Duration, message string) error {
+	c.Response().Header().Set("Retry-After", retryAfterSeconds(retryAfter))
+	return echo.NewHTTPError(http.StatusTooManyRequests, message)
+}
+
+// retryAfterSeconds formats a Retry-After value in whole seconds, at least 1
+func retryAfterSeconds(d time.Duration) string {
+	seconds := int64(math.Ceil(d.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.FormatInt(seconds, 10)
+}
+
+// MetricsMiddleware records request metrics
+func MetricsMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+
+			// Process request
+			err := next(c)
+			if err != nil {
+				c.Error(err)
+			}
+
+			endpoint := c.Path()
+			if endpoint == "" {
+				endpoint = "unmatched"
+			}
+			user, _ := c.Get("user").(string)
+			if user == "" {
+				user = "anonymous"
+			}
+			status := strconv.Itoa(c.Response().Status)
+
+			metrics.RequestsTotal.WithLabelValues(endpoint, status, user).Inc()
+			metrics.RequestDuration.WithLabelValues(endpoint, status).Observe(time.Since(start).Seconds())
+
+			return nil
+		}
+	}
+}
+
 // LoggerMiddleware logs HTTP requests
 func LoggerMiddleware() echo.MiddlewareFunc {
 	return func(next echo.HandlerFunc) echo.HandlerFunc {
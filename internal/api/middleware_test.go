@@ -1,10 +1,18 @@
 package api
 
 import (
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ideamans/lightfile6-insights-gateway/internal/auth"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/ratelimit"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 )
@@ -19,7 +27,7 @@ func TestAuthMiddleware(t *testing.T) {
 	}
 	
 	// Apply middleware
-	middleware := AuthMiddleware()
+	middleware := AuthMiddleware(newMockTokenStore())
 	h := middleware(handler)
 	
 	tests := []struct {
@@ -40,6 +48,12 @@ func TestAuthMiddleware(t *testing.T) {
 			wantStatus: http.StatusUnauthorized,
 			wantBody:   "",
 		},
+		{
+			name:       "with unknown token",
+			token:      "unknownuser",
+			wantStatus: http.StatusUnauthorized,
+			wantBody:   "",
+		},
 	}
 	
 	for _, tt := range tests {
@@ -66,6 +80,196 @@ func TestAuthMiddleware(t *testing.T) {
 	}
 }
 
+func TestSignatureMiddleware(t *testing.T) {
+	e := echo.New()
+	tokens := newMockTokenStore()
+
+	handler := func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		return c.String(http.StatusOK, string(body))
+	}
+	h := AuthMiddleware(tokens)(SignatureMiddleware(config.SigningConfig{MaxClockSkew: 5 * time.Minute}, config.LimitsConfig{})(handler))
+
+	body := `{"event": "test"}`
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	sign := func(nonce, body string) string {
+		return auth.Sign("install-secret", auth.SignedRequest{
+			Method:    http.MethodPut,
+			URI:       "/usage?source=desktop",
+			Timestamp: timestamp,
+			Nonce:     nonce,
+			Body:      []byte(body),
+		})
+	}
+
+	tests := []struct {
+		name       string
+		token      string
+		nonce      string
+		signature  string
+		wantStatus int
+	}{
+		{
+			name:       "unsigned token skips verification",
+			token:      "testuser",
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "valid signature",
+			token:      "signeduser",
+			nonce:      "nonce-1",
+			signature:  sign("nonce-1", body),
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "replayed nonce",
+			token:      "signeduser",
+			nonce:      "nonce-1",
+			signature:  sign("nonce-1", body),
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "missing signature",
+			token:      "signeduser",
+			nonce:      "nonce-2",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "signature over different body",
+			token:      "signeduser",
+			nonce:      "nonce-3",
+			signature:  sign("nonce-3", `{"event": "other"}`),
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, "/usage?source=desktop", strings.NewReader(body))
+			req.Header.Set("USER_TOKEN", tt.token)
+			if tt.signature != "" {
+				req.Header.Set(auth.HeaderSignature, tt.signature)
+				req.Header.Set(auth.HeaderTimestamp, timestamp)
+				req.Header.Set(auth.HeaderNonce, tt.nonce)
+			}
+			rec := httptest.NewRecorder()
+			c := e.NewContext(req, rec)
+
+			err := h(c)
+
+			if tt.wantStatus == http.StatusUnauthorized {
+				httpErr, ok := err.(*echo.HTTPError)
+				assert.True(t, ok)
+				assert.Equal(t, tt.wantStatus, httpErr.Code)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, tt.wantStatus, rec.Code)
+				// The body is still available to the handler
+				assert.Equal(t, body, rec.Body.String())
+			}
+		})
+	}
+}
+
+func TestBackpressureMiddleware(t *testing.T) {
+	e := echo.New()
+	cacheManager := cache.NewManager(t.TempDir())
+	assert.NoError(t, cacheManager.Init())
+
+	backpressure := cache.NewBackpressure(cacheManager, config.BackpressureConfig{
+		HighWaterFiles: 1,
+		RetryAfter:     30 * time.Second,
+	})
+	h := BackpressureMiddleware(backpressure)(func(c echo.Context) error {
+		return c.NoContent(http.StatusNoContent)
+	})
+
+	request := func() (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPut, "/usage", strings.NewReader(`{}`))
+		rec := httptest.NewRecorder()
+		return rec, h(e.NewContext(req, rec))
+	}
+
+	_, err := request()
+	assert.NoError(t, err)
+
+	assert.NoError(t, cacheManager.SaveUsage("testuser", []byte(`{}`)))
+	rec, err := request()
+	httpErr, ok := err.(*echo.HTTPError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusServiceUnavailable, httpErr.Code)
+	assert.Equal(t, "30", rec.Header().Get("Retry-After"))
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	e := echo.New()
+	cfg := config.RateLimitConfig{
+		RequestsPerSecond: 1,
+		Burst:             2,
+		DailyBytes:        10,
+		Overrides: []config.RateLimitOverride{
+			{User: "metricsuser", RequestsPerSecond: 100, Burst: 100},
+		},
+	}
+	cacheManager := cache.NewManager(t.TempDir())
+	assert.NoError(t, cacheManager.Init())
+	quotas := ratelimit.NewQuotas(cacheManager, cfg)
+
+	handler := func(c echo.Context) error {
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return err
+		}
+		if string(body) == "invalid" {
+			return echo.NewHTTPError(http.StatusUnprocessableEntity, "Invalid body")
+		}
+		return c.NoContent(http.StatusOK)
+	}
+	h := AuthMiddleware(newMockTokenStore())(RateLimitMiddleware(ratelimit.NewLimiter(cfg), quotas)(handler))
+
+	request := func(token, body string) (*httptest.ResponseRecorder, error) {
+		req := httptest.NewRequest(http.MethodPut, "/usage", strings.NewReader(body))
+		req.Header.Set("USER_TOKEN", token)
+		rec := httptest.NewRecorder()
+		return rec, h(e.NewContext(req, rec))
+	}
+
+	// Burst, then rate limited
+	for i := 0; i < 2; i++ {
+		_, err := request("testuser", "")
+		assert.NoError(t, err)
+	}
+	rec, err := request("testuser", "")
+	httpErr, ok := err.(*echo.HTTPError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusTooManyRequests, httpErr.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+
+	// Rejected requests are not charged
+	_, err = request("metricsuser", "invalid")
+	httpErr, ok = err.(*echo.HTTPError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusUnprocessableEntity, httpErr.Code)
+	assert.Equal(t, ratelimit.Usage{}, quotas.Usage("metricsuser"))
+
+	// Daily byte quota
+	_, err = request("metricsuser", "0123456789")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(10), quotas.Usage("metricsuser").Bytes)
+
+	rec, err = request("metricsuser", "")
+	httpErr, ok = err.(*echo.HTTPError)
+	assert.True(t, ok)
+	assert.Equal(t, http.StatusTooManyRequests, httpErr.Code)
+	retryAfter, convErr := strconv.Atoi(rec.Header().Get("Retry-After"))
+	assert.NoError(t, convErr)
+	assert.Greater(t, retryAfter, 0)
+	assert.LessOrEqual(t, retryAfter, 86400)
+}
+
 func TestLoggerMiddleware(t *testing.T) {
 	e := echo.New()
 	
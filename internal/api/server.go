@@ -5,25 +5,41 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/ideamans/lightfile6-insights-gateway/internal/auth"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
-	"github.com/ideamans/lightfile6-insights-gateway/internal/s3"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/health"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/metrics"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/ratelimit"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/validation"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
 	"github.com/rs/zerolog/log"
 )
 
+// SpecimenQueue queues saved specimens for upload
+type SpecimenQueue interface {
+	EnqueueSpecimen(path string) bool
+}
+
 // Server represents the HTTP server
 type Server struct {
 	echo         *echo.Echo
 	port         int
 	cacheManager *cache.Manager
-	s3Client     *s3.Client
+	specimens    SpecimenQueue
+	tokens       auth.TokenStore
+	validator    *validation.Validator
+	checker      *health.Checker
+	backpressure *cache.Backpressure
+	limiter      *ratelimit.Limiter
+	quotas       *ratelimit.Quotas
 	config       *config.Config
 }
 
 // NewServer creates a new HTTP server
-func NewServer(port int, cacheManager *cache.Manager, s3Client *s3.Client, cfg *config.Config) *Server {
+func NewServer(port int, cacheManager *cache.Manager, storage sink.Sink, specimens SpecimenQueue, tokens auth.TokenStore, validator *validation.Validator, cfg *config.Config) *Server {
 	e := echo.New()
 	e.HideBanner = true
 	e.HidePort = true
@@ -31,13 +47,20 @@ func NewServer(port int, cacheManager *cache.Manager, s3Client *s3.Client, cfg *
 	// Middleware
 	e.Use(middleware.Recover())
 	e.Use(middleware.RequestID())
+	e.Use(MetricsMiddleware())
 	e.Use(LoggerMiddleware())
 
 	s := &Server{
 		echo:         e,
 		port:         port,
 		cacheManager: cacheManager,
-		s3Client:     s3Client,
+		specimens:    specimens,
+		tokens:       tokens,
+		validator:    validator,
+		checker:      health.NewChecker(cacheManager.BaseDir, storage, cfg.Readiness),
+		backpressure: cache.NewBackpressure(cacheManager, cfg.Backpressure),
+		limiter:      ratelimit.NewLimiter(cfg.RateLimit),
+		quotas:       ratelimit.NewQuotas(cacheManager, cfg.RateLimit),
 		config:       cfg,
 	}
 
@@ -49,15 +72,24 @@ func NewServer(port int, cacheManager *cache.Manager, s3Client *s3.Client, cfg *
 
 // setupRoutes configures the API routes
 func (s *Server) setupRoutes() {
-	// Health check
+	// Liveness and readiness probes
 	s.echo.GET("/health", s.handleHealth)
+	s.echo.GET("/ready", s.handleReady)
+
+	// Prometheus metrics
+	s.echo.GET("/metrics", echo.WrapHandler(metrics.Handler()))
 
 	// Authenticated routes
 	api := s.echo.Group("")
-	api.Use(AuthMiddleware())
+	api.Use(AuthMiddleware(s.tokens))
+	api.Use(SignatureMiddleware(s.config.Signing, s.config.Limits))
+	api.Use(BackpressureMiddleware(s.backpressure))
+	api.Use(RateLimitMiddleware(s.limiter, s.quotas))
 
 	api.PUT("/usage", s.handleUsage)
 	api.PUT("/error", s.handleError)
+	api.POST("/usage/batch", s.handleUsageBatch)
+	api.POST("/error/batch", s.handleErrorBatch)
 	api.PUT("/specimen", s.handleSpecimen)
 }
 
@@ -69,33 +101,59 @@ func (s *Server) Start() error {
 
 // Shutdown gracefully shuts down the server
 func (s *Server) Shutdown(ctx context.Context) error {
-	return s.echo.Shutdown(ctx)
+	err := s.echo.Shutdown(ctx)
+	s.quotas.Flush()
+	return err
 }
 
-// handleHealth handles health check requests
+// handleHealth handles liveness probes. It only reports that the process is
+// serving requests; dependencies are checked by handleReady.
 func (s *Server) handleHealth(c echo.Context) error {
 	return c.JSON(http.StatusOK, map[string]string{
 		"status": "healthy",
 	})
 }
 
+// handleReady handles readiness probes
+func (s *Server) handleReady(c echo.Context) error {
+	report := s.checker.Check()
+	if !report.Ready() {
+		log.Warn().Interface("components", report.Components).Msg("Readiness check failed")
+		return c.JSON(http.StatusServiceUnavailable, report)
+	}
+	return c.JSON(http.StatusOK, report)
+}
+
 // handleUsage handles usage report uploads
 func (s *Server) handleUsage(c echo.Context) error {
 	user := c.Get("user").(string)
 	
 	// Read request body
-	data, err := readRequestBody(c)
+	maxBytes := s.config.Limits.ForEndpoint(c.Path())
+	data, err := readRequestBody(c, s.config.Decompression, maxBytes)
 	if err != nil {
 		log.Error().Err(err).Str("user", user).Msg("Failed to read usage request body")
-		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+		return bodyError(err, maxBytes)
+	}
+
+	if err := s.validate("usage", user, data); err != nil {
+		return err
 	}
 
+	enriched, err := s.enrich(c, user, data)
+	if err != nil {
+		log.Error().Err(err).Str("user", user).Msg("Failed to enrich usage data")
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save data")
+	}
+	data = enriched[0]
+
 	// Save to cache
 	if err := s.cacheManager.SaveUsage(user, data); err != nil {
 		log.Error().Err(err).Str("user", user).Msg("Failed to save usage data")
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save data")
 	}
 
+	metrics.IngestedBytes.WithLabelValues("usage").Add(float64(len(data)))
 	log.Info().Str("user", user).Int("size", len(data)).Msg("Usage data saved")
 	return c.NoContent(http.StatusNoContent)
 }
@@ -105,22 +163,50 @@ func (s *Server) handleError(c echo.Context) error {
 	user := c.Get("user").(string)
 	
 	// Read request body
-	data, err := readRequestBody(c)
+	maxBytes := s.config.Limits.ForEndpoint(c.Path())
+	data, err := readRequestBody(c, s.config.Decompression, maxBytes)
 	if err != nil {
 		log.Error().Err(err).Str("user", user).Msg("Failed to read error request body")
-		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+		return bodyError(err, maxBytes)
+	}
+
+	if err := s.validate("error", user, data); err != nil {
+		return err
 	}
 
+	enriched, err := s.enrich(c, user, data)
+	if err != nil {
+		log.Error().Err(err).Str("user", user).Msg("Failed to enrich error data")
+		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save data")
+	}
+	data = enriched[0]
+
 	// Save to cache
 	if err := s.cacheManager.SaveError(user, data); err != nil {
 		log.Error().Err(err).Str("user", user).Msg("Failed to save error data")
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save data")
 	}
 
+	metrics.IngestedBytes.WithLabelValues("error").Add(float64(len(data)))
 	log.Info().Str("user", user).Int("size", len(data)).Msg("Error data saved")
 	return c.NoContent(http.StatusNoContent)
 }
 
+// validate rejects records with validation violations with 422
+func (s *Server) validate(dataType, user string, data []byte) error {
+	violations := s.validator.Validate(dataType, data)
+	if len(violations) == 0 {
+		return nil
+	}
+
+	metrics.ValidationRejections.WithLabelValues(dataType, user).Inc()
+	log.Warn().Str("user", user).Str("type", dataType).Strs("violations", violations).Msg("Rejected invalid record")
+	return echo.NewHTTPError(http.StatusUnprocessableEntity, map[string]any{
+		"message":    "Validation failed",
+		"violations": violations,
+	})
+}
+
 // handleSpecimen handles specimen file uploads
 func (s *Server) handleSpecimen(c echo.Context) error {
 	user := c.Get("user").(string)
@@ -130,36 +216,40 @@ func (s *Server) handleSpecimen(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, "uri parameter is required")
 	}
 
-	// Read request body
-	data, err := readRequestBody(c)
+	// Stream request body into the cache
+	maxBytes := s.config.Limits.ForEndpoint(c.Path())
+	body, err := requestBodyReader(c, s.config.Decompression, maxBytes)
 	if err != nil {
 		log.Error().Err(err).Str("user", user).Str("uri", uri).Msg("Failed to read specimen request body")
-		return echo.NewHTTPError(http.StatusBadRequest, "Invalid request body")
+		return bodyError(err, maxBytes)
 	}
+	defer body.Close()
 
-	// Save to cache for immediate upload
-	if err := s.cacheManager.SaveSpecimen(uri, data); err != nil {
+	meta := cache.SpecimenMeta{
+		User:        user,
+		URI:         uri,
+		ContentType: c.Request().Header.Get(echo.HeaderContentType),
+		RequestID:   c.Response().Header().Get(echo.HeaderXRequestID),
+	}
+	tracked := &trackingReader{r: body}
+	path, size, err := s.cacheManager.SaveSpecimen(meta, tracked)
+	if tracked.err != nil {
+		log.Error().Err(tracked.err).Str("user", user).Str("uri", uri).Msg("Failed to read specimen request body")
+		return bodyError(tracked.err, maxBytes)
+	}
+	if err != nil {
 		log.Error().Err(err).Str("user", user).Str("uri", uri).Msg("Failed to save specimen data")
 		return echo.NewHTTPError(http.StatusInternalServerError, "Failed to save data")
 	}
 
-	// Queue for immediate upload
-	go s.uploadSpecimen(user, uri)
+	metrics.IngestedBytes.WithLabelValues("specimen").Add(float64(size))
+
+	// Queue for immediate upload; specimens that do not fit in the queue
+	// are uploaded by the next sweep
+	if s.specimens != nil && !s.specimens.EnqueueSpecimen(path) {
+		log.Warn().Str("user", user).Str("uri", uri).Msg("Specimen upload queue full, deferring upload")
+	}
 
-	log.Info().Str("user", user).Str("uri", uri).Int("size", len(data)).Msg("Specimen data saved")
+	log.Info().Str("user", user).Str("uri", uri).Int64("size", size).Msg("Specimen data saved")
 	return c.NoContent(http.StatusNoContent)
 }
-
-// uploadSpecimen uploads a specimen file to S3
-func (s *Server) uploadSpecimen(user, uri string) {
-	if s.s3Client == nil {
-		log.Warn().Str("user", user).Str("uri", uri).Msg("S3 client not configured, skipping upload")
-		return
-	}
-	
-	if err := s.s3Client.UploadSpecimen(user, uri); err != nil {
-		log.Error().Err(err).Str("user", user).Str("uri", uri).Msg("Failed to upload specimen")
-	} else {
-		log.Info().Str("user", user).Str("uri", uri).Msg("Specimen uploaded successfully")
-	}
-}
\ No newline at end of file
@@ -4,39 +4,108 @@ import (
 	"bytes"
 	"net/http"
 	"net/http/httptest"
+	"path/filepath"
+	"os"
+	"strconv"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/ideamans/lightfile6-insights-gateway/internal/auth"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/validation"
 	"github.com/labstack/echo/v4"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-// MockS3Client is a mock implementation of S3 client
-type MockS3Client struct {
-	uploadedSpecimens []struct {
-		User string
-		URI  string
-	}
+// MockSink is a mock implementation of sink.Sink
+type MockSink struct {
+	mu                sync.Mutex
+	uploadedSpecimens []sink.Specimen
+}
+
+func (m *MockSink) PutSpecimen(specimen sink.Specimen) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.uploadedSpecimens = append(m.uploadedSpecimens, specimen)
+	return nil
 }
 
-func (m *MockS3Client) UploadSpecimen(user, uri string) error {
-	m.uploadedSpecimens = append(m.uploadedSpecimens, struct {
-		User string
-		URI  string
-	}{User: user, URI: uri})
+func (m *MockSink) PutAggregated(aggregate sink.Aggregate) error {
 	return nil
 }
 
-func (m *MockS3Client) UploadAggregatedFile(filePath string, dataType string) error {
+func (m *MockSink) AbortUpload(path string) error {
 	return nil
 }
 
-func (m *MockS3Client) CheckBuckets() error {
+func (m *MockSink) HealthCheck() error {
 	return nil
 }
 
+func (m *MockSink) specimens() []sink.Specimen {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]sink.Specimen(nil), m.uploadedSpecimens...)
+}
+
+// mockSpecimenQueue uploads queued specimens immediately
+type mockSpecimenQueue struct {
+	cacheManager *cache.Manager
+	storage      sink.Sink
+	mu           sync.Mutex
+	paths        []string
+}
+
+func (q *mockSpecimenQueue) EnqueueSpecimen(path string) bool {
+	q.mu.Lock()
+	q.paths = append(q.paths, path)
+	q.mu.Unlock()
+	go sink.UploadSpecimenFile(q.storage, q.cacheManager, path)
+	return true
+}
+
+func (q *mockSpecimenQueue) enqueued() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return append([]string(nil), q.paths...)
+}
+
+// MockTokenStore is a mock implementation of auth.TokenStore
+type MockTokenStore struct {
+	identities map[string]*auth.Identity
+}
+
+// newMockTokenStore returns a token store where the test users' tokens are their names
+func newMockTokenStore() *MockTokenStore {
+	return &MockTokenStore{
+		identities: map[string]*auth.Identity{
+			"testuser":    {User: "testuser"},
+			"metricsuser": {User: "metricsuser"},
+			"errorsonly":  {User: "errorsonly", Endpoints: []string{"/error"}},
+			"signeduser":  {User: "signeduser", SigningSecret: "install-secret"},
+		},
+	}
+}
+
+func (m *MockTokenStore) Lookup(token string) (*auth.Identity, error) {
+	identity, ok := m.identities[token]
+	if !ok {
+		return nil, auth.ErrUnknownToken
+	}
+	return identity, nil
+}
+
+// newTestValidator returns a validator without schemas
+func newTestValidator(t *testing.T) *validation.Validator {
+	validator, err := validation.NewValidator(config.ValidationConfig{})
+	require.NoError(t, err)
+	return validator
+}
+
 func TestServer_Health(t *testing.T) {
 	// Setup
 	tempDir := t.TempDir()
@@ -51,7 +120,7 @@ func TestServer_Health(t *testing.T) {
 		},
 	}
 
-	server := NewServer(8080, cacheManager, nil, cfg)
+	server := NewServer(8080, cacheManager, nil, nil, newMockTokenStore(), newTestValidator(t), cfg)
 
 	// Test
 	req := httptest.NewRequest(http.MethodGet, "/health", nil)
@@ -63,6 +132,54 @@ func TestServer_Health(t *testing.T) {
 	assert.Contains(t, rec.Body.String(), `"status":"healthy"`)
 }
 
+func TestServer_Ready(t *testing.T) {
+	t.Run("ready", func(t *testing.T) {
+		server, _, _ := setupTestServer(t)
+
+		req := httptest.NewRequest(http.MethodGet, "/ready", nil)
+		rec := httptest.NewRecorder()
+		server.echo.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"status":"ready"`)
+		assert.Contains(t, rec.Body.String(), `"storage":{"status":"ok"`)
+		assert.Contains(t, rec.Body.String(), `"cache":{"status":"ok"`)
+	})
+
+	t.Run("storage not configured", func(t *testing.T) {
+		tempDir := t.TempDir()
+		cacheManager := cache.NewManager(tempDir)
+		require.NoError(t, cacheManager.Init())
+
+		server := NewServer(8080, cacheManager, nil, nil, newMockTokenStore(), newTestValidator(t), &config.Config{})
+
+		req := httptest.NewRequest(http.MethodGet, "/ready", nil)
+		rec := httptest.NewRecorder()
+		server.echo.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"status":"not_ready"`)
+		assert.Contains(t, rec.Body.String(), `"storage":{"status":"fail"`)
+	})
+}
+
+func TestServer_Metrics(t *testing.T) {
+	server, _, _ := setupTestServer(t)
+
+	// Generate some traffic
+	req := httptest.NewRequest(http.MethodPut, "/usage", bytes.NewReader([]byte(`{"event": "test"}`)))
+	req.Header.Set("USER_TOKEN", "metricsuser")
+	server.echo.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	rec := httptest.NewRecorder()
+	server.echo.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), `lightfile6_gateway_http_requests_total{endpoint="/usage",status="204",user="metricsuser"} 1`)
+	assert.Contains(t, rec.Body.String(), `lightfile6_gateway_ingested_bytes_total{data_type="usage"}`)
+}
+
 func TestServer_AuthMiddleware(t *testing.T) {
 	// Setup
 	tempDir := t.TempDir()
@@ -77,7 +194,7 @@ func TestServer_AuthMiddleware(t *testing.T) {
 		},
 	}
 
-	server := NewServer(8080, cacheManager, nil, cfg)
+	server := NewServer(8080, cacheManager, nil, nil, newMockTokenStore(), newTestValidator(t), cfg)
 
 	tests := []struct {
 		name       string
@@ -94,6 +211,16 @@ func TestServer_AuthMiddleware(t *testing.T) {
 			token:      "",
 			wantStatus: http.StatusUnauthorized,
 		},
+		{
+			name:       "unknown token",
+			token:      "someoneelse",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "endpoint not allowed",
+			token:      "errorsonly",
+			wantStatus: http.StatusForbidden,
+		},
 	}
 
 	for _, tt := range tests {
@@ -110,6 +237,46 @@ func TestServer_AuthMiddleware(t *testing.T) {
 	}
 }
 
+func TestServer_SignatureBeforeRateLimit(t *testing.T) {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+
+	cfg := &config.Config{
+		Signing:   config.SigningConfig{MaxClockSkew: 5 * time.Minute},
+		RateLimit: config.RateLimitConfig{RequestsPerSecond: 0.001, Burst: 1},
+	}
+	server := NewServer(8080, cacheManager, nil, nil, newMockTokenStore(), newTestValidator(t), cfg)
+
+	body := []byte(`{"event": "test"}`)
+	request := func(signature string) int {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req := httptest.NewRequest(http.MethodPut, "/usage", bytes.NewReader(body))
+		req.Header.Set("USER_TOKEN", "signeduser")
+		req.Header.Set(auth.HeaderTimestamp, timestamp)
+		req.Header.Set(auth.HeaderNonce, "nonce-"+signature)
+		if signature == "valid" {
+			signature = auth.Sign("install-secret", auth.SignedRequest{
+				Method:    http.MethodPut,
+				URI:       "/usage",
+				Timestamp: timestamp,
+				Nonce:     "nonce-valid",
+				Body:      body,
+			})
+		}
+		req.Header.Set(auth.HeaderSignature, signature)
+		rec := httptest.NewRecorder()
+		server.echo.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Forged requests are rejected before they use up the user's rate limit
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusUnauthorized, request(strconv.Itoa(i)))
+	}
+	assert.Equal(t, http.StatusNoContent, request("valid"))
+	assert.Equal(t, http.StatusUnauthorized, request("valid"))
+}
+
 func TestServer_HandleUsage(t *testing.T) {
 	// Setup
 	tempDir := t.TempDir()
@@ -124,7 +291,7 @@ func TestServer_HandleUsage(t *testing.T) {
 		},
 	}
 
-	server := NewServer(8080, cacheManager, nil, cfg)
+	server := NewServer(8080, cacheManager, nil, nil, newMockTokenStore(), newTestValidator(t), cfg)
 
 	// Test
 	data := []byte(`{"event": "test", "timestamp": "2024-01-01T00:00:00Z"}`)
@@ -160,7 +327,7 @@ func TestServer_HandleError(t *testing.T) {
 		},
 	}
 
-	server := NewServer(8080, cacheManager, nil, cfg)
+	server := NewServer(8080, cacheManager, nil, nil, newMockTokenStore(), newTestValidator(t), cfg)
 
 	// Test
 	data := []byte(`{"error": "test error", "timestamp": "2024-01-01T00:00:00Z"}`)
@@ -194,7 +361,7 @@ func TestServer_HandleSpecimen(t *testing.T) {
 
 	// Note: For testing, we're not actually using the mock S3 client
 	// The actual upload happens asynchronously, so we'll just verify the file is saved
-	server := NewServer(8080, cacheManager, nil, cfg)
+	server := NewServer(8080, cacheManager, nil, nil, newMockTokenStore(), newTestValidator(t), cfg)
 
 	tests := []struct {
 		name       string
@@ -237,6 +404,117 @@ func TestServer_HandleSpecimen(t *testing.T) {
 	}
 }
 
+func TestServer_BodyLimits(t *testing.T) {
+	server, cacheManager, mockSink := setupTestServer(t)
+	server.config.Limits = config.LimitsConfig{
+		UsageMaxBytes:    16,
+		SpecimenMaxBytes: 1024,
+	}
+
+	t.Run("usage over limit", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/usage", bytes.NewReader([]byte(`{"event": "too long for the limit"}`)))
+		req.Header.Set("USER_TOKEN", "testuser")
+		rec := httptest.NewRecorder()
+		server.echo.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		assert.JSONEq(t, `{"message": "Request body too large", "max_bytes": 16}`, rec.Body.String())
+	})
+
+	t.Run("usage within limit", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodPut, "/usage", bytes.NewReader([]byte(`{"event": "ok"}`)))
+		req.Header.Set("USER_TOKEN", "testuser")
+		rec := httptest.NewRecorder()
+		server.echo.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusNoContent, rec.Code)
+	})
+
+	t.Run("streamed specimen over limit", func(t *testing.T) {
+		// Without Content-Length the limit is enforced while streaming
+		req := httptest.NewRequest(http.MethodPut, "/specimen?uri=http://example.com/large.png", bytes.NewReader(make([]byte, 2048)))
+		req.ContentLength = -1
+		req.Header.Set("USER_TOKEN", "testuser")
+		rec := httptest.NewRecorder()
+		server.echo.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"max_bytes":1024`)
+
+		files, err := cacheManager.GetSpecimenFiles()
+		require.NoError(t, err)
+		assert.Empty(t, files)
+		assert.Empty(t, mockSink.specimens())
+	})
+}
+
+func TestServer_Validation(t *testing.T) {
+	server, cacheManager, _ := setupTestServer(t)
+
+	schemaPath := filepath.Join(t.TempDir(), "usage.json")
+	require.NoError(t, os.WriteFile(schemaPath, []byte(`{"type": "object", "required": ["event"]}`), 0644))
+	validator, err := validation.NewValidator(config.ValidationConfig{UsageSchema: schemaPath})
+	require.NoError(t, err)
+	server.validator = validator
+
+	tests := []struct {
+		name       string
+		path       string
+		body       string
+		wantStatus int
+		wantBody   string
+	}{
+		{
+			name:       "valid usage",
+			path:       "/usage",
+			body:       `{"event": "start"}`,
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "schema violation",
+			path:       "/usage",
+			body:       `{"action": "start"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   `{"message": "Validation failed", "violations": ["(root): event is required"]}`,
+		},
+		{
+			name:       "invalid JSON usage",
+			path:       "/usage",
+			body:       `{"event": "a"} {"event": "b"}`,
+			wantStatus: http.StatusUnprocessableEntity,
+			wantBody:   `{"message": "Validation failed", "violations": ["record is not valid JSON"]}`,
+		},
+		{
+			name:       "multiple values without a schema",
+			path:       "/error",
+			body:       "{\"error\": \"a\"}\n{\"error\": \"b\"}",
+			wantStatus: http.StatusNoContent,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodPut, tt.path, bytes.NewReader([]byte(tt.body)))
+			req.Header.Set("USER_TOKEN", "testuser")
+			rec := httptest.NewRecorder()
+			server.echo.ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			if tt.wantBody != "" {
+				assert.JSONEq(t, tt.wantBody, rec.Body.String())
+			}
+		})
+	}
+
+	// Only the valid records were stored
+	usageFiles, err := cacheManager.GetUsageFiles()
+	require.NoError(t, err)
+	assert.Len(t, usageFiles, 1)
+	errorFiles, err := cacheManager.GetErrorFiles()
+	require.NoError(t, err)
+	assert.Len(t, errorFiles, 1)
+}
+
 func TestReadRequestBody(t *testing.T) {
 	data := []byte("test data")
 	req := httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(data))
@@ -244,13 +522,53 @@ func TestReadRequestBody(t *testing.T) {
 	e := echo.New()
 	c := e.NewContext(req, httptest.NewRecorder())
 	
-	result, err := readRequestBody(c)
+	result, err := readRequestBody(c, config.DecompressionConfig{}, 0)
 	require.NoError(t, err)
 	assert.Equal(t, data, result)
 }
 
+func TestServer_HandleSpecimenUpload(t *testing.T) {
+	server, cacheManager, mockSink, queue := setupTestServerWithQueue(t)
+
+	req := httptest.NewRequest(http.MethodPut, "/specimen?uri=http://example.com/test.png", bytes.NewReader([]byte("specimen data")))
+	req.Header.Set("USER_TOKEN", "testuser")
+	req.Header.Set(echo.HeaderContentType, "image/png")
+	rec := httptest.NewRecorder()
+	server.echo.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	// The exact path that was written is queued
+	enqueued := queue.enqueued()
+	require.Len(t, enqueued, 1)
+	assert.Equal(t, filepath.Join(cacheManager.BaseDir, "specimen"), filepath.Dir(enqueued[0]))
+
+	// The upload happens asynchronously
+	assert.Eventually(t, func() bool {
+		return len(mockSink.specimens()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	specimen := mockSink.specimens()[0]
+	assert.Equal(t, "testuser", specimen.User)
+	assert.Equal(t, "http://example.com/test.png", specimen.URI)
+	assert.Equal(t, "image/png", specimen.ContentType)
+	assert.NotEmpty(t, specimen.RequestID)
+
+	// Uploaded file is removed from the cache
+	assert.Eventually(t, func() bool {
+		files, err := cacheManager.GetUploadingFiles("specimen")
+		return err == nil && len(files) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
 // Helper function to create a test server
-func setupTestServer(t *testing.T) (*Server, *cache.Manager, *MockS3Client) {
+func setupTestServer(t *testing.T) (*Server, *cache.Manager, *MockSink) {
+	server, cacheManager, mockSink, _ := setupTestServerWithQueue(t)
+	return server, cacheManager, mockSink
+}
+
+// Helper function to create a test server and its specimen queue
+func setupTestServerWithQueue(t *testing.T) (*Server, *cache.Manager, *MockSink, *mockSpecimenQueue) {
 	tempDir := t.TempDir()
 	cacheManager := cache.NewManager(tempDir)
 	require.NoError(t, cacheManager.Init())
@@ -263,11 +581,8 @@ func setupTestServer(t *testing.T) (*Server, *cache.Manager, *MockS3Client) {
 		},
 	}
 
-	mockS3 := &MockS3Client{}
-	// Note: In the actual implementation, we'd need to modify the server
-	// to accept an interface instead of the concrete s3.Client type
-	// For now, we'll test without the S3 client
-
-	server := NewServer(8080, cacheManager, nil, cfg)
-	return server, cacheManager, mockS3
+	mockSink := &MockSink{}
+	queue := &mockSpecimenQueue{cacheManager: cacheManager, storage: mockSink}
+	server := NewServer(8080, cacheManager, mockSink, queue, newMockTokenStore(), newTestValidator(t), cfg)
+	return server, cacheManager, mockSink, queue
 }
\ No newline at end of file
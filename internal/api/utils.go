@@ -3,10 +3,31 @@ package api
 import (
 	"io"
 
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
 	"github.com/labstack/echo/v4"
 )
 
-// readRequestBody reads and returns the request body
-func readRequestBody(c echo.Context) ([]byte, error) {
-	return io.ReadAll(c.Request().Body)
-}
\ No newline at end of file
+// readRequestBody reads and returns the request body, decoding it according to Content-Encoding
+func readRequestBody(c echo.Context, cfg config.DecompressionConfig, maxBytes int64) ([]byte, error) {
+	body, err := requestBodyReader(c, cfg, maxBytes)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// trackingReader records the first error returned by the underlying reader so
+// read failures can be told apart from write failures after io.Copy
+type trackingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (t *trackingReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if err != nil && err != io.EOF && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,175 @@
+package auth
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog/log"
+	"gopkg.in/yaml.v3"
+)
+
+// tokenFile is the on-disk format of a token file (YAML or JSON)
+type tokenFile struct {
+	Tokens []tokenEntry `yaml:"tokens"`
+}
+
+type tokenEntry struct {
+	SHA256        string    `yaml:"sha256"`
+	User          string    `yaml:"user"`
+	ExpiresAt     time.Time `yaml:"expires_at"`
+	Endpoints     []string  `yaml:"endpoints"`
+	SigningSecret string    `yaml:"signing_secret"`
+}
+
+// FileTokenStore is a TokenStore backed by a file of hashed tokens
+type FileTokenStore struct {
+	path string
+	now  func() time.Time
+
+	mu         sync.RWMutex
+	identities map[string]*Identity
+	modTime    time.Time
+	size       int64
+}
+
+var _ TokenStore = (*FileTokenStore)(nil)
+
+// NewFileTokenStore creates a token store and loads the token file
+func NewFileTokenStore(path string) (*FileTokenStore, error) {
+	s := &FileTokenStore{
+		path: path,
+		now:  time.Now,
+	}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Lookup returns the identity of a token
+func (s *FileTokenStore) Lookup(token string) (*Identity, error) {
+	s.mu.RLock()
+	identity, ok := s.identities[HashToken(token)]
+	s.mu.RUnlock()
+
+	if !ok {
+		return nil, ErrUnknownToken
+	}
+	if identity.Expired(s.now()) {
+		return nil, ErrTokenExpired
+	}
+	return identity, nil
+}
+
+// Reload reads the token file and replaces the current tokens.
+// On error the current tokens are kept.
+func (s *FileTokenStore) Reload() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to stat token file: %w", err)
+	}
+
+	// Remember the file even if it is invalid so Watch does not retry until it changes again
+	s.mu.Lock()
+	s.modTime = info.ModTime()
+	s.size = info.Size()
+	s.mu.Unlock()
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return fmt.Errorf("failed to read token file: %w", err)
+	}
+
+	identities, err := parseTokenFile(data)
+	if err != nil {
+		return fmt.Errorf("invalid token file %s: %w", s.path, err)
+	}
+
+	s.mu.Lock()
+	s.identities = identities
+	s.mu.Unlock()
+
+	log.Info().Str("path", s.path).Int("tokens", len(identities)).Msg("Loaded token file")
+	return nil
+}
+
+// Watch reloads the token file whenever it changes until ctx is cancelled
+func (s *FileTokenStore) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if !s.changed() {
+				continue
+			}
+			if err := s.Reload(); err != nil {
+				log.Error().Err(err).Msg("Failed to reload token file, keeping previous tokens")
+			}
+		}
+	}
+}
+
+// changed reports whether the token file differs from the loaded one
+func (s *FileTokenStore) changed() bool {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		log.Error().Err(err).Str("path", s.path).Msg("Failed to stat token file")
+		return false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return !info.ModTime().Equal(s.modTime) || info.Size() != s.size
+}
+
+// validUser reports whether a user is safe to use in cache filenames and
+// object keys
+func validUser(user string) bool {
+	if strings.Contains(user, "/") || strings.Contains(user, "..") {
+		return false
+	}
+	return !strings.ContainsFunc(user, unicode.IsControl)
+}
+
+func parseTokenFile(data []byte) (map[string]*Identity, error) {
+	var file tokenFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	identities := make(map[string]*Identity, len(file.Tokens))
+	for i, entry := range file.Tokens {
+		hash := strings.ToLower(entry.SHA256)
+		if decoded, err := hex.DecodeString(hash); err != nil || len(decoded) != 32 {
+			return nil, fmt.Errorf("token %d: sha256 must be 64 hex characters", i)
+		}
+		if entry.User == "" {
+			return nil, fmt.Errorf("token %d: user is required", i)
+		}
+		if !validUser(entry.User) {
+			return nil, fmt.Errorf("token %d: user must not contain /, .. or control characters", i)
+		}
+		if _, ok := identities[hash]; ok {
+			return nil, fmt.Errorf("token %d: duplicate sha256", i)
+		}
+
+		identities[hash] = &Identity{
+			User:          entry.User,
+			Endpoints:     entry.Endpoints,
+			ExpiresAt:     entry.ExpiresAt,
+			SigningSecret: entry.SigningSecret,
+		}
+	}
+
+	return identities, nil
+}
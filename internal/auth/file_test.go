@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeTokenFile(t *testing.T, path, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+}
+
+func TestFileTokenStore_Lookup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.yml")
+	writeTokenFile(t, path, `
+tokens:
+  - sha256: `+HashToken("secret-a")+`
+    user: acme
+  - sha256: `+HashToken("secret-b")+`
+    user: globex
+    endpoints: ["/usage"]
+    expires_at: 2030-01-01T00:00:00Z
+    signing_secret: install-secret
+`)
+
+	store, err := NewFileTokenStore(path)
+	require.NoError(t, err)
+	store.now = func() time.Time { return time.Date(2029, 1, 1, 0, 0, 0, 0, time.UTC) }
+
+	identity, err := store.Lookup("secret-a")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", identity.User)
+	assert.True(t, identity.Allows("/specimen"))
+
+	identity, err = store.Lookup("secret-b")
+	require.NoError(t, err)
+	assert.Equal(t, "globex", identity.User)
+	assert.True(t, identity.Allows("/usage"))
+	assert.False(t, identity.Allows("/error"))
+	assert.Equal(t, "install-secret", identity.SigningSecret)
+
+	_, err = store.Lookup("acme")
+	assert.ErrorIs(t, err, ErrUnknownToken)
+
+	store.now = func() time.Time { return time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC) }
+	_, err = store.Lookup("secret-b")
+	assert.ErrorIs(t, err, ErrTokenExpired)
+}
+
+func TestFileTokenStore_JSON(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.json")
+	writeTokenFile(t, path, `{"tokens": [{"sha256": "`+HashToken("secret")+`", "user": "acme", "expires_at": "2030-01-01T00:00:00Z"}]}`)
+
+	store, err := NewFileTokenStore(path)
+	require.NoError(t, err)
+
+	identity, err := store.Lookup("secret")
+	require.NoError(t, err)
+	assert.Equal(t, "acme", identity.User)
+	assert.Equal(t, time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC), identity.ExpiresAt)
+}
+
+func TestFileTokenStore_Invalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{name: "plain token", content: "tokens:\n  - sha256: secret\n    user: acme\n"},
+		{name: "missing user", content: "tokens:\n  - sha256: " + HashToken("secret") + "\n"},
+		{name: "duplicate", content: "tokens:\n  - sha256: " + HashToken("secret") + "\n    user: a\n  - sha256: " + HashToken("secret") + "\n    user: b\n"},
+		{name: "malformed", content: "tokens: ["},
+		{name: "user with slash", content: "tokens:\n  - sha256: " + HashToken("secret") + "\n    user: acme/admin\n"},
+		{name: "user with dots", content: "tokens:\n  - sha256: " + HashToken("secret") + "\n    user: ..\n"},
+		{name: "user with control character", content: "tokens:\n  - sha256: " + HashToken("secret") + "\n    user: \"acme\\n\"\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "tokens.yml")
+			writeTokenFile(t, path, tt.content)
+
+			_, err := NewFileTokenStore(path)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := NewFileTokenStore(filepath.Join(t.TempDir(), "missing.yml"))
+	assert.Error(t, err)
+}
+
+func TestFileTokenStore_Watch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tokens.yml")
+	writeTokenFile(t, path, "tokens:\n  - sha256: "+HashToken("old")+"\n    user: acme\n")
+
+	store, err := NewFileTokenStore(path)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go store.Watch(ctx, 10*time.Millisecond)
+
+	// An invalid file keeps the previous tokens
+	writeTokenFile(t, path, "tokens: [")
+	time.Sleep(50 * time.Millisecond)
+	_, err = store.Lookup("old")
+	assert.NoError(t, err)
+
+	writeTokenFile(t, path, "tokens:\n  - sha256: "+HashToken("rotated")+"\n    user: acme\n")
+	assert.Eventually(t, func() bool {
+		_, err := store.Lookup("rotated")
+		return err == nil
+	}, time.Second, 10*time.Millisecond)
+
+	_, err = store.Lookup("old")
+	assert.ErrorIs(t, err, ErrUnknownToken)
+}
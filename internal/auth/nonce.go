@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// NonceCache remembers nonces for a fixed period to reject replayed requests
+type NonceCache struct {
+	ttl time.Duration
+
+	mu        sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}
+
+// NewNonceCache creates a nonce cache. ttl should cover the whole window in
+// which a timestamp is accepted, i.e. twice the allowed clock skew.
+func NewNonceCache(ttl time.Duration) *NonceCache {
+	return &NonceCache{
+		ttl:  ttl,
+		seen: make(map[string]time.Time),
+	}
+}
+
+// Add records a nonce and reports whether it was not seen before
+func (n *NonceCache) Add(nonce string, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if now.Sub(n.lastSweep) >= n.ttl {
+		for key, expires := range n.seen {
+			if !now.Before(expires) {
+				delete(n.seen, key)
+			}
+		}
+		n.lastSweep = now
+	}
+
+	if expires, ok := n.seen[nonce]; ok && now.Before(expires) {
+		return false
+	}
+	n.seen[nonce] = now.Add(n.ttl)
+	return true
+}
+
+// Len returns the number of remembered nonces
+func (n *NonceCache) Len() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.seen)
+}
@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	request := SignedRequest{
+		Method:    "PUT",
+		URI:       "/usage",
+		Timestamp: strconv.FormatInt(now.Unix(), 10),
+		Nonce:     "nonce-1",
+		Body:      []byte(`{"event": "test"}`),
+	}
+	signature := Sign("secret", request)
+
+	tests := []struct {
+		name      string
+		modify    func(r *SignedRequest)
+		signature string
+		now       time.Time
+		wantErr   error
+	}{
+		{
+			name:      "valid",
+			signature: signature,
+			now:       now,
+		},
+		{
+			name:      "within skew",
+			signature: signature,
+			now:       now.Add(4 * time.Minute),
+		},
+		{
+			name:      "missing signature",
+			signature: "",
+			now:       now,
+			wantErr:   ErrSignatureMissing,
+		},
+		{
+			name:      "missing nonce",
+			modify:    func(r *SignedRequest) { r.Nonce = "" },
+			signature: signature,
+			now:       now,
+			wantErr:   ErrSignatureMissing,
+		},
+		{
+			name:      "invalid timestamp",
+			modify:    func(r *SignedRequest) { r.Timestamp = "yesterday" },
+			signature: signature,
+			now:       now,
+			wantErr:   ErrTimestampInvalid,
+		},
+		{
+			name:      "timestamp too old",
+			signature: signature,
+			now:       now.Add(6 * time.Minute),
+			wantErr:   ErrTimestampSkewed,
+		},
+		{
+			name:      "timestamp in the future",
+			signature: signature,
+			now:       now.Add(-6 * time.Minute),
+			wantErr:   ErrTimestampSkewed,
+		},
+		{
+			name:      "tampered body",
+			modify:    func(r *SignedRequest) { r.Body = []byte(`{"event": "tampered"}`) },
+			signature: signature,
+			now:       now,
+			wantErr:   ErrSignatureInvalid,
+		},
+		{
+			name:      "tampered uri",
+			modify:    func(r *SignedRequest) { r.URI = "/error" },
+			signature: signature,
+			now:       now,
+			wantErr:   ErrSignatureInvalid,
+		},
+		{
+			name:      "malformed signature",
+			signature: "not-hex",
+			now:       now,
+			wantErr:   ErrSignatureInvalid,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := request
+			if tt.modify != nil {
+				tt.modify(&r)
+			}
+			err := Verify("secret", r, tt.signature, tt.now, 5*time.Minute)
+			if tt.wantErr != nil {
+				assert.ErrorIs(t, err, tt.wantErr)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	now := time.Now()
+	nonces := NewNonceCache(time.Minute)
+
+	assert.True(t, nonces.Add("a", now))
+	assert.False(t, nonces.Add("a", now.Add(30*time.Second)))
+	assert.True(t, nonces.Add("b", now.Add(30*time.Second)))
+
+	// Expired nonces are swept and may be reused
+	assert.True(t, nonces.Add("a", now.Add(2*time.Minute)))
+	assert.Equal(t, 1, nonces.Len())
+}
@@ -0,0 +1,51 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"time"
+)
+
+// Authentication errors
+var (
+	ErrUnknownToken = errors.New("unknown token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Identity is the user a token authenticates as
+type Identity struct {
+	User string
+
+	// Endpoints restricts the token to these route paths; empty allows all
+	Endpoints []string
+
+	// ExpiresAt is the expiry of the token; zero means it never expires
+	ExpiresAt time.Time
+
+	// SigningSecret is the HMAC key requests must be signed with; empty disables signing
+	SigningSecret string
+}
+
+// Allows reports whether the identity may access the route path
+func (i *Identity) Allows(endpoint string) bool {
+	return len(i.Endpoints) == 0 || slices.Contains(i.Endpoints, endpoint)
+}
+
+// Expired reports whether the token has expired at the given time
+func (i *Identity) Expired(now time.Time) bool {
+	return !i.ExpiresAt.IsZero() && !now.Before(i.ExpiresAt)
+}
+
+// TokenStore resolves tokens to identities
+type TokenStore interface {
+	// Lookup returns the identity of a token, or ErrUnknownToken / ErrTokenExpired
+	Lookup(token string) (*Identity, error)
+}
+
+// HashToken returns the hex-encoded SHA-256 of a token as stored in token files
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,84 @@
+package cache
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Backpressure refuses ingestion while the cache directory is above its high
+// water marks, until it drains below the low water marks
+type Backpressure struct {
+	manager *Manager
+	config  config.BackpressureConfig
+	now     func() time.Time
+
+	mu            sync.Mutex
+	engaged       bool
+	lastRequested time.Time
+}
+
+// NewBackpressure creates a backpressure guard for a cache manager
+func NewBackpressure(manager *Manager, cfg config.BackpressureConfig) *Backpressure {
+	return &Backpressure{
+		manager: manager,
+		config:  cfg,
+		now:     time.Now,
+	}
+}
+
+// Engaged reports whether ingestion should be refused. While engaged, an
+// immediate aggregation and retry of failed uploads is requested at most
+// once per RetryAfter.
+func (b *Backpressure) Engaged() bool {
+	if b.config.HighWaterBytes <= 0 && b.config.HighWaterFiles <= 0 {
+		return false
+	}
+
+	usage := b.manager.Usage()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.engaged && b.above(usage) {
+		b.engaged = true
+		log.Warn().
+			Int64("bytes", usage.Bytes).
+			Int64("files", usage.Files).
+			Msg("Cache above high water mark, refusing ingestion")
+	} else if b.engaged && b.below(usage) {
+		b.engaged = false
+		log.Info().
+			Int64("bytes", usage.Bytes).
+			Int64("files", usage.Files).
+			Msg("Cache below low water mark, resuming ingestion")
+	}
+
+	if b.engaged {
+		now := b.now()
+		if now.Sub(b.lastRequested) >= b.config.RetryAfter {
+			b.lastRequested = now
+			b.manager.RequestAggregation("usage")
+			b.manager.RequestAggregation("error")
+			b.manager.RequestRetry()
+		}
+	}
+	return b.engaged
+}
+
+// RetryAfter returns how long refused clients should wait
+func (b *Backpressure) RetryAfter() time.Duration {
+	return b.config.RetryAfter
+}
+
+func (b *Backpressure) above(usage Usage) bool {
+	return (b.config.HighWaterBytes > 0 && usage.Bytes >= b.config.HighWaterBytes) ||
+		(b.config.HighWaterFiles > 0 && usage.Files >= b.config.HighWaterFiles)
+}
+
+func (b *Backpressure) below(usage Usage) bool {
+	return (b.config.HighWaterBytes <= 0 || usage.Bytes <= b.config.LowWaterBytes) &&
+		(b.config.HighWaterFiles <= 0 || usage.Files <= b.config.LowWaterFiles)
+}
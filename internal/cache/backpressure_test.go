@@ -0,0 +1,65 @@
+package cache
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackpressure_Engaged(t *testing.T) {
+	manager := NewManager(t.TempDir())
+	require.NoError(t, manager.Init())
+
+	backpressure := NewBackpressure(manager, config.BackpressureConfig{
+		HighWaterFiles: 3,
+		LowWaterFiles:  1,
+		RetryAfter:     time.Minute,
+	})
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	backpressure.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		require.NoError(t, manager.SaveUsage("testuser", []byte(`{}`)))
+		assert.False(t, backpressure.Engaged())
+	}
+
+	// Above the high water mark an aggregation is requested once per RetryAfter
+	require.NoError(t, manager.SaveUsage("testuser", []byte(`{}`)))
+	assert.True(t, backpressure.Engaged())
+	assert.Len(t, manager.AggregationRequests("usage"), 1)
+	assert.Len(t, manager.AggregationRequests("error"), 1)
+	assert.Len(t, manager.RetryRequests(), 1)
+	<-manager.AggregationRequests("usage")
+	assert.True(t, backpressure.Engaged())
+	assert.Empty(t, manager.AggregationRequests("usage"))
+
+	now = now.Add(time.Minute)
+	assert.True(t, backpressure.Engaged())
+	assert.Len(t, manager.AggregationRequests("usage"), 1)
+
+	// Still engaged between the water marks
+	files, err := manager.GetUsageFiles()
+	require.NoError(t, err)
+	require.NoError(t, manager.RemoveFile(files[0]))
+	assert.True(t, backpressure.Engaged())
+
+	// Released at the low water mark
+	require.NoError(t, manager.RemoveFile(files[1]))
+	assert.False(t, backpressure.Engaged())
+	require.NoError(t, manager.SaveUsage("testuser", []byte(`{}`)))
+	assert.False(t, backpressure.Engaged())
+}
+
+func TestBackpressure_Disabled(t *testing.T) {
+	manager := NewManager(t.TempDir())
+	require.NoError(t, manager.Init())
+	require.NoError(t, manager.SaveUsage("testuser", []byte(`{}`)))
+
+	backpressure := NewBackpressure(manager, config.BackpressureConfig{})
+	assert.False(t, backpressure.Engaged())
+	assert.Empty(t, manager.AggregationRequests("usage"))
+	assert.Empty(t, manager.RetryRequests())
+}
@@ -1,6 +1,8 @@
 package cache
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"net/url"
@@ -10,16 +12,62 @@ import (
 	"time"
 )
 
+// SpecimenMeta holds the metadata stored alongside a cached specimen
+type SpecimenMeta struct {
+	User        string `json:"user"`
+	URI         string `json:"uri"`
+	ContentType string `json:"content_type,omitempty"`
+	RequestID   string `json:"request_id,omitempty"`
+}
+
+// DirStats summarizes the files in a cache directory
+type DirStats struct {
+	Files  int
+	Oldest time.Time
+}
+
 // Manager handles cache file operations
 type Manager struct {
 	BaseDir string
 	mu      sync.RWMutex
+
+	// Files currently being uploaded
+	claimMu sync.Mutex
+	claimed map[string]struct{}
+
+	// Size and number of files in the cache directory
+	usage usageTracker
+
+	// Data waiting for aggregation per data type, and the thresholds that
+	// trigger an aggregation before its interval
+	pending           map[string]*usageTracker
+	aggregateMaxBytes int64
+	aggregateMaxFiles int64
+
+	// Requests for an immediate aggregation per data type, and for an
+	// immediate retry of failed uploads
+	aggregationRequests map[string]chan struct{}
+	retryRequests       chan struct{}
+
+	// Segment logs per data type, if usage and error reports use segments
+	segments map[string]*segmentLog
 }
 
 // NewManager creates a new cache manager
 func NewManager(baseDir string) *Manager {
 	return &Manager{
 		BaseDir: baseDir,
+		claimed: make(map[string]struct{}),
+
+		pending: map[string]*usageTracker{
+			"usage": {},
+			"error": {},
+		},
+		aggregationRequests: map[string]chan struct{}{
+			"usage": make(chan struct{}, 1),
+			"error": make(chan struct{}, 1),
+		},
+		retryRequests: make(chan struct{}, 1),
 	}
 }
 
@@ -29,11 +77,22 @@ func (m *Manager) Init() error {
 		filepath.Join(m.BaseDir, "usage"),
 		filepath.Join(m.BaseDir, "usage", "aggregation"),
 		filepath.Join(m.BaseDir, "usage", "uploading"),
+		filepath.Join(m.BaseDir, "usage", "retry"),
+		filepath.Join(m.BaseDir, "usage", "deadletter"),
+		filepath.Join(m.BaseDir, "usage", "active"),
 		filepath.Join(m.BaseDir, "error"),
 		filepath.Join(m.BaseDir, "error", "aggregation"),
 		filepath.Join(m.BaseDir, "error", "uploading"),
+		filepath.Join(m.BaseDir, "error", "retry"),
+		filepath.Join(m.BaseDir, "error", "deadletter"),
+		filepath.Join(m.BaseDir, "error", "active"),
 		filepath.Join(m.BaseDir, "specimen"),
 		filepath.Join(m.BaseDir, "specimen", "uploading"),
+		filepath.Join(m.BaseDir, "specimen", "meta"),
+		filepath.Join(m.BaseDir, "specimen", "retry"),
+		filepath.Join(m.BaseDir, "specimen", "deadletter"),
+		filepath.Join(m.BaseDir, "tmp"),
+		filepath.Join(m.BaseDir, "quota"),
 	}
 
 	for _, dir := range dirs {
@@ -42,28 +101,107 @@ func (m *Manager) Init() error {
 		}
 	}
 
+	// Files left in tmp were interrupted before completion
+	tmpDir := filepath.Join(m.BaseDir, "tmp")
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return fmt.Errorf("failed to read directory %s: %w", tmpDir, err)
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(tmpDir, entry.Name())); err != nil {
+			return fmt.Errorf("failed to remove incomplete file: %w", err)
+		}
+	}
+
+	// Segments left open are sealed, even if segments are no longer used
+	if err := m.recoverSegments(); err != nil {
+		return fmt.Errorf("failed to recover segments: %w", err)
+	}
+
+	if err := m.Rescan(); err != nil {
+		return fmt.Errorf("failed to scan cache directory: %w", err)
+	}
+
 	return nil
 }
 
 // SaveUsage saves usage data to cache
 func (m *Manager) SaveUsage(user string, data []byte) error {
+	if segments := m.segments["usage"]; segments != nil {
+		return segments.append(user, data)
+	}
 	filename := m.generateFilename(user)
 	path := filepath.Join(m.BaseDir, "usage", filename)
-	return m.saveFile(path, data)
+	if err := m.saveFile(path, data); err != nil {
+		return err
+	}
+	m.addPending("usage", int64(len(data)), 1)
+	return nil
 }
 
 // SaveError saves error data to cache
 func (m *Manager) SaveError(user string, data []byte) error {
+	if segments := m.segments["error"]; segments != nil {
+		return segments.append(user, data)
+	}
 	filename := m.generateFilename(user)
 	path := filepath.Join(m.BaseDir, "error", filename)
-	return m.saveFile(path, data)
+	if err := m.saveFile(path, data); err != nil {
+		return err
+	}
+	m.addPending("error", int64(len(data)), 1)
+	return nil
 }
 
-// SaveSpecimen saves specimen data to cache
-func (m *Manager) SaveSpecimen(uri string, data []byte) error {
-	filename := m.generateSpecimenFilename(uri)
+// SaveSpecimen streams specimen data to cache together with its metadata and
+// returns the path of the specimen and the number of bytes written. The metadata is written first so that
+// a specimen never exists without it, and the data is written to the tmp
+// directory and moved into place once complete so a partial specimen is never
+// picked up for upload.
+func (m *Manager) SaveSpecimen(meta SpecimenMeta, r io.Reader) (string, int64, error) {
+	filename := m.generateSpecimenFilename(meta.URI)
+
+	metaData, err := json.Marshal(meta)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to encode specimen metadata: %w", err)
+	}
+	metaPath := m.specimenMetaPath(filename)
+	if err := m.saveFile(metaPath, metaData); err != nil {
+		return "", 0, err
+	}
+
 	path := filepath.Join(m.BaseDir, "specimen", filename)
-	return m.saveFile(path, data)
+	size, err := m.streamFile(path, r)
+	if err != nil {
+		m.removeTracked(metaPath)
+		return "", 0, err
+	}
+	return path, size, nil
+}
+
+// ReadSpecimenMeta reads the metadata of a cached specimen
+func (m *Manager) ReadSpecimenMeta(path string) (*SpecimenMeta, error) {
+	data, err := os.ReadFile(m.specimenMetaPath(filepath.Base(path)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read specimen metadata: %w", err)
+	}
+
+	var meta SpecimenMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, fmt.Errorf("failed to decode specimen metadata: %w", err)
+	}
+	return &meta, nil
+}
+
+// RemoveSpecimen removes a specimen file and its metadata from cache
+func (m *Manager) RemoveSpecimen(path string) error {
+	if err := m.removeTracked(path); err != nil {
+		return err
+	}
+	if err := m.removeTracked(m.specimenMetaPath(filepath.Base(path))); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 // GetUsageFiles returns all usage files ready for aggregation
@@ -88,32 +226,45 @@ func (m *Manager) MoveToAggregation(files []string, dataType string) error {
 
 	aggregationDir := filepath.Join(m.BaseDir, dataType, "aggregation")
 	for _, file := range files {
+		info, statErr := os.Stat(file)
 		filename := filepath.Base(file)
 		dest := filepath.Join(aggregationDir, filename)
 		if err := os.Rename(file, dest); err != nil {
 			return fmt.Errorf("failed to move file %s: %w", file, err)
 		}
+		if statErr == nil {
+			m.addPending(dataType, -info.Size(), -1)
+		}
 	}
 	return nil
 }
 
-// MoveToUploading moves files to uploading directory
+// MoveToUploading moves files to uploading directory. The directory is
+// synced so the moved file survives a crash once MoveToUploading returns.
 func (m *Manager) MoveToUploading(file string, dataType string) (string, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
-	uploadingDir := filepath.Join(m.BaseDir, dataType, "uploading")
-	filename := filepath.Base(file)
-	dest := filepath.Join(uploadingDir, filename)
+	dest := m.UploadingPath(file, dataType)
+	uploadingDir := filepath.Dir(dest)
 	if err := os.Rename(file, dest); err != nil {
 		return "", fmt.Errorf("failed to move file %s: %w", file, err)
 	}
+	if err := SyncDir(uploadingDir); err != nil {
+		return "", fmt.Errorf("failed to sync directory: %w", err)
+	}
 	return dest, nil
 }
 
+// UploadingPath returns the path MoveToUploading moves a file to, so that
+// the destination can be claimed before the move
+func (m *Manager) UploadingPath(file string, dataType string) string {
+	return filepath.Join(m.BaseDir, dataType, "uploading", filepath.Base(file))
+}
+
 // RemoveFile removes a file from cache
 func (m *Manager) RemoveFile(path string) error {
-	return os.Remove(path)
+	return m.removeTracked(path)
 }
 
 // GetAggregationFiles returns files in aggregation directory
@@ -121,9 +272,51 @@ func (m *Manager) GetAggregationFiles(dataType string) ([]string, error) {
 	return m.getFiles(filepath.Join(m.BaseDir, dataType, "aggregation"))
 }
 
-// GetUploadingFiles returns files in uploading directory
+// GetUploadingFiles returns files in uploading directory, excluding
+// multipart upload state
 func (m *Manager) GetUploadingFiles(dataType string) ([]string, error) {
-	return m.getFiles(filepath.Join(m.BaseDir, dataType, "uploading"))
+	files, err := m.getFiles(filepath.Join(m.BaseDir, dataType, "uploading"))
+	if err != nil {
+		return nil, err
+	}
+
+	uploading := files[:0]
+	for _, file := range files {
+		if !isMultipartState(file) {
+			uploading = append(uploading, file)
+		}
+	}
+	return uploading, nil
+}
+
+// GetDirStats returns the file count and oldest modification time of a
+// cache directory. An empty dir refers to the incoming directory of the data type.
+func (m *Manager) GetDirStats(dataType string, dir string) (DirStats, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries, err := os.ReadDir(filepath.Join(m.BaseDir, dataType, dir))
+	if err != nil {
+		return DirStats{}, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	var stats DirStats
+	for _, entry := range entries {
+		if entry.IsDir() || isMultipartState(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			// Removed while listing
+			continue
+		}
+		stats.Files++
+		if stats.Oldest.IsZero() || info.ModTime().Before(stats.Oldest) {
+			stats.Oldest = info.ModTime()
+		}
+	}
+
+	return stats, nil
 }
 
 // ReadFile reads a cache file
@@ -188,21 +381,70 @@ func (m *Manager) generateSpecimenFilename(uri string) string {
 	return fmt.Sprintf("%s.%d.%s", timestamp, os.Getpid(), encodedURI)
 }
 
-// saveFile saves data to a file
+// specimenMetaPath returns the metadata path for a specimen filename
+func (m *Manager) specimenMetaPath(filename string) string {
+	return filepath.Join(m.BaseDir, "specimen", "meta", filename+".json")
+}
+
+// saveFile durably writes data to a file, see streamFile
 func (m *Manager) saveFile(path string, data []byte) error {
-	m.mu.Lock()
-	defer m.mu.Unlock()
+	_, err := m.streamFile(path, bytes.NewReader(data))
+	return err
+}
 
-	file, err := os.Create(path)
+// streamFile durably copies r to path. The data is written and synced to a
+// temporary file, then renamed into place and the directory synced, so path
+// never holds a partial file and survives a crash once streamFile returns.
+// The lock is only held for the rename so large bodies do not block other writers.
+func (m *Manager) streamFile(path string, r io.Reader) (int64, error) {
+	file, err := os.CreateTemp(filepath.Join(m.BaseDir, "tmp"), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, fmt.Errorf("failed to create file: %w", err)
+	}
+	tmpPath := file.Name()
+
+	size, err := io.Copy(file, r)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
 	if err != nil {
-		return fmt.Errorf("failed to create file: %w", err)
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to write file: %w", err)
 	}
-	defer file.Close()
 
-	if _, err := file.Write(data); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+	if err := m.rename(tmpPath, path, size); err != nil {
+		os.Remove(tmpPath)
+		return 0, fmt.Errorf("failed to move file: %w", err)
 	}
 
+	if err := SyncDir(filepath.Dir(path)); err != nil {
+		return 0, fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return size, nil
+}
+
+// rename moves a written file into place and updates the tracked usage.
+// Overwritten files are replaced in the tracked usage.
+func (m *Manager) rename(tmpPath, path string, size int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var previous int64
+	var files int64 = 1
+	if info, err := os.Stat(path); err == nil {
+		previous = info.Size()
+		files = 0
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	if m.tracked(path) {
+		m.usage.add(size-previous, files)
+	}
 	return nil
 }
 
@@ -1,11 +1,17 @@
 package cache
 
 import (
+	"bytes"
+	"errors"
+	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"time"
 
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -22,11 +28,20 @@ func TestManager_Init(t *testing.T) {
 		"usage",
 		"usage/aggregation",
 		"usage/uploading",
+		"usage/retry",
+		"usage/deadletter",
 		"error",
 		"error/aggregation",
 		"error/uploading",
+		"error/retry",
+		"error/deadletter",
 		"specimen",
 		"specimen/uploading",
+		"specimen/meta",
+		"specimen/retry",
+		"specimen/deadletter",
+		"tmp",
+		"quota",
 	}
 
 	for _, dir := range expectedDirs {
@@ -70,8 +85,15 @@ func TestManager_SaveAndGetFiles(t *testing.T) {
 	t.Run("SaveSpecimen", func(t *testing.T) {
 		data := []byte("specimen data")
 		uri := "http://example.com/test.png"
-		err := manager.SaveSpecimen(uri, data)
+		meta := SpecimenMeta{
+			User:        "testuser",
+			URI:         uri,
+			ContentType: "image/png",
+			RequestID:   "request-1",
+		}
+		_, size, err := manager.SaveSpecimen(meta, bytes.NewReader(data))
 		require.NoError(t, err)
+		assert.Equal(t, int64(len(data)), size)
 
 		files, err := manager.GetSpecimenFiles()
 		require.NoError(t, err)
@@ -82,9 +104,44 @@ func TestManager_SaveAndGetFiles(t *testing.T) {
 		require.NoError(t, err)
 		assert.Equal(t, uri, parsedURI)
 		assert.WithinDuration(t, time.Now().UTC(), timestamp, 10*time.Second)
+
+		// Metadata follows the file into the uploading directory
+		uploadingPath, err := manager.MoveToUploading(files[0], "specimen")
+		require.NoError(t, err)
+
+		readMeta, err := manager.ReadSpecimenMeta(uploadingPath)
+		require.NoError(t, err)
+		assert.Equal(t, meta, *readMeta)
+
+		// RemoveSpecimen removes both the file and its metadata
+		require.NoError(t, manager.RemoveSpecimen(uploadingPath))
+		_, err = manager.ReadSpecimenMeta(uploadingPath)
+		assert.Error(t, err)
+		_, err = os.Stat(uploadingPath)
+		assert.True(t, os.IsNotExist(err))
 	})
 }
 
+func TestManager_SaveSpecimenReadError(t *testing.T) {
+	tempDir := t.TempDir()
+	manager := NewManager(tempDir)
+	require.NoError(t, manager.Init())
+
+	body := io.MultiReader(bytes.NewReader([]byte("partial")), iotest.ErrReader(errors.New("connection reset")))
+	_, _, err := manager.SaveSpecimen(SpecimenMeta{User: "testuser", URI: "http://example.com/test.png"}, body)
+	assert.Error(t, err)
+
+	// Neither the partial specimen nor its metadata are left behind
+	files, err := manager.GetSpecimenFiles()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	for _, dir := range []string{"specimen/meta", "tmp"} {
+		entries, err := os.ReadDir(filepath.Join(tempDir, dir))
+		require.NoError(t, err)
+		assert.Empty(t, entries, dir)
+	}
+}
+
 func TestManager_MoveOperations(t *testing.T) {
 	tempDir := t.TempDir()
 	manager := NewManager(tempDir)
@@ -128,6 +185,35 @@ func TestManager_MoveOperations(t *testing.T) {
 	})
 }
 
+func TestManager_GetDirStats(t *testing.T) {
+	tempDir := t.TempDir()
+	manager := NewManager(tempDir)
+	require.NoError(t, manager.Init())
+
+	stats, err := manager.GetDirStats("usage", "")
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.Files)
+	assert.True(t, stats.Oldest.IsZero())
+
+	require.NoError(t, manager.SaveUsage("testuser", []byte(`{}`)))
+	require.NoError(t, manager.SaveUsage("testuser", []byte(`{}`)))
+
+	files, err := manager.GetUsageFiles()
+	require.NoError(t, err)
+	oldest := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(files[1], oldest, oldest))
+
+	// Subdirectories are not counted as files
+	stats, err = manager.GetDirStats("usage", "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, stats.Files)
+	assert.True(t, oldest.Equal(stats.Oldest))
+
+	stats, err = manager.GetDirStats("usage", "uploading")
+	require.NoError(t, err)
+	assert.Equal(t, 0, stats.Files)
+}
+
 func TestManager_generateFilename(t *testing.T) {
 	manager := NewManager("/tmp")
 
@@ -185,4 +271,112 @@ func TestManager_GetSpecimenInfo(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestManager_Usage(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Existing files are counted on Init
+	require.NoError(t, os.MkdirAll(filepath.Join(tempDir, "usage"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "usage", "existing"), []byte("12345"), 0644))
+
+	manager := NewManager(tempDir)
+	require.NoError(t, manager.Init())
+	assert.Equal(t, Usage{Bytes: 5, Files: 1}, manager.Usage())
+
+	// Writes are tracked incrementally
+	require.NoError(t, manager.SaveUsage("testuser", []byte("1234567890")))
+	_, _, err := manager.SaveSpecimen(SpecimenMeta{User: "testuser", URI: "http://example.com/test.png"}, strings.NewReader("specimen"))
+	require.NoError(t, err)
+
+	usage := manager.Usage()
+	assert.Equal(t, int64(4), usage.Files)
+
+	// Removals are tracked incrementally
+	usageFiles, err := manager.GetUsageFiles()
+	require.NoError(t, err)
+	for _, file := range usageFiles {
+		require.NoError(t, manager.RemoveFile(file))
+	}
+	specimenFiles, err := manager.GetSpecimenFiles()
+	require.NoError(t, err)
+	require.NoError(t, manager.RemoveSpecimen(specimenFiles[0]))
+	assert.Equal(t, Usage{}, manager.Usage())
+
+	// Rescan corrects files changed outside the manager
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "error", "external"), []byte("123"), 0644))
+	require.NoError(t, manager.Rescan())
+	assert.Equal(t, Usage{Bytes: 3, Files: 1}, manager.Usage())
+	assert.Equal(t, Usage{Bytes: 3, Files: 1}, manager.Pending("error"))
+
+	// Dead letters and quota counters are not counted
+	uploading, err := manager.MoveToUploading(filepath.Join(tempDir, "error", "external"), "error")
+	require.NoError(t, err)
+	_, err = manager.MoveToDeadLetter(uploading, "error")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "quota", "2024-01-02.json"), []byte("{}"), 0644))
+	assert.Equal(t, Usage{}, manager.Usage())
+	require.NoError(t, manager.Rescan())
+	assert.Equal(t, Usage{}, manager.Usage())
+}
+
+func TestManager_SaveUsageAtomic(t *testing.T) {
+	tempDir := t.TempDir()
+	manager := NewManager(tempDir)
+	require.NoError(t, manager.Init())
+
+	require.NoError(t, manager.SaveUsage("testuser", []byte(`{"event":"a"}`)))
+
+	// The file is complete in place and nothing is left in tmp
+	files, err := manager.GetUsageFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, `{"event":"a"}`, string(data))
+
+	entries, err := os.ReadDir(filepath.Join(tempDir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestManager_InitRemovesIncompleteFiles(t *testing.T) {
+	tempDir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(tempDir, "tmp"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(tempDir, "tmp", "partial.123"), []byte("{\"ev"), 0644))
+
+	manager := NewManager(tempDir)
+	require.NoError(t, manager.Init())
+
+	entries, err := os.ReadDir(filepath.Join(tempDir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+	assert.Equal(t, Usage{}, manager.Usage())
+}
+
+func TestManager_AggregationThresholds(t *testing.T) {
+	manager := NewManager(t.TempDir())
+	manager.SetAggregationThresholds(config.AggregationConfig{MaxBytes: 100, MaxFiles: 3})
+	require.NoError(t, manager.Init())
+
+	// File threshold
+	for i := 0; i < 2; i++ {
+		require.NoError(t, manager.SaveUsage("testuser", []byte(`{}`)))
+	}
+	assert.Empty(t, manager.AggregationRequests("usage"))
+	require.NoError(t, manager.SaveUsage("testuser", []byte(`{}`)))
+	assert.Len(t, manager.AggregationRequests("usage"), 1)
+	assert.Empty(t, manager.AggregationRequests("error"))
+	assert.Equal(t, Usage{Bytes: 6, Files: 3}, manager.Pending("usage"))
+
+	// Moving files to aggregation clears the pending data
+	<-manager.AggregationRequests("usage")
+	files, err := manager.GetUsageFiles()
+	require.NoError(t, err)
+	require.NoError(t, manager.MoveToAggregation(files, "usage"))
+	assert.Equal(t, Usage{}, manager.Pending("usage"))
+
+	// Byte threshold
+	require.NoError(t, manager.SaveError("testuser", bytes.Repeat([]byte("x"), 100)))
+	assert.Len(t, manager.AggregationRequests("error"), 1)
+}
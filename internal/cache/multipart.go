@@ -0,0 +1,33 @@
+package cache
+
+import (
+	"os"
+	"strings"
+)
+
+// MultipartStateSuffix is appended to the path of an uploading file to store
+// the state of its multipart upload, so an interrupted upload can resume
+const MultipartStateSuffix = ".multipart"
+
+// MultipartStatePath returns the multipart upload state path of an uploading file
+func MultipartStatePath(path string) string {
+	return path + MultipartStateSuffix
+}
+
+// isMultipartState reports whether a file holds multipart upload state
+func isMultipartState(name string) bool {
+	return strings.HasSuffix(name, MultipartStateSuffix)
+}
+
+// SaveMultipartState durably saves the multipart upload state of an uploading file
+func (m *Manager) SaveMultipartState(path string, data []byte) error {
+	return m.saveFile(MultipartStatePath(path), data)
+}
+
+// RemoveMultipartState removes the multipart upload state of an uploading file, if any
+func (m *Manager) RemoveMultipartState(path string) error {
+	if err := m.removeTracked(MultipartStatePath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// QuotaPath returns the path of the daily quota counters of a UTC day
+func (m *Manager) QuotaPath(day string) string {
+	return filepath.Join(m.BaseDir, "quota", day+".json")
+}
+
+// SaveQuota durably saves the daily quota counters of a UTC day
+func (m *Manager) SaveQuota(day string, data []byte) error {
+	return m.saveFile(m.QuotaPath(day), data)
+}
+
+// ReadQuota reads the daily quota counters of a UTC day
+func (m *Manager) ReadQuota(day string) ([]byte, error) {
+	return os.ReadFile(m.QuotaPath(day))
+}
+
+// RemoveQuotasExcept removes the quota counters of every day but the given one
+func (m *Manager) RemoveQuotasExcept(day string) error {
+	files, err := m.getFiles(filepath.Join(m.BaseDir, "quota"))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if strings.HasSuffix(file, ".json") && file != m.QuotaPath(day) {
+			if err := m.removeTracked(file); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,101 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// RetryState records the upload attempts of a file in an uploading directory
+type RetryState struct {
+	Attempts    int       `json:"attempts"`
+	LastAttempt time.Time `json:"last_attempt"`
+	NextAttempt time.Time `json:"next_attempt"`
+	LastError   string    `json:"last_error,omitempty"`
+}
+
+// ReadRetryState reads the retry state of an uploading file.
+// It returns nil without error if no attempt has been recorded yet.
+func (m *Manager) ReadRetryState(path string, dataType string) (*RetryState, error) {
+	data, err := os.ReadFile(m.retryStatePath(path, dataType))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read retry state: %w", err)
+	}
+
+	var state RetryState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode retry state: %w", err)
+	}
+	return &state, nil
+}
+
+// SaveRetryState saves the retry state of an uploading file
+func (m *Manager) SaveRetryState(path string, dataType string, state *RetryState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode retry state: %w", err)
+	}
+	return m.saveFile(m.retryStatePath(path, dataType), data)
+}
+
+// RemoveRetryState removes the retry state of an uploading file, if any
+func (m *Manager) RemoveRetryState(path string, dataType string) error {
+	if err := m.removeTracked(m.retryStatePath(path, dataType)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// MoveToDeadLetter moves a file that could not be uploaded to the deadletter directory
+func (m *Manager) MoveToDeadLetter(file string, dataType string) (string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	deadLetterDir := filepath.Join(m.BaseDir, dataType, "deadletter")
+	dest := filepath.Join(deadLetterDir, filepath.Base(file))
+	info, statErr := os.Stat(file)
+	if err := os.Rename(file, dest); err != nil {
+		return "", fmt.Errorf("failed to move file %s: %w", file, err)
+	}
+	// Dead letters are left out of the tracked usage
+	if statErr == nil {
+		m.usage.add(-info.Size(), -1)
+	}
+	return dest, nil
+}
+
+// GetDeadLetterFiles returns files in deadletter directory
+func (m *Manager) GetDeadLetterFiles(dataType string) ([]string, error) {
+	return m.getFiles(filepath.Join(m.BaseDir, dataType, "deadletter"))
+}
+
+// ClaimFile marks a file as being uploaded. It returns false if the file
+// is already claimed by another worker.
+func (m *Manager) ClaimFile(path string) bool {
+	m.claimMu.Lock()
+	defer m.claimMu.Unlock()
+
+	if _, ok := m.claimed[path]; ok {
+		return false
+	}
+	m.claimed[path] = struct{}{}
+	return true
+}
+
+// ReleaseFile releases a file claimed with ClaimFile
+func (m *Manager) ReleaseFile(path string) {
+	m.claimMu.Lock()
+	defer m.claimMu.Unlock()
+
+	delete(m.claimed, path)
+}
+
+// retryStatePath returns the retry state path for an uploading file
+func (m *Manager) retryStatePath(path string, dataType string) string {
+	return filepath.Join(m.BaseDir, dataType, "retry", filepath.Base(path)+".json")
+}
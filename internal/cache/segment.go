@@ -0,0 +1,326 @@
+package cache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// Segment files hold a sequence of records, each encoded as
+//
+//	uint32 length | uint32 CRC-32C | int64 receive time | uint16 user length | user | data
+//
+// where length and the checksum cover everything after the checksum, and the
+// receive time is in Unix nanoseconds. Integers are big-endian. Segments are appended to in the <type>/active
+// directory and moved to the incoming directory of their data type once
+// sealed, where the aggregator consumes them like any other cache file.
+
+// SegmentExt is the file extension of segment files
+const SegmentExt = ".seg"
+
+// segmentHeaderSize is the size of the length and checksum of a record
+const segmentHeaderSize = 8
+
+// segmentFixedSize is the size of the receive time and user length of a record
+const segmentFixedSize = 10
+
+// ErrCorruptSegment is returned when a segment record is truncated or fails its checksum
+var ErrCorruptSegment = errors.New("corrupt segment record")
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// segmentLog appends records of one data type to rotating segment files
+type segmentLog struct {
+	manager  *Manager
+	dataType string
+	maxBytes int64
+	maxAge   time.Duration
+
+	mu    sync.Mutex
+	file  *os.File
+	size  int64
+	seq   uint64
+	timer *time.Timer
+}
+
+// UseSegments switches usage and error reports to segment files. It must be
+// called before Init.
+func (m *Manager) UseSegments(cfg config.CacheConfig) {
+	m.segments = make(map[string]*segmentLog)
+	for _, dataType := range []string{"usage", "error"} {
+		m.segments[dataType] = &segmentLog{
+			manager:  m,
+			dataType: dataType,
+			maxBytes: cfg.SegmentMaxBytes,
+			maxAge:   cfg.SegmentMaxAge,
+		}
+	}
+}
+
+// SealSegments seals the open segments so they can be aggregated
+func (m *Manager) SealSegments() error {
+	var errs []error
+	for _, segments := range m.segments {
+		segments.mu.Lock()
+		errs = append(errs, segments.seal())
+		segments.mu.Unlock()
+	}
+	return errors.Join(errs...)
+}
+
+// IsSegment reports whether a cache file is a segment file
+func IsSegment(path string) bool {
+	return strings.HasSuffix(path, SegmentExt)
+}
+
+// ReadSegment calls fn for each record of a segment file with the time it was
+// received. It returns ErrCorruptSegment at the first truncated or invalid record.
+func ReadSegment(path string, fn func(user string, received time.Time, data []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	_, err = scanSegment(file, fn)
+	return err
+}
+
+// scanSegment reads records from r and returns the size of the valid records
+func scanSegment(r io.Reader, fn func(user string, received time.Time, data []byte) error) (int64, error) {
+	reader := bufio.NewReader(r)
+	header := make([]byte, segmentHeaderSize)
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err == io.EOF {
+			return offset, nil
+		} else if err != nil {
+			return offset, ErrCorruptSegment
+		}
+
+		length := binary.BigEndian.Uint32(header[0:4])
+		checksum := binary.BigEndian.Uint32(header[4:8])
+		if length < segmentFixedSize {
+			return offset, ErrCorruptSegment
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			return offset, ErrCorruptSegment
+		}
+		if crc32.Checksum(payload, castagnoli) != checksum {
+			return offset, ErrCorruptSegment
+		}
+
+		received := time.Unix(0, int64(binary.BigEndian.Uint64(payload[0:8])))
+		userLength := int(binary.BigEndian.Uint16(payload[8:10]))
+		if segmentFixedSize+userLength > len(payload) {
+			return offset, ErrCorruptSegment
+		}
+		user := string(payload[segmentFixedSize : segmentFixedSize+userLength])
+		if err := fn(user, received, payload[segmentFixedSize+userLength:]); err != nil {
+			return offset, err
+		}
+		offset += segmentHeaderSize + int64(length)
+	}
+}
+
+// encodeRecord encodes a segment record received at the given time
+func encodeRecord(user string, received time.Time, data []byte) ([]byte, error) {
+	if len(user) > 0xffff {
+		return nil, fmt.Errorf("user name too long: %d bytes", len(user))
+	}
+
+	record := make([]byte, segmentHeaderSize+segmentFixedSize+len(user)+len(data))
+	payload := record[segmentHeaderSize:]
+	binary.BigEndian.PutUint64(payload[0:8], uint64(received.UnixNano()))
+	binary.BigEndian.PutUint16(payload[8:10], uint16(len(user)))
+	copy(payload[segmentFixedSize:], user)
+	copy(payload[segmentFixedSize+len(user):], data)
+
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:8], crc32.Checksum(payload, castagnoli))
+	return record, nil
+}
+
+// append durably appends a record to the open segment, opening a new one if
+// needed, and seals the segment once it reaches its maximum size
+func (l *segmentLog) append(user string, data []byte) error {
+	record, err := encodeRecord(user, time.Now(), data)
+	if err != nil {
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		if err := l.open(); err != nil {
+			return err
+		}
+	}
+
+	n, err := l.file.Write(record)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	l.size += int64(n)
+	l.manager.usage.add(int64(n), 0)
+	if err != nil {
+		// Readers stop at a torn record, so nothing may be appended after it
+		if sealErr := l.seal(); sealErr != nil {
+			log.Error().Err(sealErr).Str("dataType", l.dataType).Msg("Failed to seal segment")
+		}
+		return fmt.Errorf("failed to write segment: %w", err)
+	}
+
+	if l.maxBytes > 0 && l.size >= l.maxBytes {
+		return l.seal()
+	}
+	return nil
+}
+
+// open creates a new segment in the active directory
+func (l *segmentLog) open() error {
+	dir := l.manager.activeDir(l.dataType)
+	path := filepath.Join(dir, fmt.Sprintf("%d.%d%s", time.Now().UnixNano(), os.Getpid(), SegmentExt))
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment: %w", err)
+	}
+	if err := SyncDir(dir); err != nil {
+		file.Close()
+		os.Remove(path)
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	l.manager.usage.add(0, 1)
+
+	l.file = file
+	l.size = 0
+	l.seq++
+	if l.maxAge > 0 {
+		seq := l.seq
+		l.timer = time.AfterFunc(l.maxAge, func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if l.seq != seq {
+				return
+			}
+			if err := l.seal(); err != nil {
+				log.Error().Err(err).Str("dataType", l.dataType).Msg("Failed to seal segment")
+			}
+		})
+	}
+	return nil
+}
+
+// seal closes the open segment and moves it to the incoming directory.
+// The caller must hold l.mu.
+func (l *segmentLog) seal() error {
+	if l.file == nil {
+		return nil
+	}
+	if l.timer != nil {
+		l.timer.Stop()
+		l.timer = nil
+	}
+
+	path := l.file.Name()
+	closeErr := l.file.Close()
+	l.file = nil
+	l.seq++
+	if closeErr != nil {
+		return fmt.Errorf("failed to close segment: %w", closeErr)
+	}
+
+	return l.manager.sealSegment(path, l.dataType)
+}
+
+// sealSegment moves a segment to the incoming directory of its data type,
+// removing it instead if it holds no records
+func (m *Manager) sealSegment(path string, dataType string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return m.removeTracked(path)
+	}
+
+	dir := filepath.Join(m.BaseDir, dataType)
+	m.mu.Lock()
+	err = os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+	m.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to seal segment: %w", err)
+	}
+	if err := SyncDir(dir); err != nil {
+		return err
+	}
+
+	// Only sealed segments can be aggregated
+	m.addPending(dataType, info.Size(), 1)
+	return nil
+}
+
+// recoverSegments seals segments left in the active directories by a previous
+// run, truncating any torn record at their end
+func (m *Manager) recoverSegments() error {
+	for _, dataType := range []string{"usage", "error"} {
+		dir := m.activeDir(dataType)
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return fmt.Errorf("failed to read directory %s: %w", dir, err)
+		}
+
+		for _, entry := range entries {
+			path := filepath.Join(dir, entry.Name())
+			if err := truncateSegment(path); err != nil {
+				return err
+			}
+			if err := m.sealSegment(path, dataType); err != nil {
+				return err
+			}
+			log.Info().Str("file", path).Msg("Recovered segment")
+		}
+	}
+	return nil
+}
+
+// truncateSegment cuts a segment after its last valid record
+func truncateSegment(path string) error {
+	file, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open segment: %w", err)
+	}
+	defer file.Close()
+
+	valid, err := scanSegment(file, func(string, time.Time, []byte) error { return nil })
+	if !errors.Is(err, ErrCorruptSegment) {
+		return err
+	}
+
+	log.Warn().Str("file", path).Int64("offset", valid).Msg("Truncating torn segment record")
+	if err := file.Truncate(valid); err != nil {
+		return fmt.Errorf("failed to truncate segment: %w", err)
+	}
+	return file.Sync()
+}
+
+// activeDir returns the directory of the open segments of a data type
+func (m *Manager) activeDir(dataType string) string {
+	return filepath.Join(m.BaseDir, dataType, "active")
+}
@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type segmentRecord struct {
+	User     string
+	Received time.Time
+	Data     string
+}
+
+func readSegmentRecords(t *testing.T, path string) ([]segmentRecord, error) {
+	var records []segmentRecord
+	err := ReadSegment(path, func(user string, received time.Time, data []byte) error {
+		records = append(records, segmentRecord{User: user, Received: received, Data: string(data)})
+		return nil
+	})
+	return records, err
+}
+
+func setupSegmentManager(t *testing.T, cfg config.CacheConfig) (*Manager, string) {
+	tempDir := t.TempDir()
+	manager := NewManager(tempDir)
+	manager.UseSegments(cfg)
+	require.NoError(t, manager.Init())
+	return manager, tempDir
+}
+
+func TestManager_Segments(t *testing.T) {
+	manager, tempDir := setupSegmentManager(t, config.CacheConfig{SegmentMaxBytes: 1 << 20})
+
+	before := time.Now()
+	require.NoError(t, manager.SaveUsage("user1", []byte(`{"event":"a"}`)))
+	time.Sleep(time.Millisecond)
+	require.NoError(t, manager.SaveUsage("user2", []byte(`{"event":"b"}`)))
+	require.NoError(t, manager.SaveError("user1", []byte(`{"error":"x"}`)))
+	after := time.Now()
+
+	// Open segments are not ready for aggregation
+	files, err := manager.GetUsageFiles()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+	active, err := os.ReadDir(filepath.Join(tempDir, "usage", "active"))
+	require.NoError(t, err)
+	assert.Len(t, active, 1)
+
+	require.NoError(t, manager.SealSegments())
+
+	files, err = manager.GetUsageFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.True(t, IsSegment(files[0]))
+
+	records, err := readSegmentRecords(t, files[0])
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+
+	// Each record keeps its own receive time
+	for _, record := range records {
+		assert.False(t, record.Received.Before(before))
+		assert.False(t, record.Received.After(after))
+	}
+	assert.True(t, records[1].Received.After(records[0].Received))
+	assert.Equal(t, []segmentRecord{
+		{User: "user1", Received: records[0].Received, Data: `{"event":"a"}`},
+		{User: "user2", Received: records[1].Received, Data: `{"event":"b"}`},
+	}, records)
+
+	files, err = manager.GetErrorFiles()
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	// Appends are tracked in the cache usage, and sealed segments are pending aggregation
+	assert.Equal(t, int64(2), manager.Usage().Files)
+	assert.Equal(t, int64(1), manager.Pending("usage").Files)
+}
+
+func TestManager_SegmentRotation(t *testing.T) {
+	manager, _ := setupSegmentManager(t, config.CacheConfig{SegmentMaxBytes: 40})
+
+	// Each record is 8 + 10 + 5 + 13 = 36 bytes, so segments seal after two records
+	for i := 0; i < 5; i++ {
+		require.NoError(t, manager.SaveUsage("user1", []byte(`{"event":"a"}`)))
+	}
+
+	files, err := manager.GetUsageFiles()
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	// Segments are sealed after their maximum age
+	manager, _ = setupSegmentManager(t, config.CacheConfig{SegmentMaxAge: 10 * time.Millisecond})
+	require.NoError(t, manager.SaveUsage("user1", []byte(`{"event":"a"}`)))
+	assert.Eventually(t, func() bool {
+		files, err := manager.GetUsageFiles()
+		return err == nil && len(files) == 1
+	}, time.Second, 5*time.Millisecond)
+}
+
+func TestManager_SegmentRecovery(t *testing.T) {
+	tempDir := t.TempDir()
+	received := time.Unix(0, 123)
+	record, err := encodeRecord("user1", received, []byte(`{"event":"a"}`))
+	require.NoError(t, err)
+	torn, err := encodeRecord("user1", received, []byte(`{"event":"b"}`))
+	require.NoError(t, err)
+
+	// A segment left open by a crash, with a torn record at its end
+	activeDir := filepath.Join(tempDir, "usage", "active")
+	require.NoError(t, os.MkdirAll(activeDir, 0755))
+	data := append(append([]byte{}, record...), torn[:len(torn)-3]...)
+	require.NoError(t, os.WriteFile(filepath.Join(activeDir, "123.1.seg"), data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(activeDir, "456.1.seg"), nil, 0644))
+
+	// Recovered even when segments are no longer used
+	manager := NewManager(tempDir)
+	require.NoError(t, manager.Init())
+
+	files, err := manager.GetUsageFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	assert.Equal(t, "123.1.seg", filepath.Base(files[0]))
+
+	records, err := readSegmentRecords(t, files[0])
+	require.NoError(t, err)
+	assert.Equal(t, []segmentRecord{{User: "user1", Received: received, Data: `{"event":"a"}`}}, records)
+
+	active, err := os.ReadDir(activeDir)
+	require.NoError(t, err)
+	assert.Empty(t, active)
+}
+
+func TestReadSegment_Corrupt(t *testing.T) {
+	record, err := encodeRecord("user1", time.Now(), []byte(`{"event":"a"}`))
+	require.NoError(t, err)
+	corrupt, err := encodeRecord("user1", time.Now(), []byte(`{"event":"b"}`))
+	require.NoError(t, err)
+	corrupt[len(corrupt)-2] ^= 0xff
+
+	path := filepath.Join(t.TempDir(), "123.1.seg")
+	require.NoError(t, os.WriteFile(path, append(append(record, corrupt...), record...), 0644))
+
+	records, err := readSegmentRecords(t, path)
+	assert.ErrorIs(t, err, ErrCorruptSegment)
+	assert.Len(t, records, 1)
+}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package cache
+
+import "os"
+
+// SyncDir flushes a directory so that renames into it survive a crash
+func SyncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
@@ -0,0 +1,192 @@
+package cache
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+)
+
+// Usage is the total size and number of files in the cache directory,
+// excluding dead letters and quota counters
+type Usage struct {
+	Bytes int64
+	Files int64
+}
+
+// usageTracker keeps the cache usage up to date as files are written and
+// removed, so it can be checked on every request without walking the cache
+type usageTracker struct {
+	bytes atomic.Int64
+	files atomic.Int64
+}
+
+func (t *usageTracker) add(bytes, files int64) {
+	t.bytes.Add(bytes)
+	t.files.Add(files)
+}
+
+// Usage returns the tracked size and number of files in the cache directory
+func (m *Manager) Usage() Usage {
+	return Usage{
+		Bytes: max(m.usage.bytes.Load(), 0),
+		Files: max(m.usage.files.Load(), 0),
+	}
+}
+
+// Rescan walks the cache directory and resets the tracked usage. It corrects
+// any drift from files changed outside the manager.
+func (m *Manager) Rescan() error {
+	var usage Usage
+	pending := make(map[string]*Usage)
+	for dataType := range m.pending {
+		pending[dataType] = &Usage{}
+	}
+
+	err := filepath.WalkDir(m.BaseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Removed while walking
+				return nil
+			}
+			return err
+		}
+		if d.IsDir() {
+			if !m.tracked(path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		usage.Bytes += info.Size()
+		usage.Files++
+		if p := pending[filepath.Base(filepath.Dir(path))]; p != nil && filepath.Dir(filepath.Dir(path)) == filepath.Clean(m.BaseDir) {
+			p.Bytes += info.Size()
+			p.Files++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	m.usage.bytes.Store(usage.Bytes)
+	m.usage.files.Store(usage.Files)
+	for dataType, p := range pending {
+		m.pending[dataType].bytes.Store(p.Bytes)
+		m.pending[dataType].files.Store(p.Files)
+	}
+	return nil
+}
+
+// Pending returns the size and number of files of a data type waiting for aggregation
+func (m *Manager) Pending(dataType string) Usage {
+	tracker := m.pending[dataType]
+	if tracker == nil {
+		return Usage{}
+	}
+	return Usage{
+		Bytes: max(tracker.bytes.Load(), 0),
+		Files: max(tracker.files.Load(), 0),
+	}
+}
+
+// SetAggregationThresholds sets the pending size and number of files of a
+// data type that trigger an aggregation before its interval. Zero disables
+// a threshold.
+func (m *Manager) SetAggregationThresholds(cfg config.AggregationConfig) {
+	m.aggregateMaxBytes = cfg.MaxBytes
+	m.aggregateMaxFiles = cfg.MaxFiles
+}
+
+// addPending records data waiting for aggregation and requests an
+// aggregation once a threshold is crossed
+func (m *Manager) addPending(dataType string, bytes, files int64) {
+	tracker := m.pending[dataType]
+	if tracker == nil {
+		return
+	}
+	tracker.add(bytes, files)
+
+	if bytes <= 0 && files <= 0 {
+		return
+	}
+	pending := m.Pending(dataType)
+	if (m.aggregateMaxBytes > 0 && pending.Bytes >= m.aggregateMaxBytes) ||
+		(m.aggregateMaxFiles > 0 && pending.Files >= m.aggregateMaxFiles) {
+		m.RequestAggregation(dataType)
+	}
+}
+
+// TrackFile records a file written into the cache directory without the manager
+func (m *Manager) TrackFile(path string) {
+	if !m.tracked(path) {
+		return
+	}
+	if info, err := os.Stat(path); err == nil {
+		m.usage.add(info.Size(), 1)
+	}
+}
+
+// RequestAggregation asks the workers to aggregate and upload a data type
+// immediately. Requests made while one is pending are coalesced.
+func (m *Manager) RequestAggregation(dataType string) {
+	select {
+	case m.aggregationRequests[dataType] <- struct{}{}:
+	default:
+	}
+}
+
+// AggregationRequests returns the channel receiving aggregation requests for
+// a data type
+func (m *Manager) AggregationRequests(dataType string) <-chan struct{} {
+	return m.aggregationRequests[dataType]
+}
+
+// RequestRetry asks the workers to retry failed uploads immediately.
+// Requests made while one is pending are coalesced.
+func (m *Manager) RequestRetry() {
+	select {
+	case m.retryRequests <- struct{}{}:
+	default:
+	}
+}
+
+// RetryRequests returns the channel receiving retry requests
+func (m *Manager) RetryRequests() <-chan struct{} {
+	return m.retryRequests
+}
+
+// removeTracked removes a file and subtracts it from the tracked usage
+func (m *Manager) removeTracked(path string) error {
+	info, statErr := os.Stat(path)
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if statErr == nil && m.tracked(path) {
+		m.usage.add(-info.Size(), -1)
+	}
+	return nil
+}
+
+// tracked reports whether a path counts towards the tracked usage. Dead
+// letters are only removed by an operator, so counting them could hold the
+// cache above its high water marks forever; they are reported as metrics
+// instead. Quota counters are not cached data either.
+func (m *Manager) tracked(path string) bool {
+	rel, err := filepath.Rel(m.BaseDir, path)
+	if err != nil {
+		return true
+	}
+	parts := strings.Split(filepath.ToSlash(rel), "/")
+	if parts[0] == "quota" {
+		return false
+	}
+	return len(parts) < 2 || parts[1] != "deadletter"
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"slices"
+	"strings"
 	"time"
 )
 
@@ -9,6 +11,9 @@ type Config struct {
 	// Cache directory
 	CacheDir string `mapstructure:"cache_dir"`
 
+	// Cache storage mode of usage and error reports
+	Cache CacheConfig `mapstructure:"cache"`
+
 	// AWS configuration
 	AWS AWSConfig `mapstructure:"aws"`
 
@@ -17,6 +22,45 @@ type Config struct {
 
 	// Aggregation intervals
 	Aggregation AggregationConfig `mapstructure:"aggregation"`
+
+	// Storage sink configuration
+	Storage StorageConfig `mapstructure:"storage"`
+
+	// Upload retry configuration
+	Retry RetryConfig `mapstructure:"retry"`
+
+	// S3 multipart upload configuration
+	Upload UploadConfig `mapstructure:"upload"`
+
+	// Specimen upload worker pool configuration
+	SpecimenUpload SpecimenUploadConfig `mapstructure:"specimen_upload"`
+
+	// Readiness probe configuration
+	Readiness ReadinessConfig `mapstructure:"readiness"`
+
+	// Token authentication configuration
+	Auth AuthConfig `mapstructure:"auth"`
+
+	// Request signing configuration
+	Signing SigningConfig `mapstructure:"signing"`
+
+	// Compressed request body limits
+	Decompression DecompressionConfig `mapstructure:"decompression"`
+
+	// Request body size limits
+	Limits LimitsConfig `mapstructure:"limits"`
+
+	// JSON Schema validation of usage and error records
+	Validation ValidationConfig `mapstructure:"validation"`
+
+	// Server-side enrichment of usage and error records
+	Enrichment EnrichmentConfig `mapstructure:"enrichment"`
+
+	// Per-user rate limits and daily quotas
+	RateLimit RateLimitConfig `mapstructure:"rate_limit"`
+
+	// Cache directory high and low water marks
+	Backpressure BackpressureConfig `mapstructure:"backpressure"`
 }
 
 // AWSConfig holds AWS specific configuration
@@ -31,16 +75,395 @@ type AWSConfig struct {
 type S3Config struct {
 	UsageBucket      string `mapstructure:"usage_bucket"`
 	UsagePrefix      string `mapstructure:"usage_prefix"`
+	UsageKeyTemplate string `mapstructure:"usage_key_template"`
 	ErrorBucket      string `mapstructure:"error_bucket"`
 	ErrorPrefix      string `mapstructure:"error_prefix"`
+	ErrorKeyTemplate string `mapstructure:"error_key_template"`
 	SpecimenBucket   string `mapstructure:"specimen_bucket"`
 	SpecimenPrefix   string `mapstructure:"specimen_prefix"`
+
+	// Layout selects the default key templates of aggregated files
+	Layout string `mapstructure:"layout"`
+
+	// PartitionField is a record field, such as app_version or _gateway.user,
+	// by which aggregated files are split into partitions
+	PartitionField string `mapstructure:"partition_field"`
+}
+
+// Aggregated file layouts
+const (
+	// LayoutDate stores aggregated files under YYYY/MM/DD/HH/
+	LayoutDate = "date"
+
+	// LayoutHive stores aggregated files under Hive-style dt=YYYY-MM-DD/hour=HH/
+	// partitions recognised by Athena, Trino and DuckDB
+	LayoutHive = "hive"
+)
+
+// DefaultKeyTemplate is the default object key template for aggregated files.
+// Available placeholders: {prefix}, {user} (user/ of per-user aggregates),
+// {yyyy}, {mm}, {dd}, {hh} (window start), {partition} (name=value/ of the
+// partition field), {start}, {end}, {host}, {seq}, {hash} and {ext} (file
+// extension of the output format, such as .jsonl.gz or .parquet).
+const DefaultKeyTemplate = "{prefix}{user}{yyyy}/{mm}/{dd}/{hh}/{partition}{start}-{end}.{host}.{hash}{ext}"
+
+// DefaultHiveKeyTemplate is the default object key template of the hive layout
+const DefaultHiveKeyTemplate = "{prefix}{user}dt={yyyy}-{mm}-{dd}/hour={hh}/{partition}{start}-{end}.{host}.{hash}{ext}"
+
+// LayoutKeyTemplate returns the default key template of a layout
+func LayoutKeyTemplate(layout string) string {
+	if layout == LayoutHive {
+		return DefaultHiveKeyTemplate
+	}
+	return DefaultKeyTemplate
 }
 
 // AggregationConfig holds aggregation intervals
 type AggregationConfig struct {
 	UsageInterval time.Duration `mapstructure:"usage_interval"`
 	ErrorInterval time.Duration `mapstructure:"error_interval"`
+
+	// MaxBytes and MaxFiles trigger an aggregation before the interval once
+	// the pending data of a type reaches them; 0 disables a threshold
+	MaxBytes int64 `mapstructure:"max_bytes"`
+	MaxFiles int64 `mapstructure:"max_files"`
+
+	// TimestampField is the record field, such as timestamp or event.time,
+	// holding the event time by which records are grouped into hourly files.
+	// Records without it are grouped by receive time.
+	TimestampField string `mapstructure:"timestamp_field"`
+
+	// PerUser writes one aggregated file per user, stored under the user's
+	// own key prefix, instead of merging the records of all users
+	PerUser bool `mapstructure:"per_user"`
+
+	// MaxOpenFiles caps the aggregated files written at once. Once reached,
+	// the least recently written file is finished and later records of its
+	// hour, partition and user go to a new file.
+	MaxOpenFiles int `mapstructure:"max_open_files"`
+
+	// MaxEventAge is how long before they were received records may have
+	// happened; records with older event times are grouped by receive time
+	MaxEventAge time.Duration `mapstructure:"max_event_age"`
+
+	// MaxBufferBytes caps the records buffered in memory across the files
+	// of an aggregation, such as Parquet row groups; once exceeded, the
+	// file buffering the most is flushed
+	MaxBufferBytes int64 `mapstructure:"max_buffer_bytes"`
+
+	// Output format of aggregated usage and error files
+	Usage OutputConfig `mapstructure:"usage"`
+	Error OutputConfig `mapstructure:"error"`
+}
+
+// Default aggregated file limits
+const (
+	DefaultMaxOpenFiles   = 64
+	DefaultMaxEventAge    = 7 * 24 * time.Hour
+	DefaultMaxBufferBytes = 64 << 20
+)
+
+// Output returns the output configuration of a data type
+func (a AggregationConfig) Output(dataType string) OutputConfig {
+	if dataType == "error" {
+		return a.Error
+	}
+	return a.Usage
+}
+
+// Aggregated file formats
+const (
+	FormatJSONL   = "jsonl"
+	FormatParquet = "parquet"
+)
+
+// Compression codecs of JSON lines files
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// Compression level ranges; level 0 selects the codec default
+const (
+	MaxGzipLevel = 9
+	MaxZstdLevel = 22
+)
+
+// OutputConfig holds the format of aggregated files of a data type
+type OutputConfig struct {
+	// Format is jsonl (JSON lines) or parquet
+	Format string `mapstructure:"format"`
+
+	// Compression is the codec of jsonl files: gzip, zstd or none
+	Compression string `mapstructure:"compression"`
+
+	// Level is the compression level of jsonl files, 1-9 for gzip and 1-22
+	// for zstd; 0 selects the codec default
+	Level int `mapstructure:"level"`
+
+	Parquet ParquetConfig `mapstructure:"parquet"`
+}
+
+// DefaultParquetInferRecords is the default number of records a Parquet
+// schema is inferred from
+const DefaultParquetInferRecords = 1000
+
+// ParquetTypes lists the supported Parquet column types
+var ParquetTypes = []string{"string", "int64", "double", "boolean", "timestamp", "json"}
+
+// ParquetCompressions lists the supported Parquet compression codecs
+var ParquetCompressions = []string{"snappy", "zstd", "none"}
+
+// ParquetConfig holds the schema and compression of Parquet files. Without
+// columns the schema is inferred from the first records of each file.
+type ParquetConfig struct {
+	Compression  string          `mapstructure:"compression"`
+	Columns      []ParquetColumn `mapstructure:"columns"`
+	InferRecords int             `mapstructure:"infer_records"`
+}
+
+// ParquetColumn declares a Parquet column
+type ParquetColumn struct {
+	Name string `mapstructure:"name"`
+
+	// Field is the dotted record path of the column; defaults to Name
+	Field string `mapstructure:"field"`
+
+	// Type is one of ParquetTypes
+	Type string `mapstructure:"type"`
+}
+
+// Default S3 multipart upload settings
+const (
+	DefaultMultipartThreshold = 64 << 20
+	DefaultPartSize           = 16 << 20
+
+	// MinPartSize is the smallest part size accepted by S3
+	MinPartSize = 5 << 20
+)
+
+// UploadConfig holds settings for uploads to S3. Files at or above the
+// multipart threshold are uploaded in parts, which resume after a restart.
+type UploadConfig struct {
+	MultipartThreshold int64 `mapstructure:"multipart_threshold"`
+	PartSize           int64 `mapstructure:"part_size"`
+
+	// Concurrency is the number of parts uploaded in parallel per file
+	Concurrency int `mapstructure:"concurrency"`
+}
+
+// Default specimen upload worker pool settings
+const (
+	DefaultSpecimenUploadConcurrency = 4
+	DefaultSpecimenUploadQueueSize   = 1000
+)
+
+// SpecimenUploadConfig holds settings for the specimen upload worker pool.
+// Specimens that do not fit in the queue are picked up by the periodic sweep.
+type SpecimenUploadConfig struct {
+	// Concurrency is the number of specimens uploaded in parallel
+	Concurrency int `mapstructure:"concurrency"`
+
+	// QueueSize is the number of saved specimens waiting for a worker
+	QueueSize int `mapstructure:"queue_size"`
+}
+
+// DefaultMinFreeBytes is the default free space required on the cache filesystem
+const DefaultMinFreeBytes = 256 << 20
+
+// DefaultMaxDecompressedBytes is the default decompressed size limit of a request body
+const DefaultMaxDecompressedBytes = 64 << 20
+
+// Default request body size limits
+const (
+	DefaultUsageMaxBytes    = 1 << 20
+	DefaultErrorMaxBytes    = 10 << 20
+	DefaultSpecimenMaxBytes = 100 << 20
+	DefaultBatchMaxBytes    = 32 << 20
+)
+
+// DefaultSegmentMaxBytes is the default size at which a segment is sealed
+const DefaultSegmentMaxBytes = 64 << 20
+
+// Cache storage modes
+const (
+	CacheModeFiles    = "files"
+	CacheModeSegments = "segments"
+)
+
+// CacheConfig holds how usage and error reports are stored in the cache
+type CacheConfig struct {
+	// Mode is "files" for one file per request or "segments" for appending
+	// to rotating segment files
+	Mode string `mapstructure:"mode"`
+
+	// SegmentMaxBytes is the size at which a segment is sealed
+	SegmentMaxBytes int64 `mapstructure:"segment_max_bytes"`
+
+	// SegmentMaxAge is how long a segment stays open before it is sealed
+	SegmentMaxAge time.Duration `mapstructure:"segment_max_age"`
+}
+
+// Storage sink types
+const (
+	StorageS3    = "s3"
+	StorageLocal = "local"
+)
+
+// StorageConfig holds storage sink configuration
+type StorageConfig struct {
+	// Type selects the sink backend ("s3" or "local")
+	Type string `mapstructure:"type"`
+
+	// LocalDir is the root directory used by the local sink
+	LocalDir string `mapstructure:"local_dir"`
+}
+
+// RetryConfig holds settings for retrying failed uploads
+type RetryConfig struct {
+	// Interval between scans of the uploading directories
+	Interval time.Duration `mapstructure:"interval"`
+
+	// InitialBackoff is the delay before the first retry
+	InitialBackoff time.Duration `mapstructure:"initial_backoff"`
+
+	// MaxBackoff caps the exponential backoff delay
+	MaxBackoff time.Duration `mapstructure:"max_backoff"`
+
+	// MaxAttempts is the number of failed attempts before a file is dead-lettered
+	MaxAttempts int `mapstructure:"max_attempts"`
+}
+
+// ReadinessConfig holds settings for the /ready endpoint
+type ReadinessConfig struct {
+	// CheckInterval is how long a storage health check result is cached
+	CheckInterval time.Duration `mapstructure:"check_interval"`
+
+	// MinFreeBytes is the free space required on the cache filesystem
+	MinFreeBytes int64 `mapstructure:"min_free_bytes"`
+}
+
+// AuthConfig holds token authentication settings
+type AuthConfig struct {
+	// TokensFile is a YAML or JSON file mapping SHA-256 token hashes to users
+	TokensFile string `mapstructure:"tokens_file"`
+
+	// ReloadInterval is how often the tokens file is checked for changes
+	ReloadInterval time.Duration `mapstructure:"reload_interval"`
+}
+
+// SigningConfig holds HMAC request signing settings. Signatures are required
+// for tokens that have a signing secret.
+type SigningConfig struct {
+	// MaxClockSkew is the allowed difference between X-Timestamp and server time
+	MaxClockSkew time.Duration `mapstructure:"max_clock_skew"`
+}
+
+// DecompressionConfig holds limits for compressed request bodies
+type DecompressionConfig struct {
+	// MaxBytes is the maximum decompressed size of a request body
+	MaxBytes int64 `mapstructure:"max_bytes"`
+
+	// MaxRatio is the maximum ratio of decompressed to compressed size
+	MaxRatio int64 `mapstructure:"max_ratio"`
+}
+
+// LimitsConfig holds the maximum request body size of each endpoint.
+// Limits apply to the decompressed body.
+type LimitsConfig struct {
+	UsageMaxBytes    int64 `mapstructure:"usage_max_bytes"`
+	ErrorMaxBytes    int64 `mapstructure:"error_max_bytes"`
+	SpecimenMaxBytes int64 `mapstructure:"specimen_max_bytes"`
+	BatchMaxBytes    int64 `mapstructure:"batch_max_bytes"`
+}
+
+// ForEndpoint returns the body size limit of a route path, or 0 if unlimited
+func (l LimitsConfig) ForEndpoint(path string) int64 {
+	switch path {
+	case "/usage":
+		return l.UsageMaxBytes
+	case "/error":
+		return l.ErrorMaxBytes
+	case "/specimen":
+		return l.SpecimenMaxBytes
+	case "/usage/batch", "/error/batch":
+		return l.BatchMaxBytes
+	default:
+		return 0
+	}
+}
+
+// ValidationConfig holds optional JSON Schema paths per data type
+type ValidationConfig struct {
+	UsageSchema string `mapstructure:"usage_schema"`
+	ErrorSchema string `mapstructure:"error_schema"`
+}
+
+// Enrichment fields added to the _gateway object of each record
+const (
+	EnrichReceivedAt = "received_at"
+	EnrichRequestID  = "request_id"
+	EnrichRemoteIP   = "remote_ip"
+	EnrichUser       = "user"
+	EnrichUserAgent  = "user_agent"
+)
+
+// EnrichmentFields lists all supported enrichment fields
+var EnrichmentFields = []string{EnrichReceivedAt, EnrichRequestID, EnrichRemoteIP, EnrichUser, EnrichUserAgent}
+
+// EnrichmentConfig holds settings for adding a _gateway object to records
+type EnrichmentConfig struct {
+	Enabled bool `mapstructure:"enabled"`
+
+	// Fields selects the enrichment fields; defaults to all
+	Fields []string `mapstructure:"fields"`
+}
+
+// RateLimitConfig holds per-user request rate limits and daily quotas.
+// Zero values disable the corresponding limit.
+type RateLimitConfig struct {
+	// RequestsPerSecond is the token bucket refill rate per user
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+
+	// Burst is the token bucket size; defaults to RequestsPerSecond rounded up
+	Burst int `mapstructure:"burst"`
+
+	// PerIP keys token buckets by user and client IP instead of user only
+	PerIP bool `mapstructure:"per_ip"`
+
+	// DailyRequests is the maximum number of requests per user per UTC day
+	DailyRequests int64 `mapstructure:"daily_requests"`
+
+	// DailyBytes is the maximum request body bytes per user per UTC day
+	DailyBytes int64 `mapstructure:"daily_bytes"`
+
+	// Overrides replaces the limits above for specific users
+	Overrides []RateLimitOverride `mapstructure:"overrides"`
+}
+
+// RateLimitOverride holds the limits of a single user. Zero values inherit
+// the global limits.
+type RateLimitOverride struct {
+	User              string  `mapstructure:"user"`
+	RequestsPerSecond float64 `mapstructure:"requests_per_second"`
+	Burst             int     `mapstructure:"burst"`
+	DailyRequests     int64   `mapstructure:"daily_requests"`
+	DailyBytes        int64   `mapstructure:"daily_bytes"`
+}
+
+// BackpressureConfig holds the cache usage above which ingestion is refused.
+// Ingestion resumes once usage is at or below both low water marks, which
+// default to 90% of the high water marks. A zero high water mark disables the
+// corresponding check.
+type BackpressureConfig struct {
+	HighWaterBytes int64 `mapstructure:"high_water_bytes"`
+	LowWaterBytes  int64 `mapstructure:"low_water_bytes"`
+	HighWaterFiles int64 `mapstructure:"high_water_files"`
+	LowWaterFiles  int64 `mapstructure:"low_water_files"`
+
+	// RetryAfter is sent to clients refused by backpressure
+	RetryAfter time.Duration `mapstructure:"retry_after"`
 }
 
 // SetDefaults sets default values for configuration
@@ -48,6 +471,15 @@ func (c *Config) SetDefaults() {
 	if c.CacheDir == "" {
 		c.CacheDir = "/var/lib/lightfile6-insights-gateway"
 	}
+	if c.Cache.Mode == "" {
+		c.Cache.Mode = CacheModeFiles
+	}
+	if c.Cache.SegmentMaxBytes == 0 {
+		c.Cache.SegmentMaxBytes = DefaultSegmentMaxBytes
+	}
+	if c.Cache.SegmentMaxAge == 0 {
+		c.Cache.SegmentMaxAge = time.Minute
+	}
 	if c.AWS.Region == "" {
 		c.AWS.Region = "ap-northeast-1"
 	}
@@ -57,6 +489,110 @@ func (c *Config) SetDefaults() {
 	if c.Aggregation.ErrorInterval == 0 {
 		c.Aggregation.ErrorInterval = 10 * time.Minute
 	}
+	if c.Aggregation.MaxOpenFiles == 0 {
+		c.Aggregation.MaxOpenFiles = DefaultMaxOpenFiles
+	}
+	if c.Aggregation.MaxEventAge == 0 {
+		c.Aggregation.MaxEventAge = DefaultMaxEventAge
+	}
+	if c.Aggregation.MaxBufferBytes == 0 {
+		c.Aggregation.MaxBufferBytes = DefaultMaxBufferBytes
+	}
+	for _, output := range []*OutputConfig{&c.Aggregation.Usage, &c.Aggregation.Error} {
+		if output.Format == "" {
+			output.Format = FormatJSONL
+		}
+		if output.Compression == "" {
+			output.Compression = CompressionGzip
+		}
+		if output.Parquet.Compression == "" {
+			output.Parquet.Compression = "snappy"
+		}
+		if output.Parquet.InferRecords == 0 {
+			output.Parquet.InferRecords = DefaultParquetInferRecords
+		}
+	}
+	if c.S3.Layout == "" {
+		c.S3.Layout = LayoutDate
+	}
+	if c.S3.UsageKeyTemplate == "" {
+		c.S3.UsageKeyTemplate = LayoutKeyTemplate(c.S3.Layout)
+	}
+	if c.S3.ErrorKeyTemplate == "" {
+		c.S3.ErrorKeyTemplate = LayoutKeyTemplate(c.S3.Layout)
+	}
+	if c.Storage.Type == "" {
+		c.Storage.Type = StorageS3
+	}
+	if c.Retry.Interval == 0 {
+		c.Retry.Interval = 30 * time.Second
+	}
+	if c.Retry.InitialBackoff == 0 {
+		c.Retry.InitialBackoff = time.Minute
+	}
+	if c.Retry.MaxBackoff == 0 {
+		c.Retry.MaxBackoff = time.Hour
+	}
+	if c.Retry.MaxAttempts == 0 {
+		c.Retry.MaxAttempts = 20
+	}
+	if c.Upload.MultipartThreshold == 0 {
+		c.Upload.MultipartThreshold = DefaultMultipartThreshold
+	}
+	if c.Upload.PartSize == 0 {
+		c.Upload.PartSize = DefaultPartSize
+	}
+	if c.Upload.Concurrency == 0 {
+		c.Upload.Concurrency = 4
+	}
+	if c.SpecimenUpload.Concurrency == 0 {
+		c.SpecimenUpload.Concurrency = DefaultSpecimenUploadConcurrency
+	}
+	if c.SpecimenUpload.QueueSize == 0 {
+		c.SpecimenUpload.QueueSize = DefaultSpecimenUploadQueueSize
+	}
+	if c.Readiness.CheckInterval == 0 {
+		c.Readiness.CheckInterval = 30 * time.Second
+	}
+	if c.Readiness.MinFreeBytes == 0 {
+		c.Readiness.MinFreeBytes = DefaultMinFreeBytes
+	}
+	if c.Auth.ReloadInterval == 0 {
+		c.Auth.ReloadInterval = 10 * time.Second
+	}
+	if c.Signing.MaxClockSkew == 0 {
+		c.Signing.MaxClockSkew = 5 * time.Minute
+	}
+	if c.Decompression.MaxBytes == 0 {
+		c.Decompression.MaxBytes = DefaultMaxDecompressedBytes
+	}
+	if c.Decompression.MaxRatio == 0 {
+		c.Decompression.MaxRatio = 100
+	}
+	if c.Limits.UsageMaxBytes == 0 {
+		c.Limits.UsageMaxBytes = DefaultUsageMaxBytes
+	}
+	if c.Limits.ErrorMaxBytes == 0 {
+		c.Limits.ErrorMaxBytes = DefaultErrorMaxBytes
+	}
+	if c.Limits.SpecimenMaxBytes == 0 {
+		c.Limits.SpecimenMaxBytes = DefaultSpecimenMaxBytes
+	}
+	if c.Limits.BatchMaxBytes == 0 {
+		c.Limits.BatchMaxBytes = DefaultBatchMaxBytes
+	}
+	if len(c.Enrichment.Fields) == 0 {
+		c.Enrichment.Fields = append([]string(nil), EnrichmentFields...)
+	}
+	if c.Backpressure.LowWaterBytes == 0 {
+		c.Backpressure.LowWaterBytes = c.Backpressure.HighWaterBytes * 9 / 10
+	}
+	if c.Backpressure.LowWaterFiles == 0 {
+		c.Backpressure.LowWaterFiles = c.Backpressure.HighWaterFiles * 9 / 10
+	}
+	if c.Backpressure.RetryAfter == 0 {
+		c.Backpressure.RetryAfter = 30 * time.Second
+	}
 }
 
 // Validate validates the configuration
@@ -70,5 +606,91 @@ func (c *Config) Validate() error {
 	if c.S3.SpecimenBucket == "" {
 		return ErrSpecimenBucketRequired
 	}
+	for _, template := range []string{c.S3.UsageKeyTemplate, c.S3.ErrorKeyTemplate} {
+		if template != "" && !strings.Contains(template, "{seq}") && !strings.Contains(template, "{hash}") {
+			return ErrKeyTemplateNotUnique
+		}
+		if strings.Contains(template, "{seq}") && !strings.Contains(template, "{hash}") && !strings.Contains(template, "{host}") {
+			return ErrKeyTemplateHostRequired
+		}
+		if template != "" && c.Aggregation.PerUser && !strings.Contains(template, "{user}") {
+			return ErrKeyTemplateUserRequired
+		}
+	}
+	switch c.S3.Layout {
+	case "", LayoutDate, LayoutHive:
+	default:
+		return ErrUnknownLayout
+	}
+	if c.Aggregation.MaxOpenFiles < 0 || c.Aggregation.MaxEventAge < 0 || c.Aggregation.MaxBufferBytes < 0 {
+		return ErrNegativeAggregationLimit
+	}
+	for _, output := range []OutputConfig{c.Aggregation.Usage, c.Aggregation.Error} {
+		if err := output.validate(); err != nil {
+			return err
+		}
+	}
+	if c.Upload.PartSize != 0 && c.Upload.PartSize < MinPartSize {
+		return ErrPartSizeTooSmall
+	}
+	switch c.Cache.Mode {
+	case "", CacheModeFiles, CacheModeSegments:
+	default:
+		return ErrUnknownCacheMode
+	}
+	switch c.Storage.Type {
+	case "", StorageS3:
+	case StorageLocal:
+		if c.Storage.LocalDir == "" {
+			return ErrLocalDirRequired
+		}
+	default:
+		return ErrUnknownStorageType
+	}
+	for _, field := range c.Enrichment.Fields {
+		if !slices.Contains(EnrichmentFields, field) {
+			return ErrUnknownEnrichmentField
+		}
+	}
+	if c.Backpressure.LowWaterBytes > c.Backpressure.HighWaterBytes || c.Backpressure.LowWaterFiles > c.Backpressure.HighWaterFiles {
+		return ErrLowWaterAboveHighWater
+	}
+	if c.Auth.TokensFile == "" {
+		return ErrTokensFileRequired
+	}
 	return nil
-}
\ No newline at end of file
+}
+
+// validate validates the output configuration of a data type
+func (o OutputConfig) validate() error {
+	switch o.Format {
+	case "", FormatJSONL, FormatParquet:
+	default:
+		return ErrUnknownOutputFormat
+	}
+	switch o.Compression {
+	case "", CompressionGzip:
+		if o.Level < 0 || o.Level > MaxGzipLevel {
+			return ErrCompressionLevelOutOfRange
+		}
+	case CompressionZstd:
+		if o.Level < 0 || o.Level > MaxZstdLevel {
+			return ErrCompressionLevelOutOfRange
+		}
+	case CompressionNone:
+	default:
+		return ErrUnknownCompression
+	}
+	if o.Parquet.Compression != "" && !slices.Contains(ParquetCompressions, o.Parquet.Compression) {
+		return ErrUnknownParquetCompression
+	}
+	for _, column := range o.Parquet.Columns {
+		if column.Name == "" {
+			return ErrParquetColumnNameRequired
+		}
+		if !slices.Contains(ParquetTypes, column.Type) {
+			return ErrUnknownParquetType
+		}
+	}
+	return nil
+}
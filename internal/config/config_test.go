@@ -8,6 +8,15 @@ import (
 )
 
 func TestConfig_SetDefaults(t *testing.T) {
+	defaultOutput := OutputConfig{
+		Format:      FormatJSONL,
+		Compression: CompressionGzip,
+		Parquet: ParquetConfig{
+			Compression:  "snappy",
+			InferRecords: DefaultParquetInferRecords,
+		},
+	}
+
 	tests := []struct {
 		name     string
 		input    Config
@@ -22,8 +31,67 @@ func TestConfig_SetDefaults(t *testing.T) {
 					Region: "ap-northeast-1",
 				},
 				Aggregation: AggregationConfig{
-					UsageInterval: 10 * time.Minute,
-					ErrorInterval: 10 * time.Minute,
+					UsageInterval:  10 * time.Minute,
+					ErrorInterval:  10 * time.Minute,
+					MaxOpenFiles:   DefaultMaxOpenFiles,
+					MaxEventAge:    DefaultMaxEventAge,
+					MaxBufferBytes: DefaultMaxBufferBytes,
+					Usage:          defaultOutput,
+					Error:          defaultOutput,
+				},
+				S3: S3Config{
+					UsageKeyTemplate: DefaultKeyTemplate,
+					ErrorKeyTemplate: DefaultKeyTemplate,
+					Layout:           LayoutDate,
+				},
+				Storage: StorageConfig{
+					Type: StorageS3,
+				},
+				Retry: RetryConfig{
+					Interval:       30 * time.Second,
+					InitialBackoff: time.Minute,
+					MaxBackoff:     time.Hour,
+					MaxAttempts:    20,
+				},
+				Readiness: ReadinessConfig{
+					CheckInterval: 30 * time.Second,
+					MinFreeBytes:  DefaultMinFreeBytes,
+				},
+				Auth: AuthConfig{
+					ReloadInterval: 10 * time.Second,
+				},
+				Signing: SigningConfig{
+					MaxClockSkew: 5 * time.Minute,
+				},
+				Decompression: DecompressionConfig{
+					MaxBytes: DefaultMaxDecompressedBytes,
+					MaxRatio: 100,
+				},
+				Limits: LimitsConfig{
+					UsageMaxBytes:    DefaultUsageMaxBytes,
+					ErrorMaxBytes:    DefaultErrorMaxBytes,
+					SpecimenMaxBytes: DefaultSpecimenMaxBytes,
+					BatchMaxBytes:    DefaultBatchMaxBytes,
+				},
+				Enrichment: EnrichmentConfig{
+					Fields: EnrichmentFields,
+				},
+				Backpressure: BackpressureConfig{
+					RetryAfter: 30 * time.Second,
+				},
+				Cache: CacheConfig{
+					Mode:            CacheModeFiles,
+					SegmentMaxBytes: DefaultSegmentMaxBytes,
+					SegmentMaxAge:   time.Minute,
+				},
+				Upload: UploadConfig{
+					MultipartThreshold: DefaultMultipartThreshold,
+					PartSize:           DefaultPartSize,
+					Concurrency:        4,
+				},
+				SpecimenUpload: SpecimenUploadConfig{
+					Concurrency: DefaultSpecimenUploadConcurrency,
+					QueueSize:   DefaultSpecimenUploadQueueSize,
 				},
 			},
 		},
@@ -41,8 +109,67 @@ func TestConfig_SetDefaults(t *testing.T) {
 					Region: "us-west-2",
 				},
 				Aggregation: AggregationConfig{
-					UsageInterval: 10 * time.Minute,
-					ErrorInterval: 10 * time.Minute,
+					UsageInterval:  10 * time.Minute,
+					ErrorInterval:  10 * time.Minute,
+					MaxOpenFiles:   DefaultMaxOpenFiles,
+					MaxEventAge:    DefaultMaxEventAge,
+					MaxBufferBytes: DefaultMaxBufferBytes,
+					Usage:          defaultOutput,
+					Error:          defaultOutput,
+				},
+				S3: S3Config{
+					UsageKeyTemplate: DefaultKeyTemplate,
+					ErrorKeyTemplate: DefaultKeyTemplate,
+					Layout:           LayoutDate,
+				},
+				Storage: StorageConfig{
+					Type: StorageS3,
+				},
+				Retry: RetryConfig{
+					Interval:       30 * time.Second,
+					InitialBackoff: time.Minute,
+					MaxBackoff:     time.Hour,
+					MaxAttempts:    20,
+				},
+				Readiness: ReadinessConfig{
+					CheckInterval: 30 * time.Second,
+					MinFreeBytes:  DefaultMinFreeBytes,
+				},
+				Auth: AuthConfig{
+					ReloadInterval: 10 * time.Second,
+				},
+				Signing: SigningConfig{
+					MaxClockSkew: 5 * time.Minute,
+				},
+				Decompression: DecompressionConfig{
+					MaxBytes: DefaultMaxDecompressedBytes,
+					MaxRatio: 100,
+				},
+				Limits: LimitsConfig{
+					UsageMaxBytes:    DefaultUsageMaxBytes,
+					ErrorMaxBytes:    DefaultErrorMaxBytes,
+					SpecimenMaxBytes: DefaultSpecimenMaxBytes,
+					BatchMaxBytes:    DefaultBatchMaxBytes,
+				},
+				Enrichment: EnrichmentConfig{
+					Fields: EnrichmentFields,
+				},
+				Backpressure: BackpressureConfig{
+					RetryAfter: 30 * time.Second,
+				},
+				Cache: CacheConfig{
+					Mode:            CacheModeFiles,
+					SegmentMaxBytes: DefaultSegmentMaxBytes,
+					SegmentMaxAge:   time.Minute,
+				},
+				Upload: UploadConfig{
+					MultipartThreshold: DefaultMultipartThreshold,
+					PartSize:           DefaultPartSize,
+					Concurrency:        4,
+				},
+				SpecimenUpload: SpecimenUploadConfig{
+					Concurrency: DefaultSpecimenUploadConcurrency,
+					QueueSize:   DefaultSpecimenUploadQueueSize,
 				},
 			},
 		},
@@ -59,8 +186,67 @@ func TestConfig_SetDefaults(t *testing.T) {
 					Region: "ap-northeast-1",
 				},
 				Aggregation: AggregationConfig{
-					UsageInterval: 5 * time.Minute,
-					ErrorInterval: 10 * time.Minute,
+					UsageInterval:  5 * time.Minute,
+					ErrorInterval:  10 * time.Minute,
+					MaxOpenFiles:   DefaultMaxOpenFiles,
+					MaxEventAge:    DefaultMaxEventAge,
+					MaxBufferBytes: DefaultMaxBufferBytes,
+					Usage:          defaultOutput,
+					Error:          defaultOutput,
+				},
+				S3: S3Config{
+					UsageKeyTemplate: DefaultKeyTemplate,
+					ErrorKeyTemplate: DefaultKeyTemplate,
+					Layout:           LayoutDate,
+				},
+				Storage: StorageConfig{
+					Type: StorageS3,
+				},
+				Retry: RetryConfig{
+					Interval:       30 * time.Second,
+					InitialBackoff: time.Minute,
+					MaxBackoff:     time.Hour,
+					MaxAttempts:    20,
+				},
+				Readiness: ReadinessConfig{
+					CheckInterval: 30 * time.Second,
+					MinFreeBytes:  DefaultMinFreeBytes,
+				},
+				Auth: AuthConfig{
+					ReloadInterval: 10 * time.Second,
+				},
+				Signing: SigningConfig{
+					MaxClockSkew: 5 * time.Minute,
+				},
+				Decompression: DecompressionConfig{
+					MaxBytes: DefaultMaxDecompressedBytes,
+					MaxRatio: 100,
+				},
+				Limits: LimitsConfig{
+					UsageMaxBytes:    DefaultUsageMaxBytes,
+					ErrorMaxBytes:    DefaultErrorMaxBytes,
+					SpecimenMaxBytes: DefaultSpecimenMaxBytes,
+					BatchMaxBytes:    DefaultBatchMaxBytes,
+				},
+				Enrichment: EnrichmentConfig{
+					Fields: EnrichmentFields,
+				},
+				Backpressure: BackpressureConfig{
+					RetryAfter: 30 * time.Second,
+				},
+				Cache: CacheConfig{
+					Mode:            CacheModeFiles,
+					SegmentMaxBytes: DefaultSegmentMaxBytes,
+					SegmentMaxAge:   time.Minute,
+				},
+				Upload: UploadConfig{
+					MultipartThreshold: DefaultMultipartThreshold,
+					PartSize:           DefaultPartSize,
+					Concurrency:        4,
+				},
+				SpecimenUpload: SpecimenUploadConfig{
+					Concurrency: DefaultSpecimenUploadConcurrency,
+					QueueSize:   DefaultSpecimenUploadQueueSize,
 				},
 			},
 		},
@@ -89,6 +275,9 @@ func TestConfig_Validate(t *testing.T) {
 					ErrorBucket:    "error-bucket",
 					SpecimenBucket: "specimen-bucket",
 				},
+				Auth: AuthConfig{
+					TokensFile: "/etc/lightfile6/tokens.yml",
+				},
 			},
 			wantErr: nil,
 		},
@@ -122,6 +311,289 @@ func TestConfig_Validate(t *testing.T) {
 			},
 			wantErr: ErrSpecimenBucketRequired,
 		},
+		{
+			name: "custom key template",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:      "usage-bucket",
+					UsageKeyTemplate: "{prefix}{yyyy}{mm}{dd}/{start}.{host}.{seq}.jsonl.gz",
+					ErrorBucket:      "error-bucket",
+					SpecimenBucket:   "specimen-bucket",
+				},
+				Auth: AuthConfig{
+					TokensFile: "/etc/lightfile6/tokens.yml",
+				},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "sequence key template without host",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:      "usage-bucket",
+					UsageKeyTemplate: "{prefix}{yyyy}{mm}{dd}/{start}.{seq}.jsonl.gz",
+					ErrorBucket:      "error-bucket",
+					SpecimenBucket:   "specimen-bucket",
+				},
+			},
+			wantErr: ErrKeyTemplateHostRequired,
+		},
+		{
+			name: "key template without unique placeholder",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:      "usage-bucket",
+					ErrorBucket:      "error-bucket",
+					ErrorKeyTemplate: "{prefix}{yyyy}/{mm}/{dd}/{hh}.jsonl.gz",
+					SpecimenBucket:   "specimen-bucket",
+				},
+			},
+			wantErr: ErrKeyTemplateNotUnique,
+		},
+		{
+			name: "per-user key template without user placeholder",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:      "usage-bucket",
+					ErrorBucket:      "error-bucket",
+					UsageKeyTemplate: "{prefix}{yyyy}/{mm}/{dd}/{start}.{hash}{ext}",
+					SpecimenBucket:   "specimen-bucket",
+				},
+				Aggregation: AggregationConfig{PerUser: true},
+			},
+			wantErr: ErrKeyTemplateUserRequired,
+		},
+		{
+			name: "parquet output",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Aggregation: AggregationConfig{
+					Usage: OutputConfig{
+						Format: FormatParquet,
+						Parquet: ParquetConfig{
+							Compression: "zstd",
+							Columns:     []ParquetColumn{{Name: "event", Type: "string"}},
+						},
+					},
+				},
+				Auth: AuthConfig{
+					TokensFile: "/etc/lightfile6/tokens.yml",
+				},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "unknown output format",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Aggregation: AggregationConfig{
+					Error: OutputConfig{Format: "csv"},
+				},
+			},
+			wantErr: ErrUnknownOutputFormat,
+		},
+		{
+			name: "negative max open files",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Aggregation: AggregationConfig{MaxOpenFiles: -1},
+			},
+			wantErr: ErrNegativeAggregationLimit,
+		},
+		{
+			name: "negative max buffer bytes",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Aggregation: AggregationConfig{MaxBufferBytes: -1},
+			},
+			wantErr: ErrNegativeAggregationLimit,
+		},
+		{
+			name: "unknown parquet column type",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Aggregation: AggregationConfig{
+					Usage: OutputConfig{
+						Format: FormatParquet,
+						Parquet: ParquetConfig{
+							Columns: []ParquetColumn{{Name: "event", Type: "varchar"}},
+						},
+					},
+				},
+			},
+			wantErr: ErrUnknownParquetType,
+		},
+		{
+			name: "unknown compression",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Aggregation: AggregationConfig{
+					Usage: OutputConfig{Compression: "brotli"},
+				},
+			},
+			wantErr: ErrUnknownCompression,
+		},
+		{
+			name: "compression level out of range",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Aggregation: AggregationConfig{
+					Usage: OutputConfig{Compression: CompressionGzip, Level: 12},
+				},
+			},
+			wantErr: ErrCompressionLevelOutOfRange,
+		},
+		{
+			name: "unknown layout",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+					Layout:         "flat",
+				},
+			},
+			wantErr: ErrUnknownLayout,
+		},
+		{
+			name: "local storage",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Storage: StorageConfig{
+					Type:     StorageLocal,
+					LocalDir: "/mnt/insights",
+				},
+				Auth: AuthConfig{
+					TokensFile: "/etc/lightfile6/tokens.yml",
+				},
+			},
+			wantErr: nil,
+		},
+		{
+			name: "local storage without directory",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Storage: StorageConfig{
+					Type: StorageLocal,
+				},
+			},
+			wantErr: ErrLocalDirRequired,
+		},
+		{
+			name: "unknown storage type",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Storage: StorageConfig{
+					Type: "ftp",
+				},
+			},
+			wantErr: ErrUnknownStorageType,
+		},
+		{
+			name: "unknown cache mode",
+			config: Config{
+				Cache: CacheConfig{Mode: "sqlite"},
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+			},
+			wantErr: ErrUnknownCacheMode,
+		},
+		{
+			name: "part size too small",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Upload: UploadConfig{PartSize: 1 << 20},
+			},
+			wantErr: ErrPartSizeTooSmall,
+		},
+		{
+			name: "unknown enrichment field",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Enrichment: EnrichmentConfig{
+					Enabled: true,
+					Fields:  []string{EnrichUser, "hostname"},
+				},
+			},
+			wantErr: ErrUnknownEnrichmentField,
+		},
+		{
+			name: "low water mark above high water mark",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+				Backpressure: BackpressureConfig{
+					HighWaterFiles: 1000,
+					LowWaterFiles:  2000,
+				},
+			},
+			wantErr: ErrLowWaterAboveHighWater,
+		},
+		{
+			name: "missing tokens file",
+			config: Config{
+				S3: S3Config{
+					UsageBucket:    "usage-bucket",
+					ErrorBucket:    "error-bucket",
+					SpecimenBucket: "specimen-bucket",
+				},
+			},
+			wantErr: ErrTokensFileRequired,
+		},
 	}
 
 	for _, tt := range tests {
@@ -134,4 +606,20 @@ func TestConfig_Validate(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+
+func TestLimitsConfig_ForEndpoint(t *testing.T) {
+	limits := LimitsConfig{
+		UsageMaxBytes:    1,
+		ErrorMaxBytes:    2,
+		SpecimenMaxBytes: 3,
+		BatchMaxBytes:    4,
+	}
+
+	assert.Equal(t, int64(1), limits.ForEndpoint("/usage"))
+	assert.Equal(t, int64(2), limits.ForEndpoint("/error"))
+	assert.Equal(t, int64(3), limits.ForEndpoint("/specimen"))
+	assert.Equal(t, int64(4), limits.ForEndpoint("/usage/batch"))
+	assert.Equal(t, int64(4), limits.ForEndpoint("/error/batch"))
+	assert.Equal(t, int64(0), limits.ForEndpoint("/health"))
+}
@@ -4,7 +4,25 @@ import "errors"
 
 // Configuration errors
 var (
-	ErrUsageBucketRequired    = errors.New("usage bucket is required")
-	ErrErrorBucketRequired    = errors.New("error bucket is required")
-	ErrSpecimenBucketRequired = errors.New("specimen bucket is required")
-)
\ No newline at end of file
+	ErrUsageBucketRequired        = errors.New("usage bucket is required")
+	ErrErrorBucketRequired        = errors.New("error bucket is required")
+	ErrSpecimenBucketRequired     = errors.New("specimen bucket is required")
+	ErrKeyTemplateNotUnique       = errors.New("key template must contain {seq} or {hash}")
+	ErrKeyTemplateHostRequired    = errors.New("key template with {seq} must also contain {host} or {hash}")
+	ErrKeyTemplateUserRequired    = errors.New("key template must contain {user} when aggregating per user")
+	ErrLocalDirRequired           = errors.New("storage local_dir is required for local storage")
+	ErrUnknownStorageType         = errors.New("unknown storage type")
+	ErrUnknownLayout              = errors.New("unknown s3 layout")
+	ErrUnknownCacheMode           = errors.New("unknown cache mode")
+	ErrNegativeAggregationLimit   = errors.New("aggregation max_open_files, max_event_age and max_buffer_bytes must not be negative")
+	ErrUnknownOutputFormat        = errors.New("unknown aggregation output format")
+	ErrUnknownCompression         = errors.New("unknown aggregation compression")
+	ErrCompressionLevelOutOfRange = errors.New("compression level is out of range for the codec")
+	ErrUnknownParquetCompression  = errors.New("unknown parquet compression")
+	ErrUnknownParquetType         = errors.New("unknown parquet column type")
+	ErrParquetColumnNameRequired  = errors.New("parquet column name is required")
+	ErrPartSizeTooSmall           = errors.New("upload part_size must be at least 5 MiB")
+	ErrTokensFileRequired         = errors.New("auth tokens_file is required")
+	ErrUnknownEnrichmentField     = errors.New("unknown enrichment field")
+	ErrLowWaterAboveHighWater     = errors.New("backpressure low water mark must not exceed high water mark")
+)
@@ -17,9 +17,40 @@ func Load(path string) (*Config, error) {
 	
 	// Set defaults
 	v.SetDefault("cache_dir", "/var/lib/lightfile6-insights-gateway")
+	v.SetDefault("cache.mode", CacheModeFiles)
+	v.SetDefault("cache.segment_max_bytes", DefaultSegmentMaxBytes)
+	v.SetDefault("cache.segment_max_age", "1m")
 	v.SetDefault("aws.region", "ap-northeast-1")
 	v.SetDefault("aggregation.usage_interval", "10m")
 	v.SetDefault("aggregation.error_interval", "10m")
+	v.SetDefault("aggregation.max_open_files", DefaultMaxOpenFiles)
+	v.SetDefault("aggregation.max_event_age", "168h")
+	v.SetDefault("aggregation.max_buffer_bytes", DefaultMaxBufferBytes)
+	v.SetDefault("aggregation.usage.format", FormatJSONL)
+	v.SetDefault("aggregation.error.format", FormatJSONL)
+	v.SetDefault("aggregation.usage.compression", CompressionGzip)
+	v.SetDefault("aggregation.error.compression", CompressionGzip)
+	v.SetDefault("storage.type", "s3")
+	v.SetDefault("retry.interval", "30s")
+	v.SetDefault("retry.initial_backoff", "1m")
+	v.SetDefault("retry.max_backoff", "1h")
+	v.SetDefault("retry.max_attempts", 20)
+	v.SetDefault("upload.multipart_threshold", DefaultMultipartThreshold)
+	v.SetDefault("upload.part_size", DefaultPartSize)
+	v.SetDefault("upload.concurrency", 4)
+	v.SetDefault("specimen_upload.concurrency", DefaultSpecimenUploadConcurrency)
+	v.SetDefault("specimen_upload.queue_size", DefaultSpecimenUploadQueueSize)
+	v.SetDefault("readiness.check_interval", "30s")
+	v.SetDefault("readiness.min_free_bytes", DefaultMinFreeBytes)
+	v.SetDefault("auth.reload_interval", "10s")
+	v.SetDefault("signing.max_clock_skew", "5m")
+	v.SetDefault("decompression.max_bytes", DefaultMaxDecompressedBytes)
+	v.SetDefault("decompression.max_ratio", 100)
+	v.SetDefault("limits.usage_max_bytes", DefaultUsageMaxBytes)
+	v.SetDefault("limits.error_max_bytes", DefaultErrorMaxBytes)
+	v.SetDefault("limits.specimen_max_bytes", DefaultSpecimenMaxBytes)
+	v.SetDefault("limits.batch_max_bytes", DefaultBatchMaxBytes)
+	v.SetDefault("backpressure.retry_after", "30s")
 	
 	// Enable environment variable support
 	v.SetEnvPrefix("LIGHTFILE6")
@@ -0,0 +1,134 @@
+package health
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+)
+
+// Component and overall statuses
+const (
+	StatusOK       = "ok"
+	StatusFail     = "fail"
+	StatusReady    = "ready"
+	StatusNotReady = "not_ready"
+)
+
+// ComponentStatus is the result of checking a single dependency
+type ComponentStatus struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the readiness report returned by Checker.Check
+type Report struct {
+	Status     string                     `json:"status"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// Ready reports whether all components are healthy
+func (r Report) Ready() bool {
+	return r.Status == StatusReady
+}
+
+// Checker checks the storage sink and the cache directory.
+// Storage checks reach the network, so their result is cached for
+// CheckInterval; the cache directory is checked on every call.
+type Checker struct {
+	cacheDir string
+	storage  sink.Sink
+	config   config.ReadinessConfig
+	now      func() time.Time
+
+	mu            sync.Mutex
+	storageStatus ComponentStatus
+}
+
+// NewChecker creates a new readiness checker
+func NewChecker(cacheDir string, storage sink.Sink, cfg config.ReadinessConfig) *Checker {
+	return &Checker{
+		cacheDir: cacheDir,
+		storage:  storage,
+		config:   cfg,
+		now:      time.Now,
+	}
+}
+
+// Check runs all readiness checks
+func (c *Checker) Check() Report {
+	report := Report{
+		Status: StatusReady,
+		Components: map[string]ComponentStatus{
+			"storage": c.checkStorage(),
+			"cache":   c.checkCache(),
+		},
+	}
+
+	for _, component := range report.Components {
+		if component.Status != StatusOK {
+			report.Status = StatusNotReady
+			break
+		}
+	}
+
+	return report
+}
+
+// checkStorage returns the cached storage status, refreshing it when stale
+func (c *Checker) checkStorage() ComponentStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := c.now()
+	if !c.storageStatus.CheckedAt.IsZero() && now.Sub(c.storageStatus.CheckedAt) < c.config.CheckInterval {
+		return c.storageStatus
+	}
+
+	if c.storage == nil {
+		c.storageStatus = failed(now, fmt.Errorf("storage sink not configured"))
+	} else if err := c.storage.HealthCheck(); err != nil {
+		c.storageStatus = failed(now, err)
+	} else {
+		c.storageStatus = ComponentStatus{Status: StatusOK, CheckedAt: now}
+	}
+
+	return c.storageStatus
+}
+
+// checkCache verifies the cache directory is writable and has enough free space
+func (c *Checker) checkCache() ComponentStatus {
+	now := c.now()
+
+	probe, err := os.CreateTemp(c.cacheDir, ".ready-*")
+	if err != nil {
+		return failed(now, fmt.Errorf("cache directory not writable: %w", err))
+	}
+	_, writeErr := probe.Write([]byte("ok"))
+	closeErr := probe.Close()
+	os.Remove(probe.Name())
+	if writeErr != nil {
+		return failed(now, fmt.Errorf("cache directory not writable: %w", writeErr))
+	}
+	if closeErr != nil {
+		return failed(now, fmt.Errorf("cache directory not writable: %w", closeErr))
+	}
+
+	free, err := freeBytes(c.cacheDir)
+	if err != nil {
+		return failed(now, fmt.Errorf("failed to get free space: %w", err))
+	}
+	if free < uint64(c.config.MinFreeBytes) {
+		return failed(now, fmt.Errorf("free space %d bytes below threshold %d bytes", free, c.config.MinFreeBytes))
+	}
+
+	return ComponentStatus{Status: StatusOK, CheckedAt: now}
+}
+
+func failed(now time.Time, err error) ComponentStatus {
+	return ComponentStatus{Status: StatusFail, Error: err.Error(), CheckedAt: now}
+}
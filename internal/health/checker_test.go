@@ -0,0 +1,88 @@
+package health
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockSink struct {
+	err   error
+	calls int
+}
+
+func (m *mockSink) PutAggregated(aggregate sink.Aggregate) error { return nil }
+func (m *mockSink) PutSpecimen(specimen sink.Specimen) error     { return nil }
+func (m *mockSink) AbortUpload(path string) error                { return nil }
+
+func (m *mockSink) HealthCheck() error {
+	m.calls++
+	return m.err
+}
+
+func TestChecker_Ready(t *testing.T) {
+	storage := &mockSink{}
+	checker := NewChecker(t.TempDir(), storage, config.ReadinessConfig{CheckInterval: time.Minute})
+
+	report := checker.Check()
+	assert.True(t, report.Ready())
+	assert.Equal(t, StatusOK, report.Components["storage"].Status)
+	assert.Equal(t, StatusOK, report.Components["cache"].Status)
+}
+
+func TestChecker_StorageCached(t *testing.T) {
+	storage := &mockSink{}
+	now := time.Now()
+	checker := NewChecker(t.TempDir(), storage, config.ReadinessConfig{CheckInterval: time.Minute})
+	checker.now = func() time.Time { return now }
+
+	checker.Check()
+	storage.err = errors.New("bucket not accessible")
+
+	// Within the interval the cached result is returned
+	now = now.Add(30 * time.Second)
+	report := checker.Check()
+	assert.True(t, report.Ready())
+	assert.Equal(t, 1, storage.calls)
+
+	// Once stale the storage is checked again
+	now = now.Add(time.Minute)
+	report = checker.Check()
+	assert.False(t, report.Ready())
+	assert.Equal(t, StatusNotReady, report.Status)
+	assert.Equal(t, StatusFail, report.Components["storage"].Status)
+	assert.Equal(t, "bucket not accessible", report.Components["storage"].Error)
+	assert.Equal(t, 2, storage.calls)
+}
+
+func TestChecker_CacheNotWritable(t *testing.T) {
+	cacheDir := filepath.Join(t.TempDir(), "missing")
+	checker := NewChecker(cacheDir, &mockSink{}, config.ReadinessConfig{})
+
+	report := checker.Check()
+	assert.False(t, report.Ready())
+	assert.Equal(t, StatusFail, report.Components["cache"].Status)
+	assert.Contains(t, report.Components["cache"].Error, "not writable")
+}
+
+func TestChecker_CacheFreeSpace(t *testing.T) {
+	cacheDir := t.TempDir()
+	checker := NewChecker(cacheDir, &mockSink{}, config.ReadinessConfig{MinFreeBytes: math.MaxInt64})
+
+	report := checker.Check()
+	assert.False(t, report.Ready())
+	assert.Contains(t, report.Components["cache"].Error, "below threshold")
+
+	// The probe file is cleaned up
+	entries, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
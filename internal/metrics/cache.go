@@ -0,0 +1,77 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog/log"
+)
+
+// cacheDirs lists the cache directories reported per data type.
+// The empty directory is the incoming directory of the data type.
+var cacheDirs = map[string][]string{
+	"usage":    {"", "aggregation", "uploading", "deadletter"},
+	"error":    {"", "aggregation", "uploading", "deadletter"},
+	"specimen": {"", "uploading", "deadletter"},
+}
+
+var (
+	cacheFilesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "files"),
+		"Number of files in a cache directory.",
+		[]string{"data_type", "directory"}, nil,
+	)
+	cacheOldestAgeDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(namespace, "cache", "oldest_file_age_seconds"),
+		"Age of the oldest file in a cache directory.",
+		[]string{"data_type", "directory"}, nil,
+	)
+)
+
+// CacheCollector reports cache directory statistics at scrape time
+type CacheCollector struct {
+	cacheManager *cache.Manager
+	now          func() time.Time
+}
+
+// NewCacheCollector creates a new cache collector
+func NewCacheCollector(cacheManager *cache.Manager) *CacheCollector {
+	return &CacheCollector{
+		cacheManager: cacheManager,
+		now:          time.Now,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *CacheCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- cacheFilesDesc
+	ch <- cacheOldestAgeDesc
+}
+
+// Collect implements prometheus.Collector
+func (c *CacheCollector) Collect(ch chan<- prometheus.Metric) {
+	now := c.now()
+	for dataType, dirs := range cacheDirs {
+		for _, dir := range dirs {
+			stats, err := c.cacheManager.GetDirStats(dataType, dir)
+			if err != nil {
+				log.Warn().Err(err).Str("dataType", dataType).Str("dir", dir).Msg("Failed to collect cache stats")
+				continue
+			}
+
+			label := dir
+			if label == "" {
+				label = "incoming"
+			}
+
+			var age float64
+			if stats.Files > 0 {
+				age = now.Sub(stats.Oldest).Seconds()
+			}
+
+			ch <- prometheus.MustNewConstMetric(cacheFilesDesc, prometheus.GaugeValue, float64(stats.Files), dataType, label)
+			ch <- prometheus.MustNewConstMetric(cacheOldestAgeDesc, prometheus.GaugeValue, age, dataType, label)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCacheCollector(t *testing.T) {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+
+	now := time.Now()
+	oldest := now.Add(-time.Hour)
+
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{}`)))
+	require.NoError(t, cacheManager.SaveUsage("user2", []byte(`{}`)))
+	files, err := cacheManager.GetUsageFiles()
+	require.NoError(t, err)
+	require.NoError(t, os.Chtimes(files[0], oldest, oldest))
+
+	uploading := filepath.Join(cacheManager.BaseDir, "error", "uploading", "aggregate_1.gz")
+	require.NoError(t, os.WriteFile(uploading, []byte("data"), 0644))
+
+	collector := NewCacheCollector(cacheManager)
+	collector.now = func() time.Time { return now }
+
+	registry := prometheus.NewRegistry()
+	require.NoError(t, registry.Register(collector))
+
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	values := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			key := family.GetName() + "/" + labels["data_type"] + "/" + labels["directory"]
+			values[key] = metric.GetGauge().GetValue()
+		}
+	}
+
+	assert.Equal(t, 2.0, values["lightfile6_gateway_cache_files/usage/incoming"])
+	assert.InDelta(t, time.Hour.Seconds(), values["lightfile6_gateway_cache_oldest_file_age_seconds/usage/incoming"], 1)
+	assert.Equal(t, 1.0, values["lightfile6_gateway_cache_files/error/uploading"])
+	assert.Equal(t, 0.0, values["lightfile6_gateway_cache_files/specimen/incoming"])
+	assert.Equal(t, 0.0, values["lightfile6_gateway_cache_oldest_file_age_seconds/specimen/incoming"])
+}
@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// namespace prefixes all gateway metrics
+const namespace = "lightfile6_gateway"
+
+// Registry holds all gateway metrics
+var Registry = prometheus.NewRegistry()
+
+var (
+	// RequestsTotal counts HTTP requests per endpoint, status and user
+	RequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "Number of HTTP requests by endpoint, status and user.",
+	}, []string{"endpoint", "status", "user"})
+
+	// RequestDuration observes HTTP request latency per endpoint and status
+	RequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "HTTP request latency by endpoint and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"endpoint", "status"})
+
+	// IngestedBytes counts bytes accepted per data type
+	IngestedBytes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "ingested_bytes_total",
+		Help:      "Bytes accepted into the cache by data type.",
+	}, []string{"data_type"})
+
+	// ValidationRejections counts records rejected by validation per data type and user
+	ValidationRejections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "validation_rejections_total",
+		Help:      "Number of records rejected by validation by data type and user.",
+	}, []string{"data_type", "user"})
+
+	// RateLimited counts requests rejected by rate limits or daily quotas per reason and user
+	RateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limited_total",
+		Help:      "Number of requests rejected by rate limits or daily quotas by reason and user.",
+	}, []string{"reason", "user"})
+
+	// AggregationDuration observes aggregation run duration per data type
+	AggregationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "aggregation_duration_seconds",
+		Help:      "Duration of aggregation runs by data type.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"data_type"})
+
+	// UploadDuration observes upload latency per data type
+	UploadDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "upload_duration_seconds",
+		Help:      "Latency of uploads to the storage sink by data type.",
+		Buckets:   prometheus.ExponentialBuckets(0.01, 2, 14),
+	}, []string{"data_type"})
+
+	// UploadFailures counts failed uploads per data type
+	UploadFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "upload_failures_total",
+		Help:      "Number of failed uploads to the storage sink by data type.",
+	}, []string{"data_type"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		RequestsTotal,
+		RequestDuration,
+		IngestedBytes,
+		ValidationRejections,
+		RateLimited,
+		AggregationDuration,
+		UploadDuration,
+		UploadFailures,
+	)
+}
+
+// Handler returns the HTTP handler exposing the registry
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+)
+
+// InstrumentedSink records upload latency and failures of another sink
+type InstrumentedSink struct {
+	next sink.Sink
+}
+
+var _ sink.Sink = (*InstrumentedSink)(nil)
+
+// NewInstrumentedSink wraps a sink with upload metrics
+func NewInstrumentedSink(next sink.Sink) *InstrumentedSink {
+	return &InstrumentedSink{next: next}
+}
+
+// PutAggregated implements sink.Sink
+func (s *InstrumentedSink) PutAggregated(aggregate sink.Aggregate) error {
+	start := time.Now()
+	err := s.next.PutAggregated(aggregate)
+	observeUpload(aggregate.DataType, start, err)
+	return err
+}
+
+// PutSpecimen implements sink.Sink
+func (s *InstrumentedSink) PutSpecimen(specimen sink.Specimen) error {
+	start := time.Now()
+	err := s.next.PutSpecimen(specimen)
+	observeUpload("specimen", start, err)
+	return err
+}
+
+// AbortUpload implements sink.Sink
+func (s *InstrumentedSink) AbortUpload(path string) error {
+	return s.next.AbortUpload(path)
+}
+
+// HealthCheck implements sink.Sink
+func (s *InstrumentedSink) HealthCheck() error {
+	return s.next.HealthCheck()
+}
+
+// observeUpload records the outcome of an upload
+func observeUpload(dataType string, start time.Time, err error) {
+	UploadDuration.WithLabelValues(dataType).Observe(time.Since(start).Seconds())
+	if err != nil {
+		UploadFailures.WithLabelValues(dataType).Inc()
+	}
+}
@@ -0,0 +1,250 @@
+// Package parquet writes flat Parquet files with optional columns.
+//
+// Encoding is left to github.com/parquet-go/parquet-go; this package maps
+// the column types of the configuration to Parquet logical types and keeps
+// track of the memory held by buffered row groups.
+package parquet
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/compress"
+)
+
+// Type is the logical type of a column
+type Type int
+
+// Column types
+const (
+	String Type = iota
+	Int64
+	Double
+	Boolean
+	Timestamp
+	JSON
+)
+
+// typeNames maps the configuration names of column types
+var typeNames = map[string]Type{
+	"string":    String,
+	"int64":     Int64,
+	"double":    Double,
+	"boolean":   Boolean,
+	"timestamp": Timestamp,
+	"json":      JSON,
+}
+
+// ParseType returns the column type of a configuration name
+func ParseType(name string) (Type, error) {
+	typ, ok := typeNames[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown parquet column type: %s", name)
+	}
+	return typ, nil
+}
+
+// Codec is the compression codec of data pages
+type Codec int
+
+// Compression codecs
+const (
+	Uncompressed Codec = iota
+	Snappy
+	Zstd
+)
+
+// ParseCodec returns the codec of a configuration name
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "none":
+		return Uncompressed, nil
+	case "", "snappy":
+		return Snappy, nil
+	case "zstd":
+		return Zstd, nil
+	default:
+		return 0, fmt.Errorf("unknown parquet compression: %s", name)
+	}
+}
+
+// Column describes a column of the file
+type Column struct {
+	Name string
+	Type Type
+}
+
+// Row group limits; a row group is written once either is reached
+const (
+	maxRowGroupRows  = 100000
+	maxRowGroupBytes = 64 << 20
+)
+
+// pageBufferSize is the size of the page buffered per column before it is
+// compressed, kept small as many files may be written at once
+const pageBufferSize = 64 << 10
+
+// ErrColumnCount is returned when a row does not match the columns
+var ErrColumnCount = errors.New("row does not match the number of columns")
+
+// ErrDuplicateColumn is returned when two columns have the same name
+var ErrDuplicateColumn = errors.New("duplicate parquet column name")
+
+// Writer writes rows to a Parquet file
+type Writer struct {
+	writer  *parquet.Writer
+	columns []Column
+
+	// leaves maps each column to its index in the file schema, which
+	// orders columns by name
+	leaves []int
+	row    parquet.Row
+
+	// rows and buffered are the rows and value bytes of the row group
+	// being buffered
+	rows     int
+	buffered int64
+}
+
+// NewWriter creates a writer of a Parquet file with the given columns
+func NewWriter(w io.Writer, columns []Column, codec Codec) (*Writer, error) {
+	group := make(parquet.Group, len(columns))
+	for _, column := range columns {
+		if _, ok := group[column.Name]; ok {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicateColumn, column.Name)
+		}
+		group[column.Name] = parquet.Optional(columnNode(column.Type))
+	}
+	schema := parquet.NewSchema("record", group)
+
+	leaves := make([]int, len(columns))
+	for i, column := range columns {
+		leaf, _ := schema.Lookup(column.Name)
+		leaves[i] = leaf.ColumnIndex
+	}
+
+	config, err := parquet.NewWriterConfig(
+		schema,
+		parquet.Compression(codecOf(codec)),
+		parquet.PageBufferSize(pageBufferSize),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Writer{
+		writer:  parquet.NewWriter(w, config),
+		columns: columns,
+		leaves:  leaves,
+		row:     make(parquet.Row, len(columns)),
+	}, nil
+}
+
+// columnNode returns the schema node of a column type
+func columnNode(typ Type) parquet.Node {
+	switch typ {
+	case Int64:
+		return parquet.Int(64)
+	case Double:
+		return parquet.Leaf(parquet.DoubleType)
+	case Boolean:
+		return parquet.Leaf(parquet.BooleanType)
+	case Timestamp:
+		return parquet.Timestamp(parquet.Microsecond)
+	case JSON:
+		return parquet.JSON()
+	default:
+		return parquet.String()
+	}
+}
+
+// codecOf returns the parquet-go codec of a compression codec
+func codecOf(codec Codec) compress.Codec {
+	switch codec {
+	case Snappy:
+		return &parquet.Snappy
+	case Zstd:
+		return &parquet.Zstd
+	default:
+		return &parquet.Uncompressed
+	}
+}
+
+// Write buffers a row. Values are nil for nulls, or a string, int64,
+// float64, bool or time.Time matching the column type.
+func (w *Writer) Write(row []any) error {
+	if len(row) != len(w.columns) {
+		return ErrColumnCount
+	}
+
+	var size int64
+	for i, value := range row {
+		v, n, ok := columnValue(w.columns[i].Type, value)
+		if !ok {
+			return fmt.Errorf("invalid value %T for parquet column %s", value, w.columns[i].Name)
+		}
+		definitionLevel := 1
+		if value == nil {
+			definitionLevel = 0
+		}
+		w.row[w.leaves[i]] = v.Level(0, definitionLevel, w.leaves[i])
+		size += n
+	}
+
+	if _, err := w.writer.WriteRows([]parquet.Row{w.row}); err != nil {
+		return err
+	}
+	w.rows++
+	w.buffered += size
+
+	if w.rows >= maxRowGroupRows || w.buffered >= maxRowGroupBytes {
+		return w.Flush()
+	}
+	return nil
+}
+
+// columnValue converts a value to a Parquet value of a column type and
+// returns its size
+func columnValue(typ Type, value any) (parquet.Value, int64, bool) {
+	switch v := value.(type) {
+	case nil:
+		return parquet.NullValue(), 0, true
+	case string:
+		return parquet.ByteArrayValue([]byte(v)), int64(len(v)), typ == String || typ == JSON
+	case int64:
+		return parquet.Int64Value(v), 8, typ == Int64
+	case float64:
+		return parquet.DoubleValue(v), 8, typ == Double
+	case bool:
+		return parquet.BooleanValue(v), 1, typ == Boolean
+	case time.Time:
+		return parquet.Int64Value(v.UnixMicro()), 8, typ == Timestamp
+	default:
+		return parquet.Value{}, 0, false
+	}
+}
+
+// Buffered returns the approximate number of bytes held in memory by the
+// row group being buffered
+func (w *Writer) Buffered() int64 {
+	return w.buffered
+}
+
+// Flush writes the buffered rows as a row group
+func (w *Writer) Flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+	w.rows = 0
+	w.buffered = 0
+	return w.writer.Flush()
+}
+
+// Close writes the buffered rows and the file footer. It does not close
+// the underlying writer.
+func (w *Writer) Close() error {
+	return w.writer.Close()
+}
@@ -0,0 +1,170 @@
+package parquet
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/parquet-go/parquet-go"
+	"github.com/parquet-go/parquet-go/format"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// column holds the decoded values of a column, nil for nulls
+type column []any
+
+// readFile reads a Parquet file back with the parquet-go reader and returns
+// the file and the values of each column
+func readFile(t *testing.T, data []byte) (*parquet.File, map[string]column) {
+	file, err := parquet.OpenFile(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	leaves := file.Schema().Columns()
+	columns := make(map[string]column)
+	for _, rowGroup := range file.RowGroups() {
+		rows := rowGroup.Rows()
+		buf := make([]parquet.Row, 10)
+		for {
+			n, err := rows.ReadRows(buf)
+			for _, row := range buf[:n] {
+				for _, value := range row {
+					name := leaves[value.Column()][0]
+					columns[name] = append(columns[name], decodeValue(file, name, value))
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+		}
+		require.NoError(t, rows.Close())
+	}
+	return file, columns
+}
+
+// decodeValue converts a Parquet value to the Go value written
+func decodeValue(file *parquet.File, name string, value parquet.Value) any {
+	if value.IsNull() {
+		return nil
+	}
+	leaf, _ := file.Schema().Lookup(name)
+	switch {
+	case leaf.Node.Type().LogicalType() != nil && leaf.Node.Type().LogicalType().Timestamp != nil:
+		return time.UnixMicro(value.Int64()).UTC()
+	case value.Kind() == parquet.ByteArray:
+		return string(value.ByteArray())
+	case value.Kind() == parquet.Int64:
+		return value.Int64()
+	case value.Kind() == parquet.Double:
+		return value.Double()
+	case value.Kind() == parquet.Boolean:
+		return value.Boolean()
+	}
+	return value
+}
+
+func TestWriter(t *testing.T) {
+	columns := []Column{
+		{Name: "event", Type: String},
+		{Name: "count", Type: Int64},
+		{Name: "ratio", Type: Double},
+		{Name: "ok", Type: Boolean},
+		{Name: "at", Type: Timestamp},
+		{Name: "extra", Type: JSON},
+	}
+	at := time.Date(2024, 1, 2, 3, 4, 5, 6000, time.UTC)
+	rows := [][]any{
+		{"a", int64(1), 0.5, true, at, `{"k":1}`},
+		{"b", nil, nil, false, nil, nil},
+		{nil, int64(-3), 1.25, nil, at.Add(time.Hour), `[1,2]`},
+	}
+
+	for _, codec := range []Codec{Uncompressed, Snappy, Zstd} {
+		var buf bytes.Buffer
+		writer, err := NewWriter(&buf, columns, codec)
+		require.NoError(t, err)
+		for _, row := range rows {
+			require.NoError(t, writer.Write(row))
+		}
+		require.NoError(t, writer.Close())
+
+		file, values := readFile(t, buf.Bytes())
+		assert.Equal(t, int64(3), file.NumRows())
+
+		// Columns are optional and carry their logical types
+		schema := file.Metadata().Schema
+		require.Len(t, schema, len(columns)+1)
+		logical := make(map[string]*format.LogicalType)
+		for _, element := range schema[1:] {
+			assert.Equal(t, format.Optional, *element.RepetitionType)
+			logical[element.Name] = element.LogicalType
+		}
+		assert.NotNil(t, logical["event"].UTF8)
+		assert.NotNil(t, logical["extra"].Json)
+		assert.NotNil(t, logical["at"].Timestamp)
+
+		assert.Equal(t, column{"a", "b", nil}, values["event"])
+		assert.Equal(t, column{int64(1), nil, int64(-3)}, values["count"])
+		assert.Equal(t, column{0.5, nil, 1.25}, values["ratio"])
+		assert.Equal(t, column{true, false, nil}, values["ok"])
+		assert.Equal(t, column{at, nil, at.Add(time.Hour)}, values["at"])
+		assert.Equal(t, column{`{"k":1}`, nil, `[1,2]`}, values["extra"])
+	}
+}
+
+func TestWriter_RowGroups(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, []Column{{Name: "n", Type: Int64}}, Snappy)
+	require.NoError(t, err)
+
+	total := maxRowGroupRows + 10
+	for i := 0; i < total; i++ {
+		require.NoError(t, writer.Write([]any{int64(i)}))
+	}
+	require.NoError(t, writer.Close())
+
+	file, values := readFile(t, buf.Bytes())
+	assert.Len(t, file.RowGroups(), 2)
+	require.Len(t, values["n"], total)
+	assert.Equal(t, int64(total-1), values["n"][total-1])
+}
+
+func TestWriter_Flush(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, []Column{{Name: "s", Type: String}}, Snappy)
+	require.NoError(t, err)
+
+	require.NoError(t, writer.Write([]any{"abc"}))
+	assert.Equal(t, int64(3), writer.Buffered())
+	require.NoError(t, writer.Flush())
+	assert.Zero(t, writer.Buffered())
+	require.NoError(t, writer.Write([]any{"de"}))
+	require.NoError(t, writer.Close())
+
+	file, values := readFile(t, buf.Bytes())
+	assert.Len(t, file.RowGroups(), 2)
+	assert.Equal(t, column{"abc", "de"}, values["s"])
+}
+
+func TestWriter_InvalidRow(t *testing.T) {
+	var buf bytes.Buffer
+	writer, err := NewWriter(&buf, []Column{{Name: "n", Type: Int64}}, Snappy)
+	require.NoError(t, err)
+
+	assert.ErrorIs(t, writer.Write([]any{int64(1), "extra"}), ErrColumnCount)
+	assert.Error(t, writer.Write([]any{"not a number"}))
+
+	// Rejected rows are not written
+	require.NoError(t, writer.Write([]any{int64(2)}))
+	require.NoError(t, writer.Close())
+	_, values := readFile(t, buf.Bytes())
+	assert.Equal(t, column{int64(2)}, values["n"])
+}
+
+func TestNewWriter_DuplicateColumn(t *testing.T) {
+	_, err := NewWriter(io.Discard, []Column{{Name: "a", Type: String}, {Name: "a", Type: Int64}}, Snappy)
+	assert.ErrorIs(t, err, ErrDuplicateColumn)
+}
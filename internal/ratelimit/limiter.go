@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"golang.org/x/time/rate"
+)
+
+// idleBucketTTL is how long an unused token bucket is kept
+const idleBucketTTL = 10 * time.Minute
+
+type bucket struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// Limiter is a token-bucket rate limiter keyed by user and optionally IP
+type Limiter struct {
+	config    config.RateLimitConfig
+	overrides map[string]config.RateLimitOverride
+	now       func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+// NewLimiter creates a new rate limiter
+func NewLimiter(cfg config.RateLimitConfig) *Limiter {
+	return &Limiter{
+		config:    cfg,
+		overrides: overridesByUser(cfg),
+		now:       time.Now,
+		buckets:   make(map[string]*bucket),
+	}
+}
+
+// Allow reports whether a request may proceed and, if not, how long the
+// client should wait before retrying
+func (l *Limiter) Allow(user, ip string) (bool, time.Duration) {
+	limit, burst := l.limitFor(user)
+	if limit <= 0 {
+		return true, 0
+	}
+
+	key := user
+	if l.config.PerIP {
+		key = user + "\n" + ip
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{limiter: rate.NewLimiter(rate.Limit(limit), burst)}
+		l.buckets[key] = b
+	}
+	b.lastSeen = now
+
+	reservation := b.limiter.ReserveN(now, 1)
+	if !reservation.OK() {
+		return false, time.Second
+	}
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		reservation.CancelAt(now)
+		return false, delay
+	}
+	return true, 0
+}
+
+// limitFor returns the request rate and burst of a user
+func (l *Limiter) limitFor(user string) (float64, int) {
+	limit := l.config.RequestsPerSecond
+	burst := l.config.Burst
+	if override, ok := l.overrides[user]; ok {
+		if override.RequestsPerSecond != 0 {
+			limit = override.RequestsPerSecond
+		}
+		if override.Burst != 0 {
+			burst = override.Burst
+		}
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(limit))
+	}
+	return limit, burst
+}
+
+// sweep drops buckets that have not been used recently
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < idleBucketTTL {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.lastSeen) >= idleBucketTTL {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+func overridesByUser(cfg config.RateLimitConfig) map[string]config.RateLimitOverride {
+	overrides := make(map[string]config.RateLimitOverride, len(cfg.Overrides))
+	for _, override := range cfg.Overrides {
+		overrides[override.User] = override
+	}
+	return overrides
+}
@@ -0,0 +1,67 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLimiter_Allow(t *testing.T) {
+	limiter := NewLimiter(config.RateLimitConfig{
+		RequestsPerSecond: 1,
+		Burst:             2,
+		Overrides: []config.RateLimitOverride{
+			{User: "bulk", Burst: 5},
+		},
+	})
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+
+	// The burst is available immediately
+	for i := 0; i < 2; i++ {
+		ok, _ := limiter.Allow("user1", "10.0.0.1")
+		assert.True(t, ok)
+	}
+	ok, retryAfter := limiter.Allow("user1", "10.0.0.1")
+	assert.False(t, ok)
+	assert.Equal(t, time.Second, retryAfter)
+
+	// Buckets are per user
+	ok, _ = limiter.Allow("user2", "10.0.0.1")
+	assert.True(t, ok)
+
+	// Overrides replace the global burst
+	for i := 0; i < 5; i++ {
+		ok, _ := limiter.Allow("bulk", "10.0.0.1")
+		assert.True(t, ok)
+	}
+	ok, _ = limiter.Allow("bulk", "10.0.0.1")
+	assert.False(t, ok)
+
+	// Tokens refill over time
+	now = now.Add(time.Second)
+	ok, _ = limiter.Allow("user1", "10.0.0.1")
+	assert.True(t, ok)
+}
+
+func TestLimiter_PerIP(t *testing.T) {
+	limiter := NewLimiter(config.RateLimitConfig{RequestsPerSecond: 1, PerIP: true})
+
+	ok, _ := limiter.Allow("user1", "10.0.0.1")
+	assert.True(t, ok)
+	ok, _ = limiter.Allow("user1", "10.0.0.1")
+	assert.False(t, ok)
+	ok, _ = limiter.Allow("user1", "10.0.0.2")
+	assert.True(t, ok)
+}
+
+func TestLimiter_Disabled(t *testing.T) {
+	limiter := NewLimiter(config.RateLimitConfig{})
+
+	for i := 0; i < 100; i++ {
+		ok, _ := limiter.Allow("user1", "10.0.0.1")
+		assert.True(t, ok)
+	}
+}
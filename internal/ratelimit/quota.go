@@ -0,0 +1,203 @@
+package ratelimit
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// quotaFlushInterval is how often usage counters are written to disk
+const quotaFlushInterval = 10 * time.Second
+
+// Usage is the consumption of a user on one day
+type Usage struct {
+	Requests int64 `json:"requests"`
+	Bytes    int64 `json:"bytes"`
+}
+
+// Quotas tracks daily request and byte quotas per user. Counters are kept in
+// memory and durably written to <cache_dir>/quota/<yyyy-mm-dd>.json through
+// the cache manager so they survive restarts and crashes.
+type Quotas struct {
+	cacheManager *cache.Manager
+	config    config.RateLimitConfig
+	overrides map[string]config.RateLimitOverride
+	now       func() time.Time
+
+	mu        sync.Mutex
+	day       string
+	usage     map[string]*Usage
+	dirty     bool
+	lastFlush time.Time
+}
+
+// NewQuotas creates a quota tracker and loads today's counters from the cache
+func NewQuotas(cacheManager *cache.Manager, cfg config.RateLimitConfig) *Quotas {
+	q := &Quotas{
+		cacheManager: cacheManager,
+		config:       cfg,
+		overrides:    overridesByUser(cfg),
+		now:          time.Now,
+		usage:        make(map[string]*Usage),
+	}
+
+	q.mu.Lock()
+	q.rollover(q.now())
+	q.mu.Unlock()
+	return q
+}
+
+// Check reports whether a user is within their daily quotas and, if not,
+// how long until the quotas reset
+func (q *Quotas) Check(user string) (bool, time.Duration) {
+	maxRequests, maxBytes := q.quotaFor(user)
+	if maxRequests <= 0 && maxBytes <= 0 {
+		return true, 0
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	q.rollover(now)
+
+	usage := q.usage[user]
+	if usage == nil {
+		return true, 0
+	}
+	if (maxRequests > 0 && usage.Requests >= maxRequests) || (maxBytes > 0 && usage.Bytes >= maxBytes) {
+		return false, untilMidnight(now)
+	}
+	return true, 0
+}
+
+// Add records a request and its body size against a user's quotas
+func (q *Quotas) Add(user string, bytes int64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.now()
+	q.rollover(now)
+
+	usage := q.usage[user]
+	if usage == nil {
+		usage = &Usage{}
+		q.usage[user] = usage
+	}
+	usage.Requests++
+	usage.Bytes += bytes
+	q.dirty = true
+
+	if now.Sub(q.lastFlush) >= quotaFlushInterval {
+		q.flush(now)
+	}
+}
+
+// Usage returns the consumption of a user today
+func (q *Quotas) Usage(user string) Usage {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.rollover(q.now())
+	if usage := q.usage[user]; usage != nil {
+		return *usage
+	}
+	return Usage{}
+}
+
+// Flush writes the counters to disk
+func (q *Quotas) Flush() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.flush(q.now())
+}
+
+// quotaFor returns the daily request and byte quotas of a user
+func (q *Quotas) quotaFor(user string) (int64, int64) {
+	maxRequests := q.config.DailyRequests
+	maxBytes := q.config.DailyBytes
+	if override, ok := q.overrides[user]; ok {
+		if override.DailyRequests != 0 {
+			maxRequests = override.DailyRequests
+		}
+		if override.DailyBytes != 0 {
+			maxBytes = override.DailyBytes
+		}
+	}
+	return maxRequests, maxBytes
+}
+
+// rollover switches to a new day's counters, loading them from disk on startup
+func (q *Quotas) rollover(now time.Time) {
+	day := now.UTC().Format("2006-01-02")
+	if day == q.day {
+		return
+	}
+
+	if q.day != "" {
+		q.flush(now)
+	}
+	q.day = day
+	q.usage = q.load(day)
+	q.dirty = false
+
+	// Counters of previous days are no longer needed
+	if err := q.cacheManager.RemoveQuotasExcept(day); err != nil {
+		log.Warn().Err(err).Msg("Failed to remove old quota usage")
+	}
+}
+
+func (q *Quotas) load(day string) map[string]*Usage {
+	usage := make(map[string]*Usage)
+
+	data, err := q.cacheManager.ReadQuota(day)
+	if os.IsNotExist(err) {
+		return usage
+	}
+	if err == nil {
+		err = json.Unmarshal(data, &usage)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("day", day).Msg("Failed to load quota usage, starting from zero")
+		return make(map[string]*Usage)
+	}
+	return usage
+}
+
+func (q *Quotas) flush(now time.Time) {
+	q.lastFlush = now
+	if !q.dirty {
+		return
+	}
+
+	if err := q.write(); err != nil {
+		log.Error().Err(err).Msg("Failed to save quota usage")
+		return
+	}
+	q.dirty = false
+}
+
+func (q *Quotas) write() error {
+	data, err := json.Marshal(q.usage)
+	if err != nil {
+		return err
+	}
+
+	if err := q.cacheManager.SaveQuota(q.day, data); err != nil {
+		return fmt.Errorf("failed to write quota file: %w", err)
+	}
+	return nil
+}
+
+// untilMidnight returns the time until the next UTC day
+func untilMidnight(now time.Time) time.Duration {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+	return midnight.Sub(now)
+}
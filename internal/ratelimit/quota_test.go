@@ -0,0 +1,95 @@
+package ratelimit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupCacheManager(t *testing.T) *cache.Manager {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+	return cacheManager
+}
+
+func TestQuotas_Check(t *testing.T) {
+	quotas := NewQuotas(setupCacheManager(t), config.RateLimitConfig{
+		DailyRequests: 2,
+		DailyBytes:    100,
+		Overrides: []config.RateLimitOverride{
+			{User: "bulk", DailyRequests: 10},
+		},
+	})
+	now := time.Date(2024, 1, 2, 18, 0, 0, 0, time.UTC)
+	quotas.now = func() time.Time { return now }
+
+	// Request quota
+	quotas.Add("user1", 10)
+	ok, _ := quotas.Check("user1")
+	assert.True(t, ok)
+	quotas.Add("user1", 10)
+	ok, retryAfter := quotas.Check("user1")
+	assert.False(t, ok)
+	assert.Equal(t, 6*time.Hour, retryAfter)
+
+	// Byte quota
+	quotas.Add("user2", 100)
+	ok, _ = quotas.Check("user2")
+	assert.False(t, ok)
+
+	// Overrides replace the global request quota but inherit the byte quota
+	quotas.Add("bulk", 10)
+	quotas.Add("bulk", 10)
+	ok, _ = quotas.Check("bulk")
+	assert.True(t, ok)
+
+	// Quotas reset on the next UTC day
+	now = now.Add(6 * time.Hour)
+	ok, _ = quotas.Check("user1")
+	assert.True(t, ok)
+	assert.Equal(t, Usage{}, quotas.Usage("user1"))
+}
+
+func TestQuotas_Persistence(t *testing.T) {
+	cacheManager := setupCacheManager(t)
+	dir := filepath.Join(cacheManager.BaseDir, "quota")
+	cfg := config.RateLimitConfig{DailyRequests: 2}
+
+	// Counters from previous days are removed on load
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "2000-01-01.json"), []byte(`{"user1":{"requests":1}}`), 0644))
+
+	quotas := NewQuotas(cacheManager, cfg)
+	quotas.Add("user1", 42)
+	quotas.Add("user1", 8)
+	quotas.Flush()
+
+	_, err := os.Stat(filepath.Join(dir, "2000-01-01.json"))
+	assert.True(t, os.IsNotExist(err))
+
+	// Counters are written atomically through the cache, nothing is left in tmp
+	entries, err := os.ReadDir(filepath.Join(cacheManager.BaseDir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Usage survives a restart
+	restarted := NewQuotas(cacheManager, cfg)
+	assert.Equal(t, Usage{Requests: 2, Bytes: 50}, restarted.Usage("user1"))
+	ok, _ := restarted.Check("user1")
+	assert.False(t, ok)
+}
+
+func TestQuotas_CorruptFile(t *testing.T) {
+	cacheManager := setupCacheManager(t)
+	today := time.Now().UTC().Format("2006-01-02")
+	require.NoError(t, os.WriteFile(cacheManager.QuotaPath(today), []byte("not json"), 0644))
+
+	quotas := NewQuotas(cacheManager, config.RateLimitConfig{DailyRequests: 1})
+	ok, _ := quotas.Check("user1")
+	assert.True(t, ok)
+}
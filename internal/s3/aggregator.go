@@ -1,33 +1,43 @@
 package s3
 
 import (
-	"compress/gzip"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/metrics"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
 	"github.com/rs/zerolog/log"
 )
 
 // Aggregator handles file aggregation and compression
 type Aggregator struct {
 	cacheManager *cache.Manager
-	s3Client     *Client
+	storage      sink.Sink
+	config       *config.Config
 }
 
 // NewAggregator creates a new aggregator
-func NewAggregator(cacheManager *cache.Manager, s3Client *Client) *Aggregator {
+func NewAggregator(cacheManager *cache.Manager, storage sink.Sink, cfg *config.Config) *Aggregator {
 	return &Aggregator{
 		cacheManager: cacheManager,
-		s3Client:     s3Client,
+		storage:      storage,
+		config:       cfg,
 	}
 }
 
-// AggregateAndUpload aggregates files and uploads to S3
+// AggregateAndUpload aggregates files and uploads them to the storage sink
 func (a *Aggregator) AggregateAndUpload(dataType string) error {
 	log.Info().Str("dataType", dataType).Msg("Starting aggregation")
 
@@ -44,13 +54,18 @@ func (a *Aggregator) AggregateAndUpload(dataType string) error {
 
 	log.Info().Str("dataType", dataType).Int("count", len(files)).Msg("Files to aggregate")
 
+	startTime := time.Now()
+	defer func() {
+		metrics.AggregationDuration.WithLabelValues(dataType).Observe(time.Since(startTime).Seconds())
+	}()
+
 	// Move files to aggregation directory
 	if err := a.cacheManager.MoveToAggregation(files, dataType); err != nil {
 		return fmt.Errorf("failed to move files to aggregation: %w", err)
 	}
 
 	// Get files from aggregation directory
-	aggregationFiles, err := a.cacheManager.GetAggregationFiles(dataType)
+	aggregationFiles, err := a.getAggregationFiles(dataType)
 	if err != nil {
 		return fmt.Errorf("failed to get aggregation files: %w", err)
 	}
@@ -58,52 +73,97 @@ func (a *Aggregator) AggregateAndUpload(dataType string) error {
 	// Sort files by name (timestamp-based)
 	sort.Strings(aggregationFiles)
 
-	// Create temporary file for aggregated data
-	tempFile, err := a.createTempFile(dataType)
+	// Aggregate the records into one file per event hour, partition and, when
+	// aggregating per user, user. Each file's window runs from the event time
+	// of its oldest record to now.
+	outputs, err := a.aggregateFiles(aggregationFiles, dataType, time.Now())
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
-	}
-	defer os.Remove(tempFile)
-
-	// Aggregate files
-	if err := a.aggregateFiles(aggregationFiles, tempFile); err != nil {
 		return fmt.Errorf("failed to aggregate files: %w", err)
 	}
 
-	// Move to uploading directory
-	uploadingPath, err := a.cacheManager.MoveToUploading(tempFile, dataType)
+	// Move to uploading directory. If any file cannot be moved, the sources
+	// are kept and aggregated again, so nothing of this cycle is uploaded.
+	uploadingPaths, err := a.moveToUploading(outputs, dataType)
 	if err != nil {
 		return fmt.Errorf("failed to move to uploading: %w", err)
 	}
+	defer func() {
+		for _, uploadingPath := range uploadingPaths {
+			a.cacheManager.ReleaseFile(uploadingPath)
+		}
+	}()
 
-	// Upload to S3
-	if err := a.s3Client.UploadAggregatedFile(uploadingPath, dataType); err != nil {
-		return fmt.Errorf("failed to upload to S3: %w", err)
-	}
-
-	// Remove uploaded file
-	if err := a.cacheManager.RemoveFile(uploadingPath); err != nil {
-		log.Warn().Err(err).Str("file", uploadingPath).Msg("Failed to remove uploaded file")
-	}
-
-	// Remove aggregated files
+	// The aggregated files are synced to the uploading directory and now
+	// hold the data, so remove the source files. A failed upload is retried
+	// from the uploading directory.
 	for _, file := range aggregationFiles {
 		if err := a.cacheManager.RemoveFile(file); err != nil {
 			log.Warn().Err(err).Str("file", file).Msg("Failed to remove aggregated file")
 		}
 	}
 
+	// Upload to storage
+	var uploadErrs []error
+	for _, uploadingPath := range uploadingPaths {
+		if err := a.UploadFile(uploadingPath, dataType); err != nil {
+			uploadErrs = append(uploadErrs, err)
+		}
+	}
+	if err := errors.Join(uploadErrs...); err != nil {
+		return err
+	}
+
 	log.Info().
 		Str("dataType", dataType).
 		Int("filesAggregated", len(aggregationFiles)).
+		Int("filesUploaded", len(uploadingPaths)).
 		Msg("Aggregation completed")
 
 	return nil
 }
 
+// moveToUploading moves aggregated files to the uploading directory and
+// returns their claimed paths there. Each file is claimed before it is moved
+// so the retrier cannot pick it up before the caller releases it. Either all
+// files are moved, or none are left in the uploading or aggregation directory.
+func (a *Aggregator) moveToUploading(outputs []string, dataType string) ([]string, error) {
+	for _, output := range outputs {
+		a.cacheManager.TrackFile(output)
+	}
+
+	uploadingPaths := make([]string, 0, len(outputs))
+	for _, output := range outputs {
+		uploadingPath := a.cacheManager.UploadingPath(output, dataType)
+		var err error
+		if !a.cacheManager.ClaimFile(uploadingPath) {
+			err = fmt.Errorf("aggregated file %s is already claimed", uploadingPath)
+		} else if _, err = a.cacheManager.MoveToUploading(output, dataType); err != nil {
+			a.cacheManager.ReleaseFile(uploadingPath)
+		}
+		if err != nil {
+			for _, path := range append(uploadingPaths, outputs...) {
+				if removeErr := a.cacheManager.RemoveFile(path); removeErr != nil && !os.IsNotExist(removeErr) {
+					log.Error().Err(removeErr).Str("file", path).Msg("Failed to remove aggregated file")
+				}
+			}
+			for _, path := range uploadingPaths {
+				a.cacheManager.ReleaseFile(path)
+			}
+			return nil, err
+		}
+		uploadingPaths = append(uploadingPaths, uploadingPath)
+	}
+	return uploadingPaths, nil
+}
+
 // ProcessRemaining processes any remaining files in aggregation/uploading directories
 func (a *Aggregator) ProcessRemaining() error {
 	dataTypes := []string{"usage", "error"}
+
+	// Open segments are sealed so their records are aggregated too
+	if err := a.cacheManager.SealSegments(); err != nil {
+		log.Error().Err(err).Msg("Failed to seal segments")
+	}
 	
 	for _, dataType := range dataTypes {
 		// Process uploading files first
@@ -114,13 +174,13 @@ func (a *Aggregator) ProcessRemaining() error {
 		}
 
 		for _, file := range uploadingFiles {
-			if err := a.s3Client.UploadAggregatedFile(file, dataType); err != nil {
-				log.Error().Err(err).Str("file", file).Msg("Failed to upload remaining file")
+			if !a.cacheManager.ClaimFile(file) {
 				continue
 			}
-			if err := a.cacheManager.RemoveFile(file); err != nil {
-				log.Warn().Err(err).Str("file", file).Msg("Failed to remove uploaded file")
+			if err := a.UploadFile(file, dataType); err != nil {
+				log.Error().Err(err).Str("file", file).Msg("Failed to upload remaining file")
 			}
+			a.cacheManager.ReleaseFile(file)
 		}
 
 		// Process aggregation files
@@ -129,6 +189,23 @@ func (a *Aggregator) ProcessRemaining() error {
 		}
 	}
 
+	// Process specimens whose upload was interrupted
+	uploadingSpecimens, err := a.cacheManager.GetUploadingFiles("specimen")
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get uploading specimen files")
+		return err
+	}
+
+	for _, file := range uploadingSpecimens {
+		if !a.cacheManager.ClaimFile(file) {
+			continue
+		}
+		if err := sink.PutUploadingSpecimen(a.storage, a.cacheManager, file); err != nil {
+			log.Error().Err(err).Str("file", file).Msg("Failed to upload specimen")
+		}
+		a.cacheManager.ReleaseFile(file)
+	}
+
 	// Process remaining specimen files
 	specimenFiles, err := a.cacheManager.GetSpecimenFiles()
 	if err != nil {
@@ -137,15 +214,7 @@ func (a *Aggregator) ProcessRemaining() error {
 	}
 
 	for _, file := range specimenFiles {
-		uri, _, err := a.cacheManager.GetSpecimenInfo(file)
-		if err != nil {
-			log.Warn().Err(err).Str("file", file).Msg("Failed to parse specimen info")
-			continue
-		}
-		
-		// TODO: Need user info for specimen upload
-		// For now, use "unknown" as user
-		if err := a.s3Client.UploadSpecimen("unknown", uri); err != nil {
+		if err := sink.UploadSpecimenFile(a.storage, a.cacheManager, file); err != nil {
 			log.Error().Err(err).Str("file", file).Msg("Failed to upload specimen")
 		}
 	}
@@ -153,6 +222,38 @@ func (a *Aggregator) ProcessRemaining() error {
 	return nil
 }
 
+// UploadFile uploads an aggregated file from the uploading directory and
+// removes it from cache on success
+func (a *Aggregator) UploadFile(path string, dataType string) error {
+	start, end := parseAggregateFilename(path)
+	labels := parseAggregateLabels(path)
+	typ := aggregateTypeOf(path)
+	aggregate := sink.Aggregate{
+		Path:            path,
+		DataType:        dataType,
+		Start:           start,
+		End:             end,
+		Partition:       labels.Get("partition"),
+		User:            labels.Get("user"),
+		Ext:             typ.keyExt,
+		ContentType:     typ.contentType,
+	}
+
+	if err := a.storage.PutAggregated(aggregate); err != nil {
+		return fmt.Errorf("failed to upload aggregated file: %w", err)
+	}
+
+	// Remove uploaded file
+	if err := a.cacheManager.RemoveFile(path); err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Failed to remove uploaded file")
+	}
+	if err := a.cacheManager.RemoveRetryState(path, dataType); err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Failed to remove retry state")
+	}
+
+	return nil
+}
+
 // getFilesToAggregate returns files ready for aggregation
 func (a *Aggregator) getFilesToAggregate(dataType string) ([]string, error) {
 	switch dataType {
@@ -165,60 +266,184 @@ func (a *Aggregator) getFilesToAggregate(dataType string) ([]string, error) {
 	}
 }
 
-// createTempFile creates a temporary file for aggregation
-func (a *Aggregator) createTempFile(dataType string) (string, error) {
-	tempDir := filepath.Join(a.cacheManager.BaseDir, dataType, "aggregation")
-	tempFile := filepath.Join(tempDir, fmt.Sprintf("aggregate_%d.gz", time.Now().UnixNano()))
-	
-	file, err := os.Create(tempFile)
+// getAggregationFiles returns the cache files in the aggregation directory.
+// Aggregated files left there by an interrupted aggregation are incomplete
+// and removed, as their source files are aggregated again.
+func (a *Aggregator) getAggregationFiles(dataType string) ([]string, error) {
+	files, err := a.cacheManager.GetAggregationFiles(dataType)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	file.Close()
-	
-	return tempFile, nil
+
+	sources := files[:0]
+	for _, file := range files {
+		if !isAggregateFile(file) {
+			sources = append(sources, file)
+			continue
+		}
+		if err := a.cacheManager.RemoveFile(file); err != nil {
+			log.Warn().Err(err).Str("file", file).Msg("Failed to remove incomplete aggregated file")
+		}
+	}
+	return sources, nil
 }
 
-// aggregateFiles aggregates multiple files into a single gzipped file
-func (a *Aggregator) aggregateFiles(files []string, outputPath string) error {
-	// Create output file
-	outFile, err := os.Create(outputPath)
+// unknownUser groups the records of per-user aggregates whose cache file
+// does not name a user
+const unknownUser = "_unknown"
+
+// fileUser returns the user of a usage/error cache file, taken from its
+// <nanos>.<pid>.<user> filename
+func fileUser(path string) string {
+	parts := strings.SplitN(filepath.Base(path), ".", 3)
+	if len(parts) < 3 {
+		return ""
+	}
+	return parts[2]
+}
+
+// receiveTime returns the receive time of a usage/error cache file,
+// taken from its <nanos>.<pid>.<user> filename or its modification time
+func receiveTime(path string) (time.Time, error) {
+	nanosStr, _, _ := strings.Cut(filepath.Base(path), ".")
+	if nanos, err := strconv.ParseInt(nanosStr, 10, 64); err == nil {
+		return time.Unix(0, nanos), nil
+	}
+
+	info, err := os.Stat(path)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %w", err)
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// parseAggregateFilename extracts the aggregation window from an
+// aggregate_<start>_<end>[_<labels>].<ext> filename. Files without a window fall
+// back to their modification time.
+func parseAggregateFilename(path string) (start, end time.Time) {
+	name := aggregateName(path)
+	if startStr, rest, ok := strings.Cut(name, "_"); ok {
+		endStr, _, _ := strings.Cut(rest, "_")
+		startNanos, startErr := strconv.ParseInt(startStr, 10, 64)
+		endNanos, endErr := strconv.ParseInt(endStr, 10, 64)
+		if startErr == nil && endErr == nil {
+			return time.Unix(0, startNanos), time.Unix(0, endNanos)
+		}
+	}
+
+	modTime := time.Now()
+	if info, err := os.Stat(path); err == nil {
+		modTime = info.ModTime()
 	}
-	defer outFile.Close()
+	return modTime, modTime
+}
 
-	// Create gzip writer
-	gzWriter := gzip.NewWriter(outFile)
-	defer gzWriter.Close()
+// aggregateName returns an aggregated filename without prefix and extension
+func aggregateName(path string) string {
+	name := strings.TrimPrefix(filepath.Base(path), aggregateFilePrefix)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// parseAggregateLabels extracts the partition and user labels from an
+// aggregated filename
+func parseAggregateLabels(path string) url.Values {
+	name := aggregateName(path)
+	parts := strings.SplitN(name, "_", 3)
+	if len(parts) < 3 {
+		return url.Values{}
+	}
+	labels, err := url.ParseQuery(parts[2])
+	if err != nil {
+		return url.Values{}
+	}
+	return labels
+}
+
+// aggregateFiles aggregates multiple files into files of the configured
+// format in the aggregation directory, one per event hour, partition and,
+// when aggregating per user, user, and returns their paths
+func (a *Aggregator) aggregateFiles(files []string, dataType string, end time.Time) ([]string, error) {
+	dir := filepath.Join(a.cacheManager.BaseDir, dataType, "aggregation")
+	writer := newPartitionWriter(dir, end, a.outputFormat(dataType), partitionOptions{
+		partitionField: a.config.S3.PartitionField,
+		timestampField: a.config.Aggregation.TimestampField,
+		maxOpenFiles:   a.config.Aggregation.MaxOpenFiles,
+		maxEventAge:    a.config.Aggregation.MaxEventAge,
+		maxBufferBytes: a.config.Aggregation.MaxBufferBytes,
+	})
 
 	// Process each file
 	for _, filePath := range files {
-		if err := a.appendFile(gzWriter, filePath); err != nil {
-			return fmt.Errorf("failed to append file %s: %w", filePath, err)
+		if err := a.appendFile(writer, filePath); err != nil {
+			writer.abort()
+			return nil, fmt.Errorf("failed to append file %s: %w", filePath, err)
 		}
 	}
 
-	return nil
+	return writer.close()
 }
 
-// appendFile appends a file's content to the gzip writer
-func (a *Aggregator) appendFile(gzWriter *gzip.Writer, filePath string) error {
+// appendFile appends each JSON record in a cache file to the partition writer.
+// Segment files are read record by record, each with its own receive time;
+// anything after a corrupt segment record is skipped.
+func (a *Aggregator) appendFile(writer *partitionWriter, filePath string) error {
+	if cache.IsSegment(filePath) {
+		err := cache.ReadSegment(filePath, func(user string, received time.Time, data []byte) error {
+			return a.appendRecords(writer, bytes.NewReader(data), filePath, received, a.recordUser(user))
+		})
+		if errors.Is(err, cache.ErrCorruptSegment) {
+			log.Warn().Err(err).Str("file", filePath).Msg("Skipping corrupt segment records")
+			return nil
+		}
+		return err
+	}
+
+	received, err := receiveTime(filePath)
+	if err != nil {
+		received = writer.end
+	}
+
 	file, err := os.Open(filePath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
-	// Copy file content
-	if _, err := io.Copy(gzWriter, file); err != nil {
-		return err
+	return a.appendRecords(writer, file, filePath, received, a.recordUser(fileUser(filePath)))
+}
+
+// recordUser returns the user records are aggregated under, empty unless
+// aggregating per user
+func (a *Aggregator) recordUser(user string) string {
+	if !a.config.Aggregation.PerUser {
+		return ""
+	}
+	if user == "" {
+		return unknownUser
 	}
+	return user
+}
 
-	// Add newline if the file doesn't end with one
-	if _, err := gzWriter.Write([]byte("\n")); err != nil {
-		return err
+// appendRecords appends each JSON record in r, received at the given time
+// from the given user, to the partition writer, which files it under its
+// event hour. Each record is written as a single compact line, so
+// pretty-printed or multi-record bodies cannot break the JSONL output.
+// Anything after the first invalid record is skipped.
+func (a *Aggregator) appendRecords(writer *partitionWriter, r io.Reader, filePath string, received time.Time, user string) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var record json.RawMessage
+		if err := decoder.Decode(&record); err == io.EOF {
+			break
+		} else if err != nil {
+			log.Warn().Err(err).Str("file", filePath).Msg("Skipping invalid JSON in cache file")
+			break
+		}
+
+		if err := writer.write(record, received, user); err != nil {
+			return err
+		}
 	}
 
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,617 @@
+package s3
+
+import (
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+	"github.com/klauspost/compress/zstd"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func setupAggregator(t *testing.T) (*Aggregator, *cache.Manager, string) {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+
+	destDir := t.TempDir()
+	cfg := &config.Config{
+		S3: config.S3Config{
+			UsageBucket:    "test-usage",
+			ErrorBucket:    "test-error",
+			SpecimenBucket: "test-specimen",
+		},
+		Storage: config.StorageConfig{
+			Type:     config.StorageLocal,
+			LocalDir: destDir,
+		},
+	}
+
+	return NewAggregator(cacheManager, sink.NewLocalSink(cfg), cfg), cacheManager, destDir
+}
+
+func findStoredFiles(t *testing.T, root string) []string {
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func readGzip(t *testing.T, path string) string {
+	file, err := os.Open(path)
+	require.NoError(t, err)
+	defer file.Close()
+
+	gzReader, err := gzip.NewReader(file)
+	require.NoError(t, err)
+	defer gzReader.Close()
+
+	content, err := io.ReadAll(gzReader)
+	require.NoError(t, err)
+	return string(content)
+}
+
+func TestAggregator_AggregateAndUpload(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"a"}`)))
+	require.NoError(t, cacheManager.SaveUsage("user2", []byte(`{"event":"b"}`)))
+
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	files := findStoredFiles(t, filepath.Join(destDir, "test-usage"))
+	require.Len(t, files, 1)
+	assert.Equal(t, "{\"event\":\"a\"}\n{\"event\":\"b\"}\n", readGzip(t, files[0]))
+
+	// Successive aggregations in the same hour do not overwrite each other
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"c"}`)))
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+	assert.Len(t, findStoredFiles(t, filepath.Join(destDir, "test-usage")), 2)
+
+	// Cache directories are cleaned up
+	usageFiles, err := cacheManager.GetUsageFiles()
+	require.NoError(t, err)
+	assert.Empty(t, usageFiles)
+
+	aggregationFiles, err := cacheManager.GetAggregationFiles("usage")
+	require.NoError(t, err)
+	assert.Empty(t, aggregationFiles)
+
+	uploadingFiles, err := cacheManager.GetUploadingFiles("usage")
+	require.NoError(t, err)
+	assert.Empty(t, uploadingFiles)
+}
+
+func TestAggregator_MoveToUploading(t *testing.T) {
+	aggregator, cacheManager, _ := setupAggregator(t)
+
+	aggregationDir := filepath.Join(cacheManager.BaseDir, "usage", "aggregation")
+	var outputs []string
+	for _, user := range []string{"user1", "user2", "user3"} {
+		output := filepath.Join(aggregationDir, aggregateFilename(time.Unix(0, 1), time.Unix(0, 2), "", user, 0, ".jsonl.gz"))
+		require.NoError(t, os.WriteFile(output, []byte("data"), 0644))
+		outputs = append(outputs, output)
+	}
+
+	// The second file cannot be moved after the first one was
+	blocked := cacheManager.UploadingPath(outputs[1], "usage")
+	require.True(t, cacheManager.ClaimFile(blocked))
+	_, err := aggregator.moveToUploading(outputs, "usage")
+	assert.Error(t, err)
+	cacheManager.ReleaseFile(blocked)
+
+	// Nothing of the failed aggregation is left to be uploaded
+	uploadingFiles, err := cacheManager.GetUploadingFiles("usage")
+	require.NoError(t, err)
+	assert.Empty(t, uploadingFiles)
+	aggregationFiles, err := cacheManager.GetAggregationFiles("usage")
+	require.NoError(t, err)
+	assert.Empty(t, aggregationFiles)
+	assert.True(t, cacheManager.ClaimFile(cacheManager.UploadingPath(outputs[0], "usage")))
+}
+
+func TestAggregator_AggregateAndUpload_OneRecordPerLine(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+
+	// Pretty-printed record
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte("{\n  \"event\": \"a\"\n}\n")))
+	// Batch of records
+	require.NoError(t, cacheManager.SaveUsage("user2", []byte("{\"event\":\"b\"}\n{\"event\":\"c\"}")))
+	// Invalid trailing content is dropped
+	require.NoError(t, cacheManager.SaveUsage("user3", []byte(`{"event":"d"} oops`)))
+
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	files := findStoredFiles(t, filepath.Join(destDir, "test-usage"))
+	require.Len(t, files, 1)
+	assert.Equal(t, "{\"event\":\"a\"}\n{\"event\":\"b\"}\n{\"event\":\"c\"}\n{\"event\":\"d\"}\n", readGzip(t, files[0]))
+}
+
+func TestParseAggregateFilename(t *testing.T) {
+	start := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	end := start.Add(10 * time.Minute)
+
+	path := filepath.Join(t.TempDir(), fmt.Sprintf("aggregate_%d_%d.gz", start.UnixNano(), end.UnixNano()))
+	parsedStart, parsedEnd := parseAggregateFilename(path)
+	assert.True(t, start.Equal(parsedStart))
+	assert.True(t, end.Equal(parsedEnd))
+
+	// The partition is kept in the filename
+	partitioned := filepath.Join(t.TempDir(), aggregateFilename(start, end, "app_version=1.2_3", "user.1", 0, ".gz"))
+	parsedStart, parsedEnd = parseAggregateFilename(partitioned)
+	assert.True(t, start.Equal(parsedStart))
+	assert.True(t, end.Equal(parsedEnd))
+	labels := parseAggregateLabels(partitioned)
+	assert.Equal(t, "app_version=1.2_3", labels.Get("partition"))
+	assert.Equal(t, "user.1", labels.Get("user"))
+	assert.Empty(t, parseAggregateLabels(path))
+
+	// Files without a window fall back to their modification time
+	legacy := filepath.Join(t.TempDir(), "aggregate_123.gz")
+	require.NoError(t, os.WriteFile(legacy, nil, 0644))
+	require.NoError(t, os.Chtimes(legacy, start, start))
+	parsedStart, parsedEnd = parseAggregateFilename(legacy)
+	assert.True(t, start.Equal(parsedStart))
+	assert.True(t, start.Equal(parsedEnd))
+}
+
+func TestAggregator_AggregateAndUpload_HivePartitions(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+	aggregator.config.S3.Layout = config.LayoutHive
+	aggregator.config.S3.PartitionField = "app.version"
+
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"a","app":{"version":"1.0"}}`)))
+	require.NoError(t, cacheManager.SaveUsage("user2", []byte(`{"event":"b","app":{"version":"2.0"}}`)))
+	require.NoError(t, cacheManager.SaveUsage("user3", []byte(`{"event":"c","app":{"version":"1.0"}}`)))
+	require.NoError(t, cacheManager.SaveUsage("user4", []byte(`{"event":"d"}`)))
+
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	contents := make(map[string]string)
+	for _, file := range findStoredFiles(t, filepath.Join(destDir, "test-usage")) {
+		rel, err := filepath.Rel(filepath.Join(destDir, "test-usage"), file)
+		require.NoError(t, err)
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		require.Len(t, parts, 4)
+		assert.Regexp(t, `^dt=\d{4}-\d{2}-\d{2}$`, parts[0])
+		assert.Regexp(t, `^hour=\d{2}$`, parts[1])
+		contents[parts[2]] = readGzip(t, file)
+	}
+
+	assert.Equal(t, map[string]string{
+		"version=1.0":                        "{\"event\":\"a\",\"app\":{\"version\":\"1.0\"}}\n{\"event\":\"c\",\"app\":{\"version\":\"1.0\"}}\n",
+		"version=2.0":                        "{\"event\":\"b\",\"app\":{\"version\":\"2.0\"}}\n",
+		"version=__HIVE_DEFAULT_PARTITION__": "{\"event\":\"d\"}\n",
+	}, contents)
+
+	aggregationFiles, err := cacheManager.GetAggregationFiles("usage")
+	require.NoError(t, err)
+	assert.Empty(t, aggregationFiles)
+}
+
+func TestAggregator_AggregateAndUpload_EventTime(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+	aggregator.config.Aggregation.TimestampField = "ts"
+
+	// Events buffered offline land in the hour they happened
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"a","ts":"2024-01-02T03:04:05Z"}`)))
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"b","ts":1704171600}`)))
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"c","ts":1704164645000}`)))
+	// Records without a valid timestamp use their receive time
+	require.NoError(t, cacheManager.SaveUsage("user2", []byte(`{"event":"d"}`)))
+	require.NoError(t, cacheManager.SaveUsage("user2", []byte(`{"event":"e","ts":"2999-01-01T00:00:00Z"}`)))
+
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	contents := make(map[string]string)
+	for _, file := range findStoredFiles(t, filepath.Join(destDir, "test-usage")) {
+		rel, err := filepath.Rel(filepath.Join(destDir, "test-usage"), file)
+		require.NoError(t, err)
+		contents[filepath.ToSlash(filepath.Dir(rel))] = readGzip(t, file)
+	}
+	require.Len(t, contents, 3)
+
+	assert.Equal(t, "{\"event\":\"a\",\"ts\":\"2024-01-02T03:04:05Z\"}\n{\"event\":\"c\",\"ts\":1704164645000}\n", contents["2024/01/02/03"])
+	assert.Equal(t, "{\"event\":\"b\",\"ts\":1704171600}\n", contents["2024/01/02/05"])
+	delete(contents, "2024/01/02/03")
+	delete(contents, "2024/01/02/05")
+	for dir, content := range contents {
+		assert.NotContains(t, dir, "2999")
+		assert.Equal(t, "{\"event\":\"d\"}\n{\"event\":\"e\",\"ts\":\"2999-01-01T00:00:00Z\"}\n", content)
+	}
+}
+
+func TestAggregator_AggregateAndUpload_MaxEventAge(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+	aggregator.config.Aggregation.TimestampField = "ts"
+	aggregator.config.Aggregation.MaxEventAge = 24 * time.Hour
+
+	// Events older than the horizon are grouped by receive time
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"a","ts":"2024-01-02T03:04:05Z"}`)))
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	files := findStoredFiles(t, filepath.Join(destDir, "test-usage"))
+	require.Len(t, files, 1)
+	assert.NotContains(t, filepath.ToSlash(files[0]), "2024/01/02")
+	assert.Contains(t, filepath.ToSlash(files[0]), time.Now().UTC().Format("2006/01/02"))
+}
+
+func TestAggregator_AggregateAndUpload_MaxOpenFiles(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+	aggregator.config.S3.PartitionField = "app"
+	aggregator.config.Aggregation.TimestampField = "ts"
+	aggregator.config.Aggregation.MaxOpenFiles = 3
+
+	// Two rounds over 12 hours and 4 partitions, so that every file is
+	// finished before the second round writes to its hour and partition
+	const hours, partitions = 12, 4
+	base := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	for round := 0; round < 2; round++ {
+		for hour := 0; hour < hours; hour++ {
+			for partition := 0; partition < partitions; partition++ {
+				record := fmt.Sprintf(`{"round":%d,"app":"%d","ts":"%s"}`, round, partition, base.Add(time.Duration(hour)*time.Hour).Format(time.RFC3339))
+				require.NoError(t, cacheManager.SaveUsage("user1", []byte(record)))
+			}
+		}
+	}
+
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	files := findStoredFiles(t, filepath.Join(destDir, "test-usage"))
+	require.Len(t, files, 2*hours*partitions)
+	records := make(map[string][]string)
+	for _, file := range files {
+		rel, err := filepath.Rel(filepath.Join(destDir, "test-usage"), file)
+		require.NoError(t, err)
+		dir := filepath.ToSlash(filepath.Dir(rel))
+		records[dir] = append(records[dir], strings.Split(strings.TrimSpace(readGzip(t, file)), "\n")...)
+	}
+	require.Len(t, records, hours*partitions)
+	for dir, lines := range records {
+		assert.Len(t, lines, 2, dir)
+	}
+
+	aggregationFiles, err := cacheManager.GetAggregationFiles("usage")
+	require.NoError(t, err)
+	assert.Empty(t, aggregationFiles)
+}
+
+func TestPartitionWriter_MaxOpenFiles(t *testing.T) {
+	dir := t.TempDir()
+	end := time.Now()
+	writer := newPartitionWriter(dir, end, jsonlFormat(".jsonl", func(w io.Writer) (io.WriteCloser, error) {
+		return nopWriteCloser{w}, nil
+	}), partitionOptions{partitionField: "p", maxOpenFiles: 2})
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, writer.write([]byte(fmt.Sprintf(`{"p":%d}`, i%5)), end, ""))
+		assert.LessOrEqual(t, len(writer.outputs), 2)
+	}
+
+	paths, err := writer.close()
+	require.NoError(t, err)
+	require.Len(t, paths, 10)
+	parts := make(map[string]int)
+	for _, path := range paths {
+		labels := parseAggregateLabels(path)
+		parts[labels.Get("partition")+"/"+labels.Get("part")]++
+	}
+	assert.Len(t, parts, 10)
+	assert.Equal(t, 1, parts["p=0/1"])
+}
+
+func TestParseEventTime(t *testing.T) {
+	expected := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, value := range []string{"2024-01-02T03:04:05Z", "2024-01-02T12:04:05+09:00", "1704164645", "1704164645000", "1704164645.0"} {
+		parsed, ok := parseEventTime(value)
+		assert.True(t, ok, value)
+		assert.True(t, expected.Equal(parsed), value)
+	}
+
+	for _, value := range []string{"yesterday", "-1", "0"} {
+		_, ok := parseEventTime(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestAggregator_AggregateAndUpload_PerUser(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+	aggregator.config.Aggregation.PerUser = true
+
+	require.NoError(t, cacheManager.SaveUsage("alice", []byte(`{"event":"a"}`)))
+	require.NoError(t, cacheManager.SaveUsage("bob", []byte(`{"event":"b"}`)))
+	require.NoError(t, cacheManager.SaveUsage("alice", []byte(`{"event":"c"}`)))
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	aliceFiles := findStoredFiles(t, filepath.Join(destDir, "test-usage", "alice"))
+	require.Len(t, aliceFiles, 1)
+	assert.Equal(t, "{\"event\":\"a\"}\n{\"event\":\"c\"}\n", readGzip(t, aliceFiles[0]))
+
+	bobFiles := findStoredFiles(t, filepath.Join(destDir, "test-usage", "bob"))
+	require.Len(t, bobFiles, 1)
+	assert.Equal(t, "{\"event\":\"b\"}\n", readGzip(t, bobFiles[0]))
+
+	assert.Len(t, findStoredFiles(t, filepath.Join(destDir, "test-usage")), 2)
+}
+
+func TestAggregator_AggregateAndUpload_PerUserParquet(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+	aggregator.config.Aggregation.PerUser = true
+	aggregator.config.Aggregation.MaxOpenFiles = 16
+	aggregator.config.Aggregation.MaxBufferBytes = 1 << 10
+	aggregator.config.Aggregation.Usage = config.OutputConfig{
+		Format:  config.FormatParquet,
+		Parquet: config.ParquetConfig{Compression: "snappy", InferRecords: 1000},
+	}
+
+	// More users than open files, each sending records in turn
+	const users, records = 40, 3
+	for i := 0; i < records; i++ {
+		for user := 0; user < users; user++ {
+			record := fmt.Sprintf(`{"event":"e%d","payload":"%s"}`, i, strings.Repeat("x", 100))
+			require.NoError(t, cacheManager.SaveUsage(fmt.Sprintf("user%d", user), []byte(record)))
+		}
+	}
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	for user := 0; user < users; user++ {
+		var events []any
+		for _, file := range findStoredFiles(t, filepath.Join(destDir, "test-usage", fmt.Sprintf("user%d", user))) {
+			data, err := os.ReadFile(file)
+			require.NoError(t, err)
+			events = append(events, readParquet(t, data)["event"]...)
+		}
+		assert.ElementsMatch(t, []any{"e0", "e1", "e2"}, events, user)
+	}
+}
+
+func TestPartitionWriter_MaxBufferBytes(t *testing.T) {
+	aggregator, _, _ := setupAggregator(t)
+	aggregator.config.Aggregation.Usage = config.OutputConfig{
+		Format:  config.FormatParquet,
+		Parquet: config.ParquetConfig{Compression: "snappy", InferRecords: 1000},
+	}
+
+	const maxBuffer = 4 << 10
+	end := time.Now()
+	writer := newPartitionWriter(t.TempDir(), end, aggregator.outputFormat("usage"), partitionOptions{maxBufferBytes: maxBuffer})
+	for i := 0; i < 1000; i++ {
+		record := fmt.Sprintf(`{"n":%d,"payload":"%s"}`, i, strings.Repeat("x", 100))
+		require.NoError(t, writer.write([]byte(record), end, fmt.Sprintf("user%d", i%50)))
+		assert.LessOrEqual(t, writer.buffered(), int64(maxBuffer))
+	}
+
+	paths, err := writer.close()
+	require.NoError(t, err)
+	require.Len(t, paths, 50)
+	var rows int
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		require.NoError(t, err)
+		rows += len(readParquet(t, data)["n"])
+	}
+	assert.Equal(t, 1000, rows)
+}
+
+func TestAggregator_AggregateAndUpload_PerUserSegments(t *testing.T) {
+	cacheManager := cache.NewManager(t.TempDir())
+	cacheManager.UseSegments(config.CacheConfig{SegmentMaxBytes: 1 << 20})
+	require.NoError(t, cacheManager.Init())
+
+	destDir := t.TempDir()
+	cfg := &config.Config{
+		S3:          config.S3Config{UsageBucket: "test-usage"},
+		Aggregation: config.AggregationConfig{PerUser: true},
+		Storage: config.StorageConfig{
+			Type:     config.StorageLocal,
+			LocalDir: destDir,
+		},
+	}
+	aggregator := NewAggregator(cacheManager, sink.NewLocalSink(cfg), cfg)
+
+	// Segments mix the records of all users
+	require.NoError(t, cacheManager.SaveUsage("alice", []byte(`{"event":"a"}`)))
+	require.NoError(t, cacheManager.SaveUsage("bob", []byte(`{"event":"b"}`)))
+	require.NoError(t, aggregator.ProcessRemaining())
+
+	aliceFiles := findStoredFiles(t, filepath.Join(destDir, "test-usage", "alice"))
+	require.Len(t, aliceFiles, 1)
+	assert.Equal(t, "{\"event\":\"a\"}\n", readGzip(t, aliceFiles[0]))
+
+	bobFiles := findStoredFiles(t, filepath.Join(destDir, "test-usage", "bob"))
+	require.Len(t, bobFiles, 1)
+	assert.Equal(t, "{\"event\":\"b\"}\n", readGzip(t, bobFiles[0]))
+}
+
+func TestAggregator_AggregateAndUpload_Compression(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+	aggregator.config.Aggregation.Usage = config.OutputConfig{Compression: config.CompressionZstd, Level: 19}
+	aggregator.config.Aggregation.Error = config.OutputConfig{Compression: config.CompressionNone}
+
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"a"}`)))
+	require.NoError(t, cacheManager.SaveError("user1", []byte(`{"message":"x"}`)))
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+	require.NoError(t, aggregator.AggregateAndUpload("error"))
+
+	files := findStoredFiles(t, filepath.Join(destDir, "test-usage"))
+	require.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], ".jsonl.zst"), files[0])
+	file, err := os.Open(files[0])
+	require.NoError(t, err)
+	defer file.Close()
+	decoder, err := zstd.NewReader(file)
+	require.NoError(t, err)
+	defer decoder.Close()
+	data, err := io.ReadAll(decoder)
+	require.NoError(t, err)
+	assert.Equal(t, "{\"event\":\"a\"}\n", string(data))
+
+	files = findStoredFiles(t, filepath.Join(destDir, "test-error"))
+	require.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], ".jsonl"), files[0])
+	data, err = os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "{\"message\":\"x\"}\n", string(data))
+}
+
+func TestAggregator_AggregateAndUpload_Parquet(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+	aggregator.config.Aggregation.Usage = config.OutputConfig{
+		Format: config.FormatParquet,
+		Parquet: config.ParquetConfig{
+			Compression:  "snappy",
+			InferRecords: 1000,
+		},
+	}
+
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"a","count":1}`)))
+	require.NoError(t, cacheManager.SaveUsage("user2", []byte(`{"event":"b","count":2}`)))
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	files := findStoredFiles(t, filepath.Join(destDir, "test-usage"))
+	require.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], ".parquet"), files[0])
+
+	data, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "PAR1", string(data[:4]))
+	assert.Equal(t, "PAR1", string(data[len(data)-4:]))
+
+	// Errors keep the default format
+	require.NoError(t, cacheManager.SaveError("user1", []byte(`{"message":"x"}`)))
+	require.NoError(t, aggregator.AggregateAndUpload("error"))
+	files = findStoredFiles(t, filepath.Join(destDir, "test-error"))
+	require.Len(t, files, 1)
+	assert.True(t, strings.HasSuffix(files[0], ".jsonl.gz"), files[0])
+}
+
+func TestAggregator_AggregateAndUpload_NoFiles(t *testing.T) {
+	aggregator, _, destDir := setupAggregator(t)
+
+	require.NoError(t, aggregator.AggregateAndUpload("error"))
+	assert.Empty(t, findStoredFiles(t, destDir))
+}
+
+func TestAggregator_ProcessRemaining(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+
+	require.NoError(t, cacheManager.SaveError("user1", []byte(`{"error":"x"}`)))
+	_, _, err := cacheManager.SaveSpecimen(cache.SpecimenMeta{
+		User: "user1",
+		URI:  "http://example.com/test.png",
+	}, strings.NewReader("specimen"))
+	require.NoError(t, err)
+	_, _, err = cacheManager.SaveSpecimen(cache.SpecimenMeta{
+		User: "user2",
+		URI:  "http://example.com/other.png",
+	}, strings.NewReader("specimen"))
+	require.NoError(t, err)
+
+	// Simulate a specimen upload interrupted by a crash
+	specimenFiles, err := cacheManager.GetSpecimenFiles()
+	require.NoError(t, err)
+	require.Len(t, specimenFiles, 2)
+	_, err = cacheManager.MoveToUploading(specimenFiles[1], "specimen")
+	require.NoError(t, err)
+
+	require.NoError(t, aggregator.ProcessRemaining())
+
+	assert.Len(t, findStoredFiles(t, filepath.Join(destDir, "test-error")), 1)
+
+	// Specimens are stored under the user that uploaded them
+	assert.Len(t, findStoredFiles(t, filepath.Join(destDir, "test-specimen", "user1")), 1)
+	assert.Len(t, findStoredFiles(t, filepath.Join(destDir, "test-specimen", "user2")), 1)
+
+	specimenFiles, err = cacheManager.GetSpecimenFiles()
+	require.NoError(t, err)
+	assert.Empty(t, specimenFiles)
+
+	uploadingFiles, err := cacheManager.GetUploadingFiles("specimen")
+	require.NoError(t, err)
+	assert.Empty(t, uploadingFiles)
+}
+
+func TestAggregator_AggregateAndUpload_Segments(t *testing.T) {
+	cacheManager := cache.NewManager(t.TempDir())
+	cacheManager.UseSegments(config.CacheConfig{SegmentMaxBytes: 1 << 20})
+	require.NoError(t, cacheManager.Init())
+
+	destDir := t.TempDir()
+	cfg := &config.Config{
+		S3: config.S3Config{UsageBucket: "test-usage"},
+		Storage: config.StorageConfig{
+			Type:     config.StorageLocal,
+			LocalDir: destDir,
+		},
+	}
+	aggregator := NewAggregator(cacheManager, sink.NewLocalSink(cfg), cfg)
+
+	require.NoError(t, cacheManager.SaveUsage("user1", []byte(`{"event":"a"}`)))
+	require.NoError(t, cacheManager.SaveUsage("user2", []byte("{\"event\":\"b\"}\n{\"event\":\"c\"}")))
+
+	// Only sealed segments are aggregated
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+	assert.Empty(t, findStoredFiles(t, destDir))
+
+	require.NoError(t, aggregator.ProcessRemaining())
+
+	files := findStoredFiles(t, filepath.Join(destDir, "test-usage"))
+	require.Len(t, files, 1)
+	assert.Equal(t, "{\"event\":\"a\"}\n{\"event\":\"b\"}\n{\"event\":\"c\"}\n", readGzip(t, files[0]))
+}
+
+// writeSegment writes a sealed segment holding records received at the given times
+func writeSegment(t *testing.T, path string, user string, received []time.Time, data []string) {
+	var segment []byte
+	for i := range data {
+		payload := binary.BigEndian.AppendUint64(nil, uint64(received[i].UnixNano()))
+		payload = binary.BigEndian.AppendUint16(payload, uint16(len(user)))
+		payload = append(append(payload, user...), data[i]...)
+		segment = binary.BigEndian.AppendUint32(segment, uint32(len(payload)))
+		segment = binary.BigEndian.AppendUint32(segment, crc32.Checksum(payload, crc32.MakeTable(crc32.Castagnoli)))
+		segment = append(segment, payload...)
+	}
+	require.NoError(t, os.WriteFile(path, segment, 0644))
+}
+
+func TestAggregator_AggregateAndUpload_SegmentReceiveTime(t *testing.T) {
+	aggregator, cacheManager, destDir := setupAggregator(t)
+
+	// Records in one segment fall back to their own receive time, not the segment's
+	opened := time.Date(2024, 1, 2, 3, 10, 0, 0, time.UTC)
+	writeSegment(t, filepath.Join(cacheManager.BaseDir, "usage", fmt.Sprintf("%d.1%s", opened.UnixNano(), cache.SegmentExt)), "user1",
+		[]time.Time{opened, opened.Add(2 * time.Hour)},
+		[]string{`{"event":"a"}`, `{"event":"b"}`})
+
+	require.NoError(t, aggregator.AggregateAndUpload("usage"))
+
+	contents := make(map[string]string)
+	for _, file := range findStoredFiles(t, filepath.Join(destDir, "test-usage")) {
+		rel, err := filepath.Rel(filepath.Join(destDir, "test-usage"), file)
+		require.NoError(t, err)
+		contents[filepath.ToSlash(filepath.Dir(rel))] = readGzip(t, file)
+	}
+	assert.Equal(t, map[string]string{
+		"2024/01/02/03": "{\"event\":\"a\"}\n",
+		"2024/01/02/05": "{\"event\":\"b\"}\n",
+	}, contents)
+}
@@ -0,0 +1,155 @@
+package s3
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"path/filepath"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/klauspost/compress/zstd"
+)
+
+// recordWriter encodes aggregated records into a file
+type recordWriter interface {
+	write(record json.RawMessage) error
+
+	// buffered returns the bytes of records held in memory, and flush
+	// writes them to the file
+	buffered() int64
+	flush() error
+
+	// close flushes the encoded records; it does not close the file
+	close() error
+}
+
+// outputFormat creates the record writers of aggregated files
+type outputFormat struct {
+	// ext is the extension of aggregated files in the cache
+	ext string
+
+	newWriter func(w io.Writer) (recordWriter, error)
+}
+
+// aggregateType describes how an aggregated file is stored, by the
+// extension of the file in the cache
+type aggregateType struct {
+	keyExt      string
+	contentType string
+}
+
+// aggregateTypes maps cache file extensions to their stored types.
+// Compressed files are stored as compressed objects without a
+// Content-Encoding, so clients do not decompress them on download.
+var aggregateTypes = map[string]aggregateType{
+	".gz":      {keyExt: ".jsonl.gz", contentType: "application/gzip"},
+	".zst":     {keyExt: ".jsonl.zst", contentType: "application/zstd"},
+	".jsonl":   {keyExt: ".jsonl", contentType: "application/x-ndjson"},
+	".parquet": {keyExt: ".parquet", contentType: "application/vnd.apache.parquet"},
+}
+
+// aggregateTypeOf returns the stored type of an aggregated file. Unknown
+// extensions are stored as gzipped JSON lines, the only format of earlier
+// versions.
+func aggregateTypeOf(path string) aggregateType {
+	if typ, ok := aggregateTypes[filepath.Ext(path)]; ok {
+		return typ
+	}
+	return aggregateTypes[".gz"]
+}
+
+// outputFormat returns the output format configured for a data type
+func (a *Aggregator) outputFormat(dataType string) outputFormat {
+	output := a.config.Aggregation.Output(dataType)
+	if output.Format == config.FormatParquet {
+		columns, err := parquetColumns(output.Parquet.Columns, a.config.Enrichment)
+		return outputFormat{
+			ext: ".parquet",
+			newWriter: func(w io.Writer) (recordWriter, error) {
+				if err != nil {
+					return nil, err
+				}
+				return newParquetRecordWriter(w, columns, output.Parquet)
+			},
+		}
+	}
+
+	switch output.Compression {
+	case config.CompressionZstd:
+		level := zstd.SpeedDefault
+		if output.Level > 0 {
+			level = zstd.EncoderLevelFromZstd(output.Level)
+		}
+		return jsonlFormat(".zst", func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(level))
+		})
+	case config.CompressionNone:
+		return jsonlFormat(".jsonl", func(w io.Writer) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		})
+	default:
+		level := gzip.DefaultCompression
+		if output.Level > 0 {
+			level = output.Level
+		}
+		return jsonlFormat(".gz", func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		})
+	}
+}
+
+// jsonlFormat returns the format of JSON lines files encoded by the writers
+// of newEncoder
+func jsonlFormat(ext string, newEncoder func(w io.Writer) (io.WriteCloser, error)) outputFormat {
+	return outputFormat{
+		ext: ext,
+		newWriter: func(w io.Writer) (recordWriter, error) {
+			encoder, err := newEncoder(w)
+			if err != nil {
+				return nil, err
+			}
+			return &jsonlWriter{encoder: encoder}, nil
+		},
+	}
+}
+
+// nopWriteCloser writes uncompressed JSON lines
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// jsonlWriter writes records as compressed JSON lines
+type jsonlWriter struct {
+	encoder io.WriteCloser
+	line    bytes.Buffer
+}
+
+// write appends a record as a single compact line
+func (j *jsonlWriter) write(record json.RawMessage) error {
+	j.line.Reset()
+	if err := json.Compact(&j.line, record); err != nil {
+		return err
+	}
+	j.line.WriteByte('\n')
+	_, err := j.encoder.Write(j.line.Bytes())
+	return err
+}
+
+// buffered returns 0 as records are compressed as they are written, within
+// the bounded window of the encoder
+func (j *jsonlWriter) buffered() int64 {
+	return 0
+}
+
+func (j *jsonlWriter) flush() error {
+	return nil
+}
+
+func (j *jsonlWriter) close() error {
+	return j.encoder.Close()
+}
@@ -0,0 +1,340 @@
+package s3
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// maxParts is the maximum number of parts of a multipart upload
+const maxParts = 10000
+
+// s3API is the subset of the S3 client used for uploads
+type s3API interface {
+	PutObject(ctx context.Context, params *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error)
+	HeadBucket(ctx context.Context, params *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error)
+	CreateMultipartUpload(ctx context.Context, params *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error)
+	UploadPart(ctx context.Context, params *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error)
+	CompleteMultipartUpload(ctx context.Context, params *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error)
+	ListParts(ctx context.Context, params *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error)
+	AbortMultipartUpload(ctx context.Context, params *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error)
+}
+
+// object describes an object to upload from a cache file
+type object struct {
+	Path        string
+	Bucket      string
+	Key         string
+	ContentType string
+	Metadata    map[string]string
+}
+
+// multipartState is stored next to an uploading file so that a multipart
+// upload continues after a restart instead of starting over
+type multipartState struct {
+	Bucket   string `json:"bucket"`
+	Key      string `json:"key"`
+	UploadID string `json:"upload_id"`
+	Size     int64  `json:"size"`
+	PartSize int64  `json:"part_size"`
+}
+
+// uploadFile streams a cache file to S3, using a multipart upload at or
+// above the configured threshold. It returns the key the object was stored
+// under, which for a resumed multipart upload is the key it was started with.
+func uploadFile(ctx context.Context, client s3API, cacheManager *cache.Manager, cfg config.UploadConfig, obj object) (string, int64, error) {
+	file, err := os.Open(obj.Path)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to stat file: %w", err)
+	}
+	size := info.Size()
+
+	if cfg.MultipartThreshold <= 0 || size < cfg.MultipartThreshold {
+		_, err := client.PutObject(ctx, &s3.PutObjectInput{
+			Bucket:        aws.String(obj.Bucket),
+			Key:           aws.String(obj.Key),
+			Body:          file,
+			ContentLength: aws.Int64(size),
+			ContentType:   aws.String(obj.ContentType),
+			Metadata:      obj.Metadata,
+		})
+		return obj.Key, size, err
+	}
+
+	key, err := uploadMultipart(ctx, client, cacheManager, cfg, obj, file, size)
+	return key, size, err
+}
+
+// uploadMultipart uploads a file in parts, skipping parts already uploaded
+// by an interrupted attempt. The state of the upload is saved next to the
+// file through the cache manager.
+func uploadMultipart(ctx context.Context, client s3API, cacheManager *cache.Manager, cfg config.UploadConfig, obj object, file *os.File, size int64) (string, error) {
+	statePath := cache.MultipartStatePath(obj.Path)
+
+	state := readMultipartState(statePath, obj.Bucket, size)
+	done := map[int32]types.CompletedPart{}
+	if state != nil {
+		parts, err := listParts(ctx, client, state)
+		if err != nil {
+			var noSuchUpload *types.NoSuchUpload
+			if !errors.As(err, &noSuchUpload) {
+				return "", fmt.Errorf("failed to list uploaded parts: %w", err)
+			}
+			log.Warn().Str("file", obj.Path).Msg("Multipart upload no longer exists, starting over")
+			state = nil
+		} else {
+			for _, part := range parts {
+				if aws.ToInt64(part.Size) == partLength(state, aws.ToInt32(part.PartNumber)) {
+					done[aws.ToInt32(part.PartNumber)] = types.CompletedPart{ETag: part.ETag, PartNumber: part.PartNumber}
+				}
+			}
+			log.Info().Str("file", obj.Path).Str("key", state.Key).Int("parts", len(done)).Msg("Resuming multipart upload")
+		}
+	}
+
+	if state == nil {
+		partSize := max(cfg.PartSize, (size+maxParts-1)/maxParts)
+		out, err := client.CreateMultipartUpload(ctx, &s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(obj.Bucket),
+			Key:         aws.String(obj.Key),
+			ContentType: aws.String(obj.ContentType),
+			Metadata:    obj.Metadata,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create multipart upload: %w", err)
+		}
+		state = &multipartState{
+			Bucket:   obj.Bucket,
+			Key:      obj.Key,
+			UploadID: aws.ToString(out.UploadId),
+			Size:     size,
+			PartSize: partSize,
+		}
+		if err := writeMultipartState(cacheManager, obj.Path, state); err != nil {
+			return "", err
+		}
+	}
+
+	parts, err := uploadParts(ctx, client, cfg.Concurrency, state, file, done)
+	if err == nil {
+		_, err = client.CompleteMultipartUpload(ctx, &s3.CompleteMultipartUploadInput{
+			Bucket:          aws.String(state.Bucket),
+			Key:             aws.String(state.Key),
+			UploadId:        aws.String(state.UploadID),
+			MultipartUpload: &types.CompletedMultipartUpload{Parts: parts},
+		})
+		if err != nil {
+			err = fmt.Errorf("failed to complete multipart upload: %w", err)
+		}
+	}
+	if err != nil {
+		// Parts of an upload that cannot succeed are not kept for a retry
+		if isPermanent(err) {
+			if abortErr := abortUpload(ctx, client, cacheManager, obj.Path); abortErr != nil {
+				log.Warn().Err(abortErr).Str("file", obj.Path).Msg("Failed to abort multipart upload")
+			}
+		}
+		return "", err
+	}
+
+	if err := cacheManager.RemoveMultipartState(obj.Path); err != nil {
+		log.Warn().Err(err).Str("file", statePath).Msg("Failed to remove multipart upload state")
+	}
+	return state.Key, nil
+}
+
+// uploadParts uploads the missing parts of a file with bounded concurrency
+// and returns all parts in order
+func uploadParts(ctx context.Context, client s3API, concurrency int, state *multipartState, file *os.File, done map[int32]types.CompletedPart) ([]types.CompletedPart, error) {
+	count := int32((state.Size + state.PartSize - 1) / state.PartSize)
+
+	var mu sync.Mutex
+	var firstErr error
+	var wg sync.WaitGroup
+	numbers := make(chan int32)
+
+	for i := 0; i < max(concurrency, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for number := range numbers {
+				offset := int64(number-1) * state.PartSize
+				length := partLength(state, number)
+				out, err := client.UploadPart(ctx, &s3.UploadPartInput{
+					Bucket:        aws.String(state.Bucket),
+					Key:           aws.String(state.Key),
+					UploadId:      aws.String(state.UploadID),
+					PartNumber:    aws.Int32(number),
+					Body:          io.NewSectionReader(file, offset, length),
+					ContentLength: aws.Int64(length),
+				})
+
+				mu.Lock()
+				if err != nil {
+					if firstErr == nil {
+						firstErr = fmt.Errorf("failed to upload part %d: %w", number, err)
+					}
+				} else {
+					done[number] = types.CompletedPart{ETag: out.ETag, PartNumber: aws.Int32(number)}
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for number := int32(1); number <= count; number++ {
+		mu.Lock()
+		_, uploaded := done[number]
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			break
+		}
+		if !uploaded {
+			numbers <- number
+		}
+	}
+	close(numbers)
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	parts := make([]types.CompletedPart, 0, len(done))
+	for _, part := range done {
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.ToInt32(parts[i].PartNumber) < aws.ToInt32(parts[j].PartNumber)
+	})
+	return parts, nil
+}
+
+// abortUpload aborts the multipart upload recorded for an uploading file,
+// if any, and removes its state
+func abortUpload(ctx context.Context, client s3API, cacheManager *cache.Manager, path string) error {
+	state := decodeMultipartState(cache.MultipartStatePath(path))
+	if state == nil {
+		return nil
+	}
+
+	_, err := client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	})
+	var noSuchUpload *types.NoSuchUpload
+	if err != nil && !errors.As(err, &noSuchUpload) {
+		return fmt.Errorf("failed to abort multipart upload: %w", err)
+	}
+	log.Info().Str("file", path).Str("key", state.Key).Msg("Aborted multipart upload")
+
+	return cacheManager.RemoveMultipartState(path)
+}
+
+// isPermanent reports whether an upload failed with an error that retries
+// will not fix, such as a rejected request. Throttling, timeouts, denied
+// access, which may be granted again, and server errors are retried.
+func isPermanent(err error) bool {
+	var responseErr *awshttp.ResponseError
+	if !errors.As(err, &responseErr) {
+		return false
+	}
+	switch status := responseErr.HTTPStatusCode(); status {
+	case http.StatusForbidden, http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return false
+	default:
+		return status >= 400 && status < 500
+	}
+}
+
+// listParts returns the parts already uploaded for a multipart upload
+func listParts(ctx context.Context, client s3API, state *multipartState) ([]types.Part, error) {
+	var parts []types.Part
+	var marker *string
+	for {
+		out, err := client.ListParts(ctx, &s3.ListPartsInput{
+			Bucket:           aws.String(state.Bucket),
+			Key:              aws.String(state.Key),
+			UploadId:         aws.String(state.UploadID),
+			PartNumberMarker: marker,
+		})
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, out.Parts...)
+		if !aws.ToBool(out.IsTruncated) {
+			return parts, nil
+		}
+		marker = out.NextPartNumberMarker
+	}
+}
+
+// partLength returns the size of a part; the last part may be shorter
+func partLength(state *multipartState, number int32) int64 {
+	offset := int64(number-1) * state.PartSize
+	return min(state.PartSize, state.Size-offset)
+}
+
+// readMultipartState returns the state of an interrupted multipart upload of
+// the same file to the same bucket, or nil
+func readMultipartState(path string, bucket string, size int64) *multipartState {
+	state := decodeMultipartState(path)
+	if state == nil || state.Bucket != bucket || state.Size != size || state.PartSize <= 0 {
+		return nil
+	}
+	return state
+}
+
+// decodeMultipartState returns the multipart upload state stored at path, or
+// nil if there is none
+func decodeMultipartState(path string) *multipartState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var state multipartState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Ignoring invalid multipart upload state")
+		return nil
+	}
+	if state.UploadID == "" {
+		return nil
+	}
+	return &state
+}
+
+// writeMultipartState durably saves the state of the multipart upload of
+// an uploading file, so that it is never read back partially written
+func writeMultipartState(cacheManager *cache.Manager, path string, state *multipartState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode multipart upload state: %w", err)
+	}
+	if err := cacheManager.SaveMultipartState(path, data); err != nil {
+		return fmt.Errorf("failed to save multipart upload state: %w", err)
+	}
+	return nil
+}
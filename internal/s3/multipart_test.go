@@ -0,0 +1,270 @@
+package s3
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	smithyhttp "github.com/aws/smithy-go/transport/http"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeS3 stores objects and multipart uploads in memory
+type fakeS3 struct {
+	mu          sync.Mutex
+	objects     map[string][]byte
+	uploads     map[string]map[int32][]byte
+	keys        map[string]string
+	contentType map[string]string
+	nextID      int
+	failPart    int32
+	failErr     error
+	puts        int
+	created     int
+	aborted     int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects:     make(map[string][]byte),
+		uploads:     make(map[string]map[int32][]byte),
+		keys:        make(map[string]string),
+		contentType: make(map[string]string),
+	}
+}
+
+func (f *fakeS3) PutObject(ctx context.Context, in *s3.PutObjectInput, optFns ...func(*s3.Options)) (*s3.PutObjectOutput, error) {
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.puts++
+	f.objects[aws.ToString(in.Key)] = data
+	f.contentType[aws.ToString(in.Key)] = aws.ToString(in.ContentType)
+	return &s3.PutObjectOutput{}, nil
+}
+
+func (f *fakeS3) HeadBucket(ctx context.Context, in *s3.HeadBucketInput, optFns ...func(*s3.Options)) (*s3.HeadBucketOutput, error) {
+	return &s3.HeadBucketOutput{}, nil
+}
+
+func (f *fakeS3) CreateMultipartUpload(ctx context.Context, in *s3.CreateMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CreateMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nextID++
+	f.created++
+	id := fmt.Sprintf("upload-%d", f.nextID)
+	f.uploads[id] = make(map[int32][]byte)
+	f.keys[id] = aws.ToString(in.Key)
+	f.contentType[aws.ToString(in.Key)] = aws.ToString(in.ContentType)
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(id)}, nil
+}
+
+func (f *fakeS3) UploadPart(ctx context.Context, in *s3.UploadPartInput, optFns ...func(*s3.Options)) (*s3.UploadPartOutput, error) {
+	number := aws.ToInt32(in.PartNumber)
+	data, err := io.ReadAll(in.Body)
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if number == f.failPart {
+		if f.failErr != nil {
+			return nil, f.failErr
+		}
+		return nil, errors.New("connection reset")
+	}
+	f.uploads[aws.ToString(in.UploadId)][number] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("etag-%d", number))}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUpload(ctx context.Context, in *s3.CompleteMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.CompleteMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := aws.ToString(in.UploadId)
+	var data []byte
+	for _, part := range in.MultipartUpload.Parts {
+		data = append(data, f.uploads[id][aws.ToInt32(part.PartNumber)]...)
+	}
+	f.objects[aws.ToString(in.Key)] = data
+	delete(f.uploads, id)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) ListParts(ctx context.Context, in *s3.ListPartsInput, optFns ...func(*s3.Options)) (*s3.ListPartsOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	upload, ok := f.uploads[aws.ToString(in.UploadId)]
+	if !ok {
+		return nil, &types.NoSuchUpload{}
+	}
+	var parts []types.Part
+	for number, data := range upload {
+		parts = append(parts, types.Part{
+			PartNumber: aws.Int32(number),
+			ETag:       aws.String(fmt.Sprintf("etag-%d", number)),
+			Size:       aws.Int64(int64(len(data))),
+		})
+	}
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	return &s3.ListPartsOutput{Parts: parts, IsTruncated: aws.Bool(false)}, nil
+}
+
+func (f *fakeS3) AbortMultipartUpload(ctx context.Context, in *s3.AbortMultipartUploadInput, optFns ...func(*s3.Options)) (*s3.AbortMultipartUploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := aws.ToString(in.UploadId)
+	if _, ok := f.uploads[id]; !ok {
+		return nil, &types.NoSuchUpload{}
+	}
+	delete(f.uploads, id)
+	f.aborted++
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+// responseError returns an S3 error response with the given status
+func responseError(status int) error {
+	return &awshttp.ResponseError{
+		ResponseError: &smithyhttp.ResponseError{
+			Response: &smithyhttp.Response{Response: &http.Response{StatusCode: status}},
+			Err:      errors.New("request rejected"),
+		},
+	}
+}
+
+func writeTestFile(t *testing.T, size int) (string, []byte) {
+	data := bytes.Repeat([]byte("0123456789"), size/10)
+	path := filepath.Join(t.TempDir(), "aggregate_1_2.gz")
+	require.NoError(t, os.WriteFile(path, data, 0644))
+	return path, data
+}
+
+func newTestCacheManager(t *testing.T) *cache.Manager {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+	return cacheManager
+}
+
+func TestUploadFile_SinglePut(t *testing.T) {
+	client := newFakeS3()
+	cacheManager := newTestCacheManager(t)
+	path, data := writeTestFile(t, 100)
+
+	key, size, err := uploadFile(context.Background(), client, cacheManager, config.UploadConfig{MultipartThreshold: 1000, PartSize: 30, Concurrency: 2}, object{
+		Path:        path,
+		Bucket:      "bucket",
+		Key:         "key",
+		ContentType: "application/zstd",
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "key", key)
+	assert.Equal(t, int64(100), size)
+	assert.Equal(t, data, client.objects["key"])
+	assert.Equal(t, "application/zstd", client.contentType["key"])
+	assert.Equal(t, 1, client.puts)
+	assert.Zero(t, client.created)
+}
+
+func TestUploadFile_Multipart(t *testing.T) {
+	client := newFakeS3()
+	cacheManager := newTestCacheManager(t)
+	path, data := writeTestFile(t, 100)
+	cfg := config.UploadConfig{MultipartThreshold: 50, PartSize: 30, Concurrency: 2}
+
+	// The upload is interrupted after some parts were uploaded
+	client.failPart = 3
+	_, _, err := uploadFile(context.Background(), client, cacheManager, cfg, object{Path: path, Bucket: "bucket", Key: "key-1"})
+	require.Error(t, err)
+	assert.FileExists(t, cache.MultipartStatePath(path))
+
+	// The retry continues the same upload under its original key
+	client.failPart = 0
+	key, _, err := uploadFile(context.Background(), client, cacheManager, cfg, object{Path: path, Bucket: "bucket", Key: "key-2"})
+	require.NoError(t, err)
+	assert.Equal(t, "key-1", key)
+	assert.Equal(t, data, client.objects["key-1"])
+	assert.Equal(t, 1, client.created)
+	assert.NoFileExists(t, cache.MultipartStatePath(path))
+}
+
+func TestUploadFile_MultipartExpired(t *testing.T) {
+	client := newFakeS3()
+	cacheManager := newTestCacheManager(t)
+	path, data := writeTestFile(t, 100)
+	cfg := config.UploadConfig{MultipartThreshold: 50, PartSize: 30, Concurrency: 1}
+
+	// State of an upload that was aborted on the S3 side
+	require.NoError(t, writeMultipartState(cacheManager, path, &multipartState{
+		Bucket:   "bucket",
+		Key:      "old-key",
+		UploadID: "aborted",
+		Size:     100,
+		PartSize: 30,
+	}))
+
+	key, _, err := uploadFile(context.Background(), client, cacheManager, cfg, object{Path: path, Bucket: "bucket", Key: "key"})
+	require.NoError(t, err)
+	assert.Equal(t, "key", key)
+	assert.Equal(t, data, client.objects["key"])
+}
+
+func TestUploadFile_MultipartPermanentError(t *testing.T) {
+	client := newFakeS3()
+	cacheManager := newTestCacheManager(t)
+	path, _ := writeTestFile(t, 100)
+	cfg := config.UploadConfig{MultipartThreshold: 50, PartSize: 30, Concurrency: 1}
+
+	// A transient error keeps the upload for a retry
+	client.failPart = 2
+	client.failErr = responseError(http.StatusServiceUnavailable)
+	_, _, err := uploadFile(context.Background(), client, cacheManager, cfg, object{Path: path, Bucket: "bucket", Key: "key"})
+	require.Error(t, err)
+	assert.Zero(t, client.aborted)
+	assert.FileExists(t, cache.MultipartStatePath(path))
+
+	// A rejected request aborts it
+	client.failErr = responseError(http.StatusBadRequest)
+	_, _, err = uploadFile(context.Background(), client, cacheManager, cfg, object{Path: path, Bucket: "bucket", Key: "key"})
+	require.Error(t, err)
+	assert.Equal(t, 1, client.aborted)
+	assert.Empty(t, client.uploads)
+	assert.NoFileExists(t, cache.MultipartStatePath(path))
+}
+
+func TestAbortUpload(t *testing.T) {
+	client := newFakeS3()
+	cacheManager := newTestCacheManager(t)
+	path, _ := writeTestFile(t, 100)
+	cfg := config.UploadConfig{MultipartThreshold: 50, PartSize: 30, Concurrency: 1}
+
+	// Nothing to abort without an interrupted upload
+	require.NoError(t, abortUpload(context.Background(), client, cacheManager, path))
+	assert.Zero(t, client.aborted)
+
+	client.failPart = 3
+	_, _, err := uploadFile(context.Background(), client, cacheManager, cfg, object{Path: path, Bucket: "bucket", Key: "key"})
+	require.Error(t, err)
+	require.Len(t, client.uploads, 1)
+
+	require.NoError(t, abortUpload(context.Background(), client, cacheManager, path))
+	assert.Equal(t, 1, client.aborted)
+	assert.Empty(t, client.uploads)
+	assert.NoFileExists(t, cache.MultipartStatePath(path))
+}
@@ -0,0 +1,408 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/parquet"
+)
+
+// gatewayField is the record field holding the enrichment fields
+const gatewayField = "_gateway"
+
+// recordColumn is the column holding whole records when no schema can be
+// inferred, such as for records that are not JSON objects
+const recordColumn = "record"
+
+// extraColumn is the JSON column holding, with an inferred schema, the
+// fields that have no column of their own: fields first seen after the
+// schema was inferred, fields whose names clash with another column and
+// values that do not convert to their column type
+const extraColumn = "_extra"
+
+// parquetColumn maps a record field to a Parquet column
+type parquetColumn struct {
+	name string
+	path []string
+	typ  parquet.Type
+}
+
+// parquetColumns returns the declared columns followed by a column per
+// enrichment field that is not declared. Enrichment fields are stored as
+// gateway_<field> columns.
+func parquetColumns(declared []config.ParquetColumn, enrichment config.EnrichmentConfig) ([]parquetColumn, error) {
+	var columns []parquetColumn
+	fields := make(map[string]bool)
+	for _, column := range declared {
+		typ, err := parquet.ParseType(column.Type)
+		if err != nil {
+			return nil, err
+		}
+		field := column.Field
+		if field == "" {
+			field = column.Name
+		}
+		columns = append(columns, parquetColumn{name: column.Name, path: strings.Split(field, "."), typ: typ})
+		fields[field] = true
+	}
+
+	if !enrichment.Enabled {
+		return columns, nil
+	}
+	for _, name := range enrichment.Fields {
+		if fields[gatewayField+"."+name] {
+			continue
+		}
+		typ := parquet.String
+		if name == config.EnrichReceivedAt {
+			typ = parquet.Timestamp
+		}
+		columns = append(columns, parquetColumn{name: "gateway_" + name, path: []string{gatewayField, name}, typ: typ})
+	}
+	return columns, nil
+}
+
+// parquetRecordWriter writes records as a Parquet file. Without declared
+// columns, the schema is inferred from the first records, which are held
+// until then.
+type parquetRecordWriter struct {
+	w       io.Writer
+	config  config.ParquetConfig
+	codec   parquet.Codec
+	columns []parquetColumn
+	writer  *parquet.Writer
+	row     []any
+
+	// pending holds the records the schema is inferred from, and
+	// pendingBytes their size
+	infer        bool
+	pending      []json.RawMessage
+	pendingBytes int64
+
+	// fields maps the top-level fields of an inferred schema to their
+	// columns, and extra is the index of the extra column or -1
+	fields map[string]int
+	extra  int
+}
+
+// newParquetRecordWriter creates a Parquet writer with the given columns
+func newParquetRecordWriter(w io.Writer, columns []parquetColumn, cfg config.ParquetConfig) (*parquetRecordWriter, error) {
+	codec, err := parquet.ParseCodec(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &parquetRecordWriter{
+		w:       w,
+		config:  cfg,
+		codec:   codec,
+		columns: columns,
+		infer:   len(cfg.Columns) == 0,
+		extra:   -1,
+	}
+	if !p.infer {
+		if err := p.start(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *parquetRecordWriter) write(record json.RawMessage) error {
+	if p.writer != nil {
+		return p.writeRow(record)
+	}
+
+	p.pending = append(p.pending, record)
+	p.pendingBytes += int64(len(record))
+	if len(p.pending) < p.config.InferRecords {
+		return nil
+	}
+	return p.start()
+}
+
+func (p *parquetRecordWriter) buffered() int64 {
+	if p.writer == nil {
+		return p.pendingBytes
+	}
+	return p.writer.Buffered()
+}
+
+// flush writes the buffered rows as a row group. Records held for schema
+// inference are written first, with the schema inferred from them.
+func (p *parquetRecordWriter) flush() error {
+	if p.writer == nil {
+		if err := p.start(); err != nil {
+			return err
+		}
+	}
+	return p.writer.Flush()
+}
+
+func (p *parquetRecordWriter) close() error {
+	if p.writer == nil {
+		if err := p.start(); err != nil {
+			return err
+		}
+	}
+	return p.writer.Close()
+}
+
+// start infers the schema if needed, creates the Parquet writer and writes
+// the pending records
+func (p *parquetRecordWriter) start() error {
+	if p.infer {
+		reserved := map[string]bool{extraColumn: true}
+		for _, column := range p.columns {
+			reserved[column.name] = true
+		}
+		inferred := inferColumns(p.pending, reserved)
+		if len(inferred) == 0 {
+			inferred = []parquetColumn{{name: recordColumn, typ: parquet.JSON}}
+		} else {
+			p.fields = make(map[string]int, len(inferred))
+			for i, column := range inferred {
+				p.fields[column.name] = i
+			}
+			p.extra = len(inferred)
+			inferred = append(inferred, parquetColumn{name: extraColumn, typ: parquet.JSON})
+		}
+		p.columns = append(inferred, p.columns...)
+	}
+
+	columns := make([]parquet.Column, len(p.columns))
+	for i, column := range p.columns {
+		columns[i] = parquet.Column{Name: column.name, Type: column.typ}
+	}
+	writer, err := parquet.NewWriter(p.w, columns, p.codec)
+	if err != nil {
+		return err
+	}
+	p.writer = writer
+	p.row = make([]any, len(p.columns))
+
+	for _, record := range p.pending {
+		if err := p.writeRow(record); err != nil {
+			return err
+		}
+	}
+	p.pending = nil
+	p.pendingBytes = 0
+	return nil
+}
+
+// writeRow converts a record to a row. Fields that are missing or do not
+// convert to their column type are null.
+func (p *parquetRecordWriter) writeRow(record json.RawMessage) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(record, &fields); err != nil {
+		fields = nil
+	}
+
+	for i, column := range p.columns {
+		p.row[i] = nil
+		if i == p.extra {
+			continue
+		}
+		if len(column.path) == 0 {
+			p.row[i] = columnValue(column.typ, record)
+			continue
+		}
+		value, ok := fields[column.path[0]]
+		if !ok {
+			continue
+		}
+		if value, ok = lookupField(value, column.path[1:]); ok {
+			p.row[i] = columnValue(column.typ, value)
+		}
+	}
+	if p.extra >= 0 {
+		p.row[p.extra] = p.extraValue(fields)
+	}
+	return p.writer.Write(p.row)
+}
+
+// extraValue returns the fields of a record that are not stored in an
+// inferred column as a JSON object, or nil if there are none
+func (p *parquetRecordWriter) extraValue(fields map[string]json.RawMessage) any {
+	extra := make(map[string]json.RawMessage)
+	for name, value := range fields {
+		if name == gatewayField {
+			continue
+		}
+		if i, ok := p.fields[name]; ok && (p.row[i] != nil || kindOf(value) == kindNull) {
+			continue
+		}
+		extra[name] = value
+	}
+	if len(extra) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(extra)
+	if err != nil {
+		return nil
+	}
+	return string(data)
+}
+
+// columnValue converts a JSON value to a Parquet value, or nil
+func columnValue(typ parquet.Type, value json.RawMessage) any {
+	kind := kindOf(value)
+	if kind == kindNull {
+		return nil
+	}
+
+	switch typ {
+	case parquet.JSON:
+		return compactJSON(value)
+	case parquet.String:
+		switch kind {
+		case kindString:
+			var str string
+			if err := json.Unmarshal(value, &str); err != nil {
+				return nil
+			}
+			return str
+		case kindJSON:
+			return compactJSON(value)
+		default:
+			return string(bytes.TrimSpace(value))
+		}
+	}
+
+	text, ok := scalarValue(value)
+	if !ok {
+		return nil
+	}
+	switch typ {
+	case parquet.Int64:
+		if n, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return n
+		}
+		f, err := strconv.ParseFloat(text, 64)
+		if err != nil || f != math.Trunc(f) || math.Abs(f) > math.MaxInt64 {
+			return nil
+		}
+		return int64(f)
+	case parquet.Double:
+		if f, err := strconv.ParseFloat(text, 64); err == nil {
+			return f
+		}
+	case parquet.Boolean:
+		if b, err := strconv.ParseBool(text); err == nil && (kind == kindBoolean || kind == kindString) {
+			return b
+		}
+	case parquet.Timestamp:
+		if t, ok := parseEventTime(text); ok {
+			return t.UTC()
+		}
+	}
+	return nil
+}
+
+// compactJSON returns a JSON value as compact text
+func compactJSON(value json.RawMessage) string {
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, value); err != nil {
+		return string(value)
+	}
+	return buf.String()
+}
+
+// jsonKind is the kind of a JSON value used for schema inference
+type jsonKind int
+
+const (
+	kindNull jsonKind = iota
+	kindString
+	kindInteger
+	kindNumber
+	kindBoolean
+	kindJSON
+)
+
+// kindOf returns the kind of a JSON value
+func kindOf(value json.RawMessage) jsonKind {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 {
+		return kindNull
+	}
+	switch value[0] {
+	case 'n':
+		return kindNull
+	case '"':
+		return kindString
+	case 't', 'f':
+		return kindBoolean
+	case '{', '[':
+		return kindJSON
+	}
+	if bytes.ContainsAny(value, ".eE") {
+		return kindNumber
+	}
+	return kindInteger
+}
+
+// mergeKinds returns the kind holding values of both kinds
+func mergeKinds(a, b jsonKind) jsonKind {
+	switch {
+	case a == kindNull:
+		return b
+	case b == kindNull, a == b:
+		return a
+	case (a == kindInteger || a == kindNumber) && (b == kindInteger || b == kindNumber):
+		return kindNumber
+	default:
+		return kindJSON
+	}
+}
+
+// inferColumns infers a column for each top-level field of the records,
+// in name order. The enrichment object is left to the enrichment columns,
+// and fields that are always null or named after a reserved column are
+// skipped.
+func inferColumns(records []json.RawMessage, reserved map[string]bool) []parquetColumn {
+	kinds := make(map[string]jsonKind)
+	for _, record := range records {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(record, &fields); err != nil {
+			continue
+		}
+		for name, value := range fields {
+			if name == gatewayField || reserved[name] {
+				continue
+			}
+			kinds[name] = mergeKinds(kinds[name], kindOf(value))
+		}
+	}
+
+	var columns []parquetColumn
+	for name, kind := range kinds {
+		var typ parquet.Type
+		switch kind {
+		case kindNull:
+			continue
+		case kindString:
+			typ = parquet.String
+		case kindInteger:
+			typ = parquet.Int64
+		case kindNumber:
+			typ = parquet.Double
+		case kindBoolean:
+			typ = parquet.Boolean
+		default:
+			typ = parquet.JSON
+		}
+		columns = append(columns, parquetColumn{name: name, path: []string{name}, typ: typ})
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		return columns[i].name < columns[j].name
+	})
+	return columns
+}
@@ -0,0 +1,105 @@
+package s3
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/parquet"
+	parquetgo "github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParquetRecordWriter_InferColumns(t *testing.T) {
+	columns, err := parquetColumns(nil, config.EnrichmentConfig{Enabled: true, Fields: []string{config.EnrichReceivedAt}})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	writer, err := newParquetRecordWriter(&buf, columns, config.ParquetConfig{Compression: "none", InferRecords: 2})
+	require.NoError(t, err)
+	require.NoError(t, writer.write([]byte(`{"event":"a","count":1,"_gateway":{"received_at":"2024-01-02T03:04:05Z"}}`)))
+	require.NoError(t, writer.write([]byte(`{"event":"b","count":1.5,"tags":["x"],"none":null}`)))
+	require.NoError(t, writer.write([]byte(`{"event":"c"}`)))
+	require.NoError(t, writer.close())
+
+	names := make([]string, len(writer.columns))
+	for i, column := range writer.columns {
+		names[i] = column.name
+	}
+	assert.Equal(t, []string{"count", "event", "tags", extraColumn, "gateway_received_at"}, names)
+	assert.Equal(t, parquet.Double, writer.columns[0].typ)
+	assert.Equal(t, parquet.String, writer.columns[1].typ)
+	assert.Equal(t, parquet.JSON, writer.columns[2].typ)
+	assert.Equal(t, parquet.JSON, writer.columns[3].typ)
+	assert.Equal(t, parquet.Timestamp, writer.columns[4].typ)
+}
+
+func TestParquetRecordWriter_ExtraColumn(t *testing.T) {
+	columns, err := parquetColumns(nil, config.EnrichmentConfig{Enabled: true, Fields: []string{config.EnrichUser}})
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	writer, err := newParquetRecordWriter(&buf, columns, config.ParquetConfig{Compression: "none", InferRecords: 1})
+	require.NoError(t, err)
+	// The clashing field is not inferred as a column
+	require.NoError(t, writer.write([]byte(`{"count":1,"gateway_user":"spoofed","_gateway":{"user":"alice"}}`)))
+	// Later fields and values that do not convert are kept in the extra column
+	require.NoError(t, writer.write([]byte(`{"count":"many","late":{"a":1},"_gateway":{"user":"bob"}}`)))
+	require.NoError(t, writer.write([]byte(`{"count":2,"_gateway":{"user":"carol"}}`)))
+	require.NoError(t, writer.close())
+
+	values := readParquet(t, buf.Bytes())
+	assert.Equal(t, []any{int64(1), nil, int64(2)}, values["count"])
+	assert.Equal(t, []any{`{"gateway_user":"spoofed"}`, `{"count":"many","late":{"a":1}}`, nil}, values[extraColumn])
+	assert.Equal(t, []any{"alice", "bob", "carol"}, values["gateway_user"])
+}
+
+// readParquet reads the values of each column of a Parquet file, nil for
+// nulls
+func readParquet(t *testing.T, data []byte) map[string][]any {
+	file, err := parquetgo.OpenFile(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+
+	leaves := file.Schema().Columns()
+	values := make(map[string][]any)
+	for _, rowGroup := range file.RowGroups() {
+		rows := rowGroup.Rows()
+		buf := make([]parquetgo.Row, 10)
+		for {
+			n, err := rows.ReadRows(buf)
+			for _, row := range buf[:n] {
+				for _, value := range row {
+					name := leaves[value.Column()][0]
+					switch {
+					case value.IsNull():
+						values[name] = append(values[name], nil)
+					case value.Kind() == parquetgo.ByteArray:
+						values[name] = append(values[name], string(value.ByteArray()))
+					default:
+						values[name] = append(values[name], value.Int64())
+					}
+				}
+			}
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			require.NoError(t, err)
+		}
+		require.NoError(t, rows.Close())
+	}
+	return values
+}
+
+func TestColumnValue(t *testing.T) {
+	assert.Equal(t, int64(3), columnValue(parquet.Int64, []byte(`"3"`)))
+	assert.Equal(t, int64(3), columnValue(parquet.Int64, []byte(`3.0`)))
+	assert.Nil(t, columnValue(parquet.Int64, []byte(`3.5`)))
+	assert.Equal(t, "1.5", columnValue(parquet.String, []byte(`1.5`)))
+	assert.Equal(t, `{"a":1}`, columnValue(parquet.String, []byte(`{ "a": 1 }`)))
+	assert.Equal(t, true, columnValue(parquet.Boolean, []byte(`"true"`)))
+	assert.Nil(t, columnValue(parquet.Boolean, []byte(`1`)))
+	assert.Nil(t, columnValue(parquet.Double, []byte(`null`)))
+}
@@ -0,0 +1,409 @@
+package s3
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+)
+
+// hiveDefaultPartition is the partition value of records without the
+// partition field, as used by Hive
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// aggregateFilePrefix prefixes the aggregated files written by the aggregator
+const aggregateFilePrefix = "aggregate_"
+
+// partitionWriter splits aggregated records into files, one per event hour,
+// partition and, for per-user aggregates, user. The event time of a record
+// is read from the timestamp field, falling back to the time the record was
+// received.
+//
+// At most maxOpen files are open at once. Once the cap is reached, the least
+// recently written file is finished and later records of its hour,
+// partition and user go to a new part file. Likewise, once the open files
+// buffer more than maxBuffer bytes in memory, the file buffering the most
+// is flushed.
+type partitionWriter struct {
+	dir    string
+	end    time.Time
+	format outputFormat
+
+	// field is the path of the partition field and name the partition column
+	field []string
+	name  string
+
+	// timestampField is the path of the event time field, and maxAge how
+	// long before their receive time events may have happened; 0 disables
+	// the horizon
+	timestampField []string
+	maxAge         time.Duration
+
+	// maxOpen caps the open files and maxBuffer the bytes they buffer; 0
+	// disables a cap
+	maxOpen   int
+	maxBuffer int64
+
+	// outputs holds the open file of each key, parts counts the files of
+	// each key and files holds all files in creation order
+	outputs map[outputKey]*partitionOutput
+	parts   map[outputKey]int
+	files   []*partitionOutput
+
+	// writes counts the records written, to find the least recently
+	// written file
+	writes uint64
+}
+
+// partitionOptions configures how a partitionWriter splits records
+type partitionOptions struct {
+	// partitionField and timestampField are dotted record paths such as
+	// app_version or _gateway.user; the last element of the partition
+	// field names the partition
+	partitionField string
+	timestampField string
+
+	maxOpenFiles   int
+	maxEventAge    time.Duration
+	maxBufferBytes int64
+}
+
+// outputKey identifies the aggregated file of a record
+type outputKey struct {
+	hour      int64
+	partition string
+	user      string
+}
+
+// partitionOutput is an aggregated file being written
+type partitionOutput struct {
+	key    outputKey
+	part   int
+	path   string
+	file   *os.File
+	writer recordWriter
+
+	// start is the event time of the oldest record in the file
+	start time.Time
+
+	// lastWrite is the write count of the last record, and finished is
+	// set once the file is closed
+	lastWrite uint64
+	finished  bool
+}
+
+// newPartitionWriter creates a writer of aggregated files of the given format
+// in dir for an aggregation running at end
+func newPartitionWriter(dir string, end time.Time, format outputFormat, options partitionOptions) *partitionWriter {
+	w := &partitionWriter{
+		dir:       dir,
+		end:       end,
+		format:    format,
+		maxAge:    options.maxEventAge,
+		maxOpen:   options.maxOpenFiles,
+		maxBuffer: options.maxBufferBytes,
+		outputs:   make(map[outputKey]*partitionOutput),
+		parts:     make(map[outputKey]int),
+	}
+	if options.partitionField != "" {
+		w.field = strings.Split(options.partitionField, ".")
+		w.name = w.field[len(w.field)-1]
+	}
+	if options.timestampField != "" {
+		w.timestampField = strings.Split(options.timestampField, ".")
+	}
+	return w
+}
+
+// write appends a record received at the given time to the file of its
+// event hour, partition and user. The user is empty unless aggregating
+// per user.
+func (w *partitionWriter) write(record json.RawMessage, received time.Time, user string) error {
+	eventTime := w.eventTime(record, received)
+	key := outputKey{
+		hour:      eventTime.Truncate(time.Hour).Unix(),
+		partition: w.partition(record),
+		user:      user,
+	}
+
+	output, err := w.output(key)
+	if err != nil {
+		return err
+	}
+	if output.start.IsZero() || eventTime.Before(output.start) {
+		output.start = eventTime
+	}
+	w.writes++
+	output.lastWrite = w.writes
+	if err := output.writer.write(record); err != nil {
+		return err
+	}
+	return w.limitBuffered()
+}
+
+// limitBuffered flushes the files buffering the most until the open files
+// buffer at most maxBuffer bytes
+func (w *partitionWriter) limitBuffered() error {
+	if w.maxBuffer <= 0 {
+		return nil
+	}
+	for w.buffered() > w.maxBuffer {
+		var largest *partitionOutput
+		for _, output := range w.outputs {
+			if largest == nil || output.writer.buffered() > largest.writer.buffered() {
+				largest = output
+			}
+		}
+		if err := largest.writer.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// buffered returns the bytes buffered in memory by the open files
+func (w *partitionWriter) buffered() int64 {
+	var total int64
+	for _, output := range w.outputs {
+		total += output.writer.buffered()
+	}
+	return total
+}
+
+// eventTime returns the event time of a record. Records without a valid
+// timestamp, with one after the aggregation or with one further than the
+// horizon before their receive time, use their receive time.
+func (w *partitionWriter) eventTime(record json.RawMessage, received time.Time) time.Time {
+	if w.timestampField == nil {
+		return received
+	}
+
+	value, ok := recordField(record, w.timestampField)
+	if !ok {
+		return received
+	}
+	eventTime, ok := parseEventTime(value)
+	if !ok || eventTime.After(w.end) || (w.maxAge > 0 && eventTime.Before(received.Add(-w.maxAge))) {
+		return received
+	}
+	return eventTime
+}
+
+// partition returns the name=value partition of a record
+func (w *partitionWriter) partition(record json.RawMessage) string {
+	if w.field == nil {
+		return ""
+	}
+
+	value, ok := recordField(record, w.field)
+	if !ok {
+		value = hiveDefaultPartition
+	}
+	return w.name + "=" + url.PathEscape(value)
+}
+
+// output returns the open file of an event hour and partition, creating it
+// on first use. Files are written under a temporary name until closed, as
+// their window is not known before.
+func (w *partitionWriter) output(key outputKey) (*partitionOutput, error) {
+	if output, ok := w.outputs[key]; ok {
+		return output, nil
+	}
+	if w.maxOpen > 0 && len(w.outputs) >= w.maxOpen {
+		if err := w.finishLeastRecent(); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.CreateTemp(w.dir, aggregateFilePrefix+"*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create output file: %w", err)
+	}
+
+	writer, err := w.format.newWriter(file)
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+
+	output := &partitionOutput{
+		key:    key,
+		part:   w.parts[key],
+		path:   file.Name(),
+		file:   file,
+		writer: writer,
+	}
+	w.outputs[key] = output
+	w.parts[key]++
+	w.files = append(w.files, output)
+	return output, nil
+}
+
+// finishLeastRecent finishes the least recently written open file
+func (w *partitionWriter) finishLeastRecent() error {
+	var oldest *partitionOutput
+	for _, output := range w.outputs {
+		if oldest == nil || output.lastWrite < oldest.lastWrite {
+			oldest = output
+		}
+	}
+	delete(w.outputs, oldest.key)
+	return oldest.finish()
+}
+
+// finish flushes, syncs and closes the file
+func (o *partitionOutput) finish() error {
+	o.finished = true
+	err := o.writer.close()
+	if syncErr := o.file.Sync(); err == nil {
+		err = syncErr
+	}
+	if closeErr := o.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// close finishes and syncs all files, renames them after their window,
+// partition, user and part and returns their paths in creation order. The
+// files are durable once close returns, so their sources can be removed.
+func (w *partitionWriter) close() ([]string, error) {
+	var closeErr error
+	for _, output := range w.files {
+		if output.finished {
+			continue
+		}
+		if err := output.finish(); err != nil && closeErr == nil {
+			closeErr = err
+		}
+	}
+	if closeErr != nil {
+		w.remove()
+		return nil, closeErr
+	}
+
+	paths := make([]string, 0, len(w.files))
+	for _, output := range w.files {
+		key := output.key
+		path := filepath.Join(w.dir, aggregateFilename(output.start, w.end, key.partition, key.user, output.part, w.format.ext))
+		if err := os.Rename(output.path, path); err != nil {
+			w.remove()
+			return nil, fmt.Errorf("failed to rename output file: %w", err)
+		}
+		output.path = path
+		paths = append(paths, path)
+	}
+	if err := cache.SyncDir(w.dir); err != nil {
+		w.remove()
+		return nil, fmt.Errorf("failed to sync aggregation directory: %w", err)
+	}
+	return paths, nil
+}
+
+// abort closes and removes all files
+func (w *partitionWriter) abort() {
+	for _, output := range w.outputs {
+		output.file.Close()
+	}
+	w.remove()
+}
+
+// remove removes all files
+func (w *partitionWriter) remove() {
+	for _, output := range w.files {
+		os.Remove(output.path)
+	}
+}
+
+// parseEventTime parses an RFC 3339 timestamp or a Unix time in seconds or
+// milliseconds
+func parseEventTime(value string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t, true
+	}
+
+	unix, err := strconv.ParseFloat(value, 64)
+	if err != nil || unix <= 0 {
+		return time.Time{}, false
+	}
+	// Values this large are milliseconds; in seconds they would be
+	// tens of thousands of years away
+	if unix >= 1e12 {
+		return time.UnixMilli(int64(unix)), true
+	}
+	return time.Unix(0, int64(unix*1e9)), true
+}
+
+// recordField returns a scalar field of a JSON record as a string
+func recordField(record json.RawMessage, path []string) (string, bool) {
+	value, ok := lookupField(record, path)
+	if !ok {
+		return "", false
+	}
+	return scalarValue(value)
+}
+
+// lookupField returns the raw value at a path of a JSON record
+func lookupField(record json.RawMessage, path []string) (json.RawMessage, bool) {
+	value := record
+	for _, name := range path {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(value, &fields); err != nil {
+			return nil, false
+		}
+		var ok bool
+		if value, ok = fields[name]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// scalarValue returns a JSON string, number or boolean as a string
+func scalarValue(value json.RawMessage) (string, bool) {
+	var str string
+	if err := json.Unmarshal(value, &str); err == nil {
+		return str, str != ""
+	}
+
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || bytes.Equal(value, []byte("null")) || value[0] == '{' || value[0] == '[' {
+		return "", false
+	}
+	return string(value), true
+}
+
+// aggregateFilename returns the name of an aggregated file. The aggregation
+// window, partition and user are encoded in the name so that they survive
+// retries and restarts; part numbers the later files of the same hour,
+// partition and user.
+func aggregateFilename(start, end time.Time, partition, user string, part int, ext string) string {
+	name := fmt.Sprintf("%s%d_%d", aggregateFilePrefix, start.UnixNano(), end.UnixNano())
+	labels := url.Values{}
+	if partition != "" {
+		labels.Set("partition", partition)
+	}
+	if user != "" {
+		labels.Set("user", user)
+	}
+	if part > 0 {
+		labels.Set("part", strconv.Itoa(part))
+	}
+	if len(labels) > 0 {
+		name += "_" + labels.Encode()
+	}
+	return name + ext
+}
+
+// isAggregateFile reports whether a path is an aggregated file
+func isAggregateFile(path string) bool {
+	return strings.HasPrefix(filepath.Base(path), aggregateFilePrefix)
+}
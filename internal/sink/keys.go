@@ -0,0 +1,193 @@
+package sink
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// windowFormat is the timestamp format of the {start} and {end} placeholders
+const windowFormat = "20060102T150405Z"
+
+// sequence numbers aggregated keys rendered by this process. It starts at
+// the process start time in microseconds, so numbers do not repeat after a
+// restart; {host} keeps them apart across hosts.
+var sequence atomic.Uint64
+
+func init() {
+	sequence.Store(uint64(time.Now().UnixMicro()))
+}
+
+// AggregatedKey renders the object key for an aggregated file from a key template
+func AggregatedKey(template, prefix string, aggregate Aggregate) (string, error) {
+	start := aggregate.Start.UTC()
+	end := aggregate.End.UTC()
+
+	replacements := []string{
+		"{prefix}", prefix,
+		"{user}", userPath(aggregate.User),
+		"{yyyy}", start.Format("2006"),
+		"{mm}", start.Format("01"),
+		"{dd}", start.Format("02"),
+		"{hh}", start.Format("15"),
+		"{partition}", partitionPath(aggregate.Partition),
+		"{start}", start.Format(windowFormat),
+		"{end}", end.Format(windowFormat),
+		"{host}", getHostname(),
+		"{ext}", aggregateExt(aggregate),
+	}
+
+	if strings.Contains(template, "{seq}") {
+		replacements = append(replacements, "{seq}", fmt.Sprintf("%06d", sequence.Add(1)))
+	}
+
+	if strings.Contains(template, "{hash}") {
+		hash, err := fileHash(aggregate.Path)
+		if err != nil {
+			return "", fmt.Errorf("failed to hash aggregated file: %w", err)
+		}
+		replacements = append(replacements, "{hash}", hash)
+	}
+
+	return strings.NewReplacer(replacements...).Replace(template), nil
+}
+
+// aggregateExt returns the object key extension of an aggregated file
+func aggregateExt(aggregate Aggregate) string {
+	if aggregate.Ext == "" {
+		return ".jsonl.gz"
+	}
+	return aggregate.Ext
+}
+
+// userPath renders the user of a per-user aggregate as a key path segment
+func userPath(user string) string {
+	if user == "" {
+		return ""
+	}
+	return url.PathEscape(user) + "/"
+}
+
+// partitionPath renders a partition as a key path segment
+func partitionPath(partition string) string {
+	if partition == "" {
+		return ""
+	}
+	return partition + "/"
+}
+
+// SpecimenKey generates the object key for a specimen file
+func SpecimenKey(prefix string, specimen Specimen) string {
+	utcTime := specimen.Timestamp.UTC()
+	return fmt.Sprintf("%s%s%s/%s/%s/%s.%d%s",
+		prefix,
+		userPath(specimen.User),
+		utcTime.Format("2006"),
+		utcTime.Format("01"),
+		utcTime.Format("02"),
+		cleanURIForFilename(specimen.URI),
+		specimen.Timestamp.UnixNano(),
+		ExtractExtension(specimen.URI),
+	)
+}
+
+// ExtractExtension extracts file extension from URI
+func ExtractExtension(uri string) string {
+	// Parse the URI path
+	parts := strings.Split(uri, "/")
+	if len(parts) == 0 {
+		return ""
+	}
+
+	filename := parts[len(parts)-1]
+	ext := filepath.Ext(filename)
+
+	// If no extension, try to guess from common patterns
+	if ext == "" {
+		if strings.Contains(strings.ToLower(uri), "screenshot") {
+			return ".png"
+		}
+	}
+
+	return ext
+}
+
+// DetectContentType detects content type from extension
+func DetectContentType(ext string) string {
+	switch strings.ToLower(ext) {
+	case ".png":
+		return "image/png"
+	case ".jpg", ".jpeg":
+		return "image/jpeg"
+	case ".gif":
+		return "image/gif"
+	case ".json":
+		return "application/json"
+	case ".log", ".txt":
+		return "text/plain"
+	case ".html":
+		return "text/html"
+	case ".xml":
+		return "application/xml"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// cleanURIForFilename cleans URI for use in filename
+func cleanURIForFilename(uri string) string {
+	// Extract filename from URI
+	parts := strings.Split(uri, "/")
+	filename := parts[len(parts)-1]
+
+	// Remove extension
+	ext := filepath.Ext(filename)
+	if ext != "" {
+		filename = strings.TrimSuffix(filename, ext)
+	}
+
+	// Replace problematic characters
+	replacer := strings.NewReplacer(
+		" ", "_",
+		":", "_",
+		"?", "_",
+		"&", "_",
+		"=", "_",
+		"%", "_",
+		"#", "_",
+	)
+
+	return replacer.Replace(filename)
+}
+
+// fileHash returns a short content hash of a file
+func fileHash(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16], nil
+}
+
+// getHostname returns the hostname for key generation
+func getHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	// Clean hostname for object keys
+	return strings.ReplaceAll(hostname, ".", "-")
+}
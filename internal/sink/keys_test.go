@@ -0,0 +1,129 @@
+package sink
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregatedKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "aggregate.gz")
+	require.NoError(t, os.WriteFile(path, []byte("aggregated"), 0644))
+
+	aggregate := Aggregate{
+		Path:     path,
+		DataType: "usage",
+		Start:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		End:      time.Date(2024, 1, 2, 3, 14, 5, 0, time.UTC),
+	}
+	host := getHostname()
+
+	tests := []struct {
+		name     string
+		template string
+		expected string
+	}{
+		{
+			name:     "window and host",
+			template: "{prefix}{yyyy}/{mm}/{dd}/{hh}/{start}-{end}.{host}.jsonl.gz",
+			expected: "usage/2024/01/02/03/20240102T030405Z-20240102T031405Z." + host + ".jsonl.gz",
+		},
+		{
+			name:     "content hash",
+			template: "{prefix}{hash}.jsonl.gz",
+			expected: "usage/9fb062c8391ab89a.jsonl.gz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := AggregatedKey(tt.template, "usage/", aggregate)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, key)
+		})
+	}
+
+	t.Run("hive partition", func(t *testing.T) {
+		aggregate := aggregate
+		aggregate.Partition = "app_version=1.2.0"
+		key, err := AggregatedKey("{prefix}dt={yyyy}-{mm}-{dd}/hour={hh}/{partition}{start}.jsonl.gz", "usage/", aggregate)
+		require.NoError(t, err)
+		assert.Equal(t, "usage/dt=2024-01-02/hour=03/app_version=1.2.0/20240102T030405Z.jsonl.gz", key)
+
+		// Unpartitioned aggregates render no partition segment
+		aggregate.Partition = ""
+		key, err = AggregatedKey("{prefix}dt={yyyy}-{mm}-{dd}/hour={hh}/{partition}{start}.jsonl.gz", "usage/", aggregate)
+		require.NoError(t, err)
+		assert.Equal(t, "usage/dt=2024-01-02/hour=03/20240102T030405Z.jsonl.gz", key)
+	})
+
+	t.Run("user", func(t *testing.T) {
+		aggregate := aggregate
+		aggregate.User = "acme corp"
+		key, err := AggregatedKey("{prefix}{user}{yyyy}/{start}{ext}", "usage/", aggregate)
+		require.NoError(t, err)
+		assert.Equal(t, "usage/acme%20corp/2024/20240102T030405Z.jsonl.gz", key)
+
+		// Aggregates of all users render no user segment
+		aggregate.User = ""
+		key, err = AggregatedKey("{prefix}{user}{yyyy}/{start}{ext}", "usage/", aggregate)
+		require.NoError(t, err)
+		assert.Equal(t, "usage/2024/20240102T030405Z.jsonl.gz", key)
+	})
+
+	t.Run("extension", func(t *testing.T) {
+		key, err := AggregatedKey("{prefix}{start}{ext}", "usage/", aggregate)
+		require.NoError(t, err)
+		assert.Equal(t, "usage/20240102T030405Z.jsonl.gz", key)
+
+		aggregate := aggregate
+		aggregate.Ext = ".parquet"
+		key, err = AggregatedKey("{prefix}{start}{ext}", "usage/", aggregate)
+		require.NoError(t, err)
+		assert.Equal(t, "usage/20240102T030405Z.parquet", key)
+	})
+
+	t.Run("sequence is unique", func(t *testing.T) {
+		first, err := AggregatedKey("{start}.{seq}", "", aggregate)
+		require.NoError(t, err)
+		second, err := AggregatedKey("{start}.{seq}", "", aggregate)
+		require.NoError(t, err)
+		assert.NotEqual(t, first, second)
+		require.Regexp(t, `^20240102T030405Z\.\d{16}$`, first)
+
+		// Numbers start at the process start time, not at 1 after each restart
+		seq, err := strconv.ParseInt(strings.TrimPrefix(first, "20240102T030405Z."), 10, 64)
+		require.NoError(t, err)
+		assert.Greater(t, seq, time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC).UnixMicro())
+	})
+
+	t.Run("missing file with hash", func(t *testing.T) {
+		aggregate := aggregate
+		aggregate.Path = filepath.Join(t.TempDir(), "missing")
+		_, err := AggregatedKey("{hash}", "", aggregate)
+		assert.Error(t, err)
+	})
+}
+
+func TestSpecimenKey(t *testing.T) {
+	key := SpecimenKey("specimen/", Specimen{
+		User:      "testuser",
+		URI:       "http://example.com/my file.png",
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	assert.Equal(t, "specimen/testuser/2024/01/02/my_file.1704164645000000000.png", key)
+
+	// Users cannot add path segments to the key
+	key = SpecimenKey("specimen/", Specimen{
+		User:      "../other",
+		URI:       "http://example.com/a.png",
+		Timestamp: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	})
+	assert.Equal(t, "specimen/..%2Fother/2024/01/02/a.1704164645000000000.png", key)
+}
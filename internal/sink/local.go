@@ -0,0 +1,156 @@
+package sink
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/rs/zerolog/log"
+)
+
+// LocalSink stores files in a local or network-mounted directory.
+// Objects are laid out as <local_dir>/<bucket>/<key>, mirroring the S3 layout.
+type LocalSink struct {
+	baseDir string
+	config  *config.Config
+}
+
+var _ Sink = (*LocalSink)(nil)
+
+// NewLocalSink creates a new local filesystem sink
+func NewLocalSink(cfg *config.Config) *LocalSink {
+	return &LocalSink{
+		baseDir: cfg.Storage.LocalDir,
+		config:  cfg,
+	}
+}
+
+// PutAggregated copies an aggregated file into the local directory
+func (s *LocalSink) PutAggregated(aggregate Aggregate) error {
+	bucket, prefix, err := Destination(s.config, aggregate.DataType)
+	if err != nil {
+		return err
+	}
+
+	key, err := AggregatedKey(KeyTemplate(s.config, aggregate.DataType), prefix, aggregate)
+	if err != nil {
+		return err
+	}
+	dest, err := s.objectPath(bucket, key)
+	if err != nil {
+		return err
+	}
+	size, err := copyFile(aggregate.Path, dest)
+	if err != nil {
+		return fmt.Errorf("failed to store aggregated file: %w", err)
+	}
+
+	log.Info().
+		Str("path", dest).
+		Int64("size", size).
+		Msg("Stored aggregated file locally")
+
+	return nil
+}
+
+// PutSpecimen copies a specimen file into the local directory
+func (s *LocalSink) PutSpecimen(specimen Specimen) error {
+	key := SpecimenKey(s.config.S3.SpecimenPrefix, specimen)
+	dest, err := s.objectPath(s.config.S3.SpecimenBucket, key)
+	if err != nil {
+		return err
+	}
+	size, err := copyFile(specimen.Path, dest)
+	if err != nil {
+		return fmt.Errorf("failed to store specimen: %w", err)
+	}
+
+	log.Info().
+		Str("path", dest).
+		Str("user", specimen.User).
+		Str("uri", specimen.URI).
+		Int64("size", size).
+		Msg("Stored specimen file locally")
+
+	return nil
+}
+
+// AbortUpload does nothing, as failed copies leave nothing behind
+func (s *LocalSink) AbortUpload(path string) error {
+	return nil
+}
+
+// HealthCheck verifies that the base directory exists
+func (s *LocalSink) HealthCheck() error {
+	info, err := os.Stat(s.baseDir)
+	if err != nil {
+		return fmt.Errorf("local directory %s not accessible: %w", s.baseDir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("local directory %s is not a directory", s.baseDir)
+	}
+	return nil
+}
+
+// objectPath returns the filesystem path for a bucket and key. Keys that
+// resolve outside the bucket directory, such as through .. segments, are
+// rejected.
+func (s *LocalSink) objectPath(bucket, key string) (string, error) {
+	dir := filepath.Join(s.baseDir, bucket)
+	path := filepath.Join(dir, filepath.FromSlash(key))
+	if rel, err := filepath.Rel(dir, path); err != nil || !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("object key %q resolves outside the local directory", key)
+	}
+	return path, nil
+}
+
+// copyFile durably copies src to dest through a temporary file in the same
+// directory, so readers of the destination never observe a partial file and
+// concurrent copies to the same destination do not share a temporary file.
+// The directory is synced so the file survives a crash once copyFile returns.
+func copyFile(src, dest string) (int64, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return 0, err
+	}
+	defer in.Close()
+
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return 0, err
+	}
+
+	dir := filepath.Dir(dest)
+	out, err := os.CreateTemp(dir, "."+filepath.Base(dest)+".*.tmp")
+	if err != nil {
+		return 0, err
+	}
+	tmp := out.Name()
+
+	size, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Chmod(0644)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+
+	if err := os.Rename(tmp, dest); err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	if err := cache.SyncDir(dir); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
@@ -0,0 +1,149 @@
+package sink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestConfig(dir string) *config.Config {
+	return &config.Config{
+		S3: config.S3Config{
+			UsageBucket:    "test-usage",
+			UsagePrefix:    "usage/",
+			ErrorBucket:    "test-error",
+			SpecimenBucket: "test-specimen",
+			SpecimenPrefix: "specimen/",
+		},
+		Storage: config.StorageConfig{
+			Type:     config.StorageLocal,
+			LocalDir: dir,
+		},
+	}
+}
+
+func findFiles(t *testing.T, root string) []string {
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func TestLocalSink_PutAggregated(t *testing.T) {
+	destDir := t.TempDir()
+	s := NewLocalSink(newTestConfig(destDir))
+
+	src := filepath.Join(t.TempDir(), "aggregate.gz")
+	require.NoError(t, os.WriteFile(src, []byte("aggregated"), 0644))
+
+	aggregate := Aggregate{
+		Path:     src,
+		DataType: "usage",
+		Start:    time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		End:      time.Date(2024, 1, 2, 3, 14, 5, 0, time.UTC),
+	}
+	require.NoError(t, s.PutAggregated(aggregate))
+
+	files := findFiles(t, filepath.Join(destDir, "test-usage"))
+	require.Len(t, files, 1)
+	rel, err := filepath.Rel(destDir, files[0])
+	require.NoError(t, err)
+	assert.Regexp(t, `^test-usage/usage/2024/01/02/03/20240102T030405Z-20240102T031405Z\..+\.[0-9a-f]{16}\.jsonl\.gz$`, filepath.ToSlash(rel))
+
+	content, err := os.ReadFile(files[0])
+	require.NoError(t, err)
+	assert.Equal(t, "aggregated", string(content))
+
+	t.Run("unknown data type", func(t *testing.T) {
+		aggregate.DataType = "unknown"
+		assert.Error(t, s.PutAggregated(aggregate))
+	})
+}
+
+func TestLocalSink_PutSpecimen(t *testing.T) {
+	destDir := t.TempDir()
+	s := NewLocalSink(newTestConfig(destDir))
+
+	src := filepath.Join(t.TempDir(), "specimen")
+	require.NoError(t, os.WriteFile(src, []byte("specimen data"), 0644))
+
+	timestamp := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	err := s.PutSpecimen(Specimen{
+		Path:      src,
+		User:      "testuser",
+		URI:       "http://example.com/test.png",
+		Timestamp: timestamp,
+	})
+	require.NoError(t, err)
+
+	dest := filepath.Join(destDir, "test-specimen", "specimen", "testuser", "2024", "01", "02",
+		"test."+"1704164645000000000"+".png")
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "specimen data", string(content))
+}
+
+func TestCopyFile_Concurrent(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "bucket", "key.jsonl.gz")
+
+	// Concurrent copies to the same destination each use their own temporary file
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		src := filepath.Join(dir, fmt.Sprintf("src-%d", i))
+		require.NoError(t, os.WriteFile(src, []byte(strings.Repeat("x", 1<<16)), 0644))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			size, err := copyFile(src, dest)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(1<<16), size)
+		}()
+	}
+	wg.Wait()
+
+	entries, err := os.ReadDir(filepath.Dir(dest))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "key.jsonl.gz", entries[0].Name())
+	info, err := entries[0].Info()
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<16), info.Size())
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+func TestLocalSink_ObjectPath(t *testing.T) {
+	destDir := t.TempDir()
+	s := NewLocalSink(newTestConfig(destDir))
+
+	path, err := s.objectPath("bucket", "a/b.gz")
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(destDir, "bucket", "a", "b.gz"), path)
+
+	for _, key := range []string{"../escape.gz", "a/../../escape.gz", "../bucket2/a.gz"} {
+		_, err := s.objectPath("bucket", key)
+		assert.Error(t, err, key)
+	}
+}
+
+func TestLocalSink_HealthCheck(t *testing.T) {
+	destDir := t.TempDir()
+	assert.NoError(t, NewLocalSink(newTestConfig(destDir)).HealthCheck())
+	assert.Error(t, NewLocalSink(newTestConfig(filepath.Join(destDir, "missing"))).HealthCheck())
+}
@@ -0,0 +1,92 @@
+package sink
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+)
+
+// Sink is a storage destination for aggregated files and specimens
+type Sink interface {
+	// PutAggregated stores an aggregated usage or error file
+	PutAggregated(aggregate Aggregate) error
+
+	// PutSpecimen stores a specimen file
+	PutSpecimen(specimen Specimen) error
+
+	// AbortUpload releases what failed uploads of a cache file left at the
+	// destination, such as the parts of an S3 multipart upload, when the
+	// file is given up on
+	AbortUpload(path string) error
+
+	// HealthCheck verifies that the destination is reachable
+	HealthCheck() error
+}
+
+// Aggregate describes an aggregated file to be stored
+type Aggregate struct {
+	Path     string
+	DataType string
+
+	// Start is the event time of the oldest record in the file. Records are
+	// grouped into files by event hour, falling back to their receive time,
+	// so every record of the file is in the hour of Start.
+	Start time.Time
+
+	// End is the time the aggregation ran
+	End time.Time
+
+	// Partition is the name=value partition of the records in the file,
+	// empty when aggregates are not partitioned
+	Partition string
+
+	// User is the user whose records the file holds, empty when aggregates
+	// are not per user
+	User string
+
+	// Ext is the object key extension, .jsonl.gz when empty
+	Ext string
+
+	// ContentType is the content type of the file, application/gzip when empty
+	ContentType string
+}
+
+// Specimen describes a cached specimen file to be stored
+type Specimen struct {
+	Path        string
+	User        string
+	URI         string
+	ContentType string
+	RequestID   string
+	Timestamp   time.Time
+}
+
+// KeyTemplate returns the aggregated object key template configured for a data type
+func KeyTemplate(cfg *config.Config, dataType string) string {
+	var template string
+	switch dataType {
+	case "usage":
+		template = cfg.S3.UsageKeyTemplate
+	case "error":
+		template = cfg.S3.ErrorKeyTemplate
+	}
+	if template == "" {
+		return config.LayoutKeyTemplate(cfg.S3.Layout)
+	}
+	return template
+}
+
+// Destination returns the bucket and prefix configured for a data type
+func Destination(cfg *config.Config, dataType string) (bucket, prefix string, err error) {
+	switch dataType {
+	case "usage":
+		return cfg.S3.UsageBucket, cfg.S3.UsagePrefix, nil
+	case "error":
+		return cfg.S3.ErrorBucket, cfg.S3.ErrorPrefix, nil
+	case "specimen":
+		return cfg.S3.SpecimenBucket, cfg.S3.SpecimenPrefix, nil
+	default:
+		return "", "", fmt.Errorf("unknown data type: %s", dataType)
+	}
+}
@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"fmt"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/rs/zerolog/log"
+)
+
+// unknownUser is used for specimens cached without metadata
+const unknownUser = "unknown"
+
+// UploadSpecimenFile moves a cached specimen to the uploading directory and stores it in the sink
+func UploadSpecimenFile(s Sink, cacheManager *cache.Manager, path string) error {
+	// Claim the destination before the move so that the retrier cannot
+	// pick the file up in between
+	uploadingPath := cacheManager.UploadingPath(path, "specimen")
+	if !cacheManager.ClaimFile(uploadingPath) {
+		return fmt.Errorf("specimen %s is already being uploaded", uploadingPath)
+	}
+	defer cacheManager.ReleaseFile(uploadingPath)
+
+	// Move to uploading directory
+	if _, err := cacheManager.MoveToUploading(path, "specimen"); err != nil {
+		return fmt.Errorf("failed to move file to uploading: %w", err)
+	}
+
+	return PutUploadingSpecimen(s, cacheManager, uploadingPath)
+}
+
+// PutUploadingSpecimen stores a specimen from the uploading directory and removes it from cache.
+// The caller is responsible for claiming the file.
+func PutUploadingSpecimen(s Sink, cacheManager *cache.Manager, path string) error {
+	specimen, err := specimenFromCache(cacheManager, path)
+	if err != nil {
+		return err
+	}
+
+	// Failed uploads stay in the uploading directory to be retried
+	if err := s.PutSpecimen(specimen); err != nil {
+		return err
+	}
+
+	// Remove uploaded file
+	if err := cacheManager.RemoveSpecimen(path); err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Failed to remove uploaded file")
+	}
+	if err := cacheManager.RemoveRetryState(path, "specimen"); err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Failed to remove retry state")
+	}
+
+	return nil
+}
+
+// specimenFromCache builds a Specimen from a cached file and its metadata
+func specimenFromCache(cacheManager *cache.Manager, path string) (Specimen, error) {
+	uri, timestamp, err := cacheManager.GetSpecimenInfo(path)
+	if err != nil {
+		return Specimen{}, fmt.Errorf("failed to get specimen info: %w", err)
+	}
+
+	specimen := Specimen{
+		Path:      path,
+		User:      unknownUser,
+		URI:       uri,
+		Timestamp: timestamp,
+	}
+
+	meta, err := cacheManager.ReadSpecimenMeta(path)
+	if err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Specimen metadata not available, using unknown user")
+		return specimen, nil
+	}
+
+	specimen.User = meta.User
+	specimen.ContentType = meta.ContentType
+	specimen.RequestID = meta.RequestID
+	if meta.URI != "" {
+		specimen.URI = meta.URI
+	}
+
+	return specimen, nil
+}
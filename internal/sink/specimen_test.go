@@ -0,0 +1,35 @@
+package sink
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUploadSpecimenFile(t *testing.T) {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+	destDir := t.TempDir()
+	s := NewLocalSink(newTestConfig(destDir))
+
+	path, _, err := cacheManager.SaveSpecimen(cache.SpecimenMeta{User: "acme", URI: "http://example.com/a.png"}, strings.NewReader("data"))
+	require.NoError(t, err)
+
+	// A destination claimed by another worker is left alone
+	uploadingPath := cacheManager.UploadingPath(path, "specimen")
+	require.True(t, cacheManager.ClaimFile(uploadingPath))
+	assert.Error(t, UploadSpecimenFile(s, cacheManager, path))
+	assert.FileExists(t, path)
+	cacheManager.ReleaseFile(uploadingPath)
+
+	require.NoError(t, UploadSpecimenFile(s, cacheManager, path))
+	assert.NoFileExists(t, path)
+	assert.NoFileExists(t, uploadingPath)
+	assert.Len(t, findFiles(t, destDir), 1)
+
+	// The claim is released after the upload
+	assert.True(t, cacheManager.ClaimFile(uploadingPath))
+}
@@ -0,0 +1,70 @@
+package validation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/xeipuuv/gojsonschema"
+)
+
+// Validator checks usage and error records against optional JSON Schemas
+type Validator struct {
+	schemas map[string]*gojsonschema.Schema
+}
+
+// NewValidator loads the schemas configured per data type
+func NewValidator(cfg config.ValidationConfig) (*Validator, error) {
+	v := &Validator{schemas: make(map[string]*gojsonschema.Schema)}
+
+	for dataType, path := range map[string]string{
+		"usage": cfg.UsageSchema,
+		"error": cfg.ErrorSchema,
+	} {
+		if path == "" {
+			continue
+		}
+
+		// A reference loader lets schemas $ref files relative to themselves
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s schema path: %w", dataType, err)
+		}
+		schema, err := gojsonschema.NewSchema(gojsonschema.NewReferenceLoader("file://" + filepath.ToSlash(absPath)))
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s schema %s: %w", dataType, path, err)
+		}
+		v.schemas[dataType] = schema
+	}
+
+	return v, nil
+}
+
+// Validate checks data against the schema configured for the data type,
+// which must be a single JSON value conforming to the schema. Without a
+// schema any data is accepted. It returns the list of violations, which is
+// empty for valid data.
+func (v *Validator) Validate(dataType string, data []byte) []string {
+	schema, ok := v.schemas[dataType]
+	if !ok {
+		return nil
+	}
+
+	trimmed := bytes.TrimSpace(data)
+	if !json.Valid(trimmed) {
+		return []string{"record is not valid JSON"}
+	}
+
+	result, err := schema.Validate(gojsonschema.NewBytesLoader(trimmed))
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var violations []string
+	for _, resultErr := range result.Errors() {
+		violations = append(violations, resultErr.String())
+	}
+	return violations
+}
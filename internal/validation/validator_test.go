@@ -0,0 +1,123 @@
+package validation
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeSchemas(t *testing.T) string {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "definitions.json"), []byte(`{
+		"definitions": {
+			"version": {"type": "string", "pattern": "^[0-9]+\\.[0-9]+\\.[0-9]+$"}
+		}
+	}`), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "usage.json"), []byte(`{
+		"type": "object",
+		"required": ["event"],
+		"properties": {
+			"event": {"type": "string"},
+			"app_version": {"$ref": "definitions.json#/definitions/version"}
+		}
+	}`), 0644))
+	return dir
+}
+
+func TestValidator_Validate(t *testing.T) {
+	dir := writeSchemas(t)
+	validator, err := NewValidator(config.ValidationConfig{
+		UsageSchema: filepath.Join(dir, "usage.json"),
+	})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name       string
+		dataType   string
+		data       string
+		violations []string
+	}{
+		{
+			name:     "valid",
+			dataType: "usage",
+			data:     `{"event": "start", "app_version": "1.2.3"}`,
+		},
+		{
+			name:     "pretty printed",
+			dataType: "usage",
+			data:     "{\n  \"event\": \"start\"\n}\n",
+		},
+		{
+			name:       "missing required field",
+			dataType:   "usage",
+			data:       `{"app_version": "1.2.3"}`,
+			violations: []string{"(root): event is required"},
+		},
+		{
+			name:       "referenced definition",
+			dataType:   "usage",
+			data:       `{"event": "start", "app_version": "latest"}`,
+			violations: []string{`app_version: Does not match pattern '^[0-9]+\.[0-9]+\.[0-9]+$'`},
+		},
+		{
+			name:       "not an object",
+			dataType:   "usage",
+			data:       `["event"]`,
+			violations: []string{"(root): Invalid type. Expected: object, given: array"},
+		},
+		{
+			name:       "multiple records",
+			dataType:   "usage",
+			data:       `{"event": "a"} {"event": "b"}`,
+			violations: []string{"record is not valid JSON"},
+		},
+		{
+			name:     "no schema for data type",
+			dataType: "error",
+			data:     `{"anything": true}`,
+		},
+		{
+			name:     "no schema accepts any JSON value",
+			dataType: "error",
+			data:     `["stack", "trace"]`,
+		},
+		{
+			name:     "no schema accepts multiple values",
+			dataType: "error",
+			data:     `{"error": "a"} {"error": "b"}`,
+		},
+		{
+			name:     "no schema accepts any body",
+			dataType: "error",
+			data:     `stack trace`,
+		},
+		{
+			name:       "empty",
+			dataType:   "usage",
+			data:       ` `,
+			violations: []string{"record is not valid JSON"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.violations, validator.Validate(tt.dataType, []byte(tt.data)))
+		})
+	}
+}
+
+func TestNewValidator_InvalidSchema(t *testing.T) {
+	_, err := NewValidator(config.ValidationConfig{
+		ErrorSchema: filepath.Join(t.TempDir(), "missing.json"),
+	})
+	assert.Error(t, err)
+
+	path := filepath.Join(t.TempDir(), "broken.json")
+	require.NoError(t, os.WriteFile(path, []byte(`{"type": 42}`), 0644))
+	_, err = NewValidator(config.ValidationConfig{UsageSchema: path})
+	assert.Error(t, err)
+}
@@ -8,32 +8,35 @@ import (
 	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
 	"github.com/ideamans/lightfile6-insights-gateway/internal/s3"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
 	"github.com/rs/zerolog/log"
 )
 
 // Manager manages background workers
 type Manager struct {
 	cacheManager *cache.Manager
-	s3Client     *s3.Client
+	storage      sink.Sink
 	aggregator   *s3.Aggregator
+	retrier      *Retrier
+	specimens    *SpecimenPool
 	config       *config.Config
 	wg           sync.WaitGroup
 	usageTicker  *time.Ticker
 	errorTicker  *time.Ticker
+	retryTicker  *time.Ticker
 }
 
 // NewManager creates a new worker manager
-func NewManager(cacheManager *cache.Manager, s3Client *s3.Client, cfg *config.Config) *Manager {
-	// Set cache manager in S3 client
-	s3Client.SetCacheManager(cacheManager)
-	
+func NewManager(cacheManager *cache.Manager, storage sink.Sink, cfg *config.Config) *Manager {
 	// Create aggregator
-	aggregator := s3.NewAggregator(cacheManager, s3Client)
+	aggregator := s3.NewAggregator(cacheManager, storage, cfg)
 	
 	return &Manager{
 		cacheManager: cacheManager,
-		s3Client:     s3Client,
+		storage:      storage,
 		aggregator:   aggregator,
+		retrier:      NewRetrier(cacheManager, storage, aggregator, cfg),
+		specimens:    NewSpecimenPool(cacheManager, storage, cfg.SpecimenUpload),
 		config:       cfg,
 	}
 }
@@ -43,16 +46,27 @@ func (m *Manager) Start(ctx context.Context) {
 	// Start usage aggregation worker
 	m.usageTicker = time.NewTicker(m.config.Aggregation.UsageInterval)
 	m.wg.Add(1)
-	go m.runAggregationWorker(ctx, "usage", m.usageTicker.C)
+	go m.runAggregationWorker(ctx, "usage", m.usageTicker.C, m.cacheManager.AggregationRequests("usage"))
 	
 	// Start error aggregation worker
 	m.errorTicker = time.NewTicker(m.config.Aggregation.ErrorInterval)
 	m.wg.Add(1)
-	go m.runAggregationWorker(ctx, "error", m.errorTicker.C)
+	go m.runAggregationWorker(ctx, "error", m.errorTicker.C, m.cacheManager.AggregationRequests("error"))
+	
+	// Start upload retry worker
+	m.retryTicker = time.NewTicker(m.config.Retry.Interval)
+	m.wg.Add(1)
+	go m.runRetryWorker(ctx, m.retryTicker.C, m.cacheManager.RetryRequests())
+	
+	// Start specimen upload workers and queue specimens left from a previous run
+	m.specimens.Start(ctx)
+	m.specimens.Sweep()
 	
 	log.Info().
 		Dur("usageInterval", m.config.Aggregation.UsageInterval).
 		Dur("errorInterval", m.config.Aggregation.ErrorInterval).
+		Dur("retryInterval", m.config.Retry.Interval).
+		Int("specimenConcurrency", m.config.SpecimenUpload.Concurrency).
 		Msg("Started background workers")
 }
 
@@ -65,9 +79,18 @@ func (m *Manager) Wait() {
 	if m.errorTicker != nil {
 		m.errorTicker.Stop()
 	}
+	if m.retryTicker != nil {
+		m.retryTicker.Stop()
+	}
 	
 	// Wait for workers
 	m.wg.Wait()
+	m.specimens.Wait()
+}
+
+// EnqueueSpecimen queues a cached specimen for upload
+func (m *Manager) EnqueueSpecimen(path string) bool {
+	return m.specimens.Enqueue(path)
 }
 
 // ProcessRemaining processes any remaining files
@@ -76,7 +99,8 @@ func (m *Manager) ProcessRemaining() error {
 }
 
 // runAggregationWorker runs the aggregation worker for a specific data type
-func (m *Manager) runAggregationWorker(ctx context.Context, dataType string, ticker <-chan time.Time) {
+// Aggregation also runs as soon as it is requested by the cache manager.
+func (m *Manager) runAggregationWorker(ctx context.Context, dataType string, ticker <-chan time.Time, requests <-chan struct{}) {
 	defer m.wg.Done()
 	
 	log.Info().Str("dataType", dataType).Msg("Aggregation worker started")
@@ -87,11 +111,47 @@ func (m *Manager) runAggregationWorker(ctx context.Context, dataType string, tic
 			log.Info().Str("dataType", dataType).Msg("Aggregation worker stopping")
 			return
 		case <-ticker:
-			if err := m.aggregator.AggregateAndUpload(dataType); err != nil {
-				log.Error().
-					Err(err).
-					Str("dataType", dataType).
-					Msg("Aggregation failed")
+			m.aggregate(dataType)
+		case <-requests:
+			log.Info().Str("dataType", dataType).Msg("Immediate aggregation requested")
+			m.aggregate(dataType)
+		}
+	}
+}
+
+// aggregate runs one aggregation cycle for a data type
+func (m *Manager) aggregate(dataType string) {
+	if err := m.aggregator.AggregateAndUpload(dataType); err != nil {
+		log.Error().
+			Err(err).
+			Str("dataType", dataType).
+			Msg("Aggregation failed")
+	}
+}
+
+// runRetryWorker periodically retries failed uploads and queues specimens
+// that did not fit in the upload queue. Retries also run as soon as they are
+// requested by the cache manager.
+func (m *Manager) runRetryWorker(ctx context.Context, ticker <-chan time.Time, requests <-chan struct{}) {
+	defer m.wg.Done()
+	
+	log.Info().Msg("Retry worker started")
+	
+	for {
+		select {
+		case <-ctx.Done():
+			log.Info().Msg("Retry worker stopping")
+			return
+		case <-ticker:
+			m.retrier.RetryAll()
+			m.specimens.Sweep()
+		case <-requests:
+			log.Info().Msg("Immediate retry requested")
+			m.retrier.RetryAll()
+			m.specimens.Sweep()
+			// Correct any drift in the tracked cache usage off the request path
+			if err := m.cacheManager.Rescan(); err != nil {
+				log.Error().Err(err).Msg("Failed to rescan cache directory")
 			}
 		}
 	}
@@ -0,0 +1,165 @@
+package worker
+
+import (
+	"math/rand/v2"
+	"os"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/s3"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+	"github.com/rs/zerolog/log"
+)
+
+// Retrier re-attempts uploads left in the uploading directories with
+// exponential backoff, moving files to the deadletter directory after
+// the configured number of attempts.
+type Retrier struct {
+	cacheManager *cache.Manager
+	storage      sink.Sink
+	aggregator   *s3.Aggregator
+	config       config.RetryConfig
+	now          func() time.Time
+}
+
+// NewRetrier creates a new retrier
+func NewRetrier(cacheManager *cache.Manager, storage sink.Sink, aggregator *s3.Aggregator, cfg *config.Config) *Retrier {
+	return &Retrier{
+		cacheManager: cacheManager,
+		storage:      storage,
+		aggregator:   aggregator,
+		config:       cfg.Retry,
+		now:          time.Now,
+	}
+}
+
+// RetryAll re-attempts every due file in the uploading directories
+func (r *Retrier) RetryAll() {
+	for _, dataType := range []string{"usage", "error", "specimen"} {
+		files, err := r.cacheManager.GetUploadingFiles(dataType)
+		if err != nil {
+			log.Error().Err(err).Str("dataType", dataType).Msg("Failed to get uploading files")
+			continue
+		}
+
+		for _, file := range files {
+			r.retryFile(file, dataType)
+		}
+	}
+}
+
+// retryFile re-attempts a single upload if it is due
+func (r *Retrier) retryFile(path string, dataType string) {
+	// Skip files currently being uploaded by another worker
+	if !r.cacheManager.ClaimFile(path) {
+		return
+	}
+	defer r.cacheManager.ReleaseFile(path)
+
+	state, err := r.cacheManager.ReadRetryState(path, dataType)
+	if err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Failed to read retry state")
+	}
+	if state == nil {
+		// No attempt recorded yet; the first upload failed or was interrupted.
+		// Wait one backoff period from the time the file was written.
+		info, err := os.Stat(path)
+		if err != nil {
+			return
+		}
+		state = &cache.RetryState{
+			NextAttempt: info.ModTime().Add(r.config.InitialBackoff),
+		}
+	}
+
+	now := r.now()
+	if now.Before(state.NextAttempt) {
+		return
+	}
+
+	if err := r.upload(path, dataType); err != nil {
+		state.LastError = err.Error()
+	} else {
+		log.Info().
+			Str("file", path).
+			Str("dataType", dataType).
+			Int("attempts", state.Attempts+1).
+			Msg("Retried upload succeeded")
+		return
+	}
+
+	state.Attempts++
+	state.LastAttempt = now
+	state.NextAttempt = now.Add(r.backoff(state.Attempts))
+
+	if state.Attempts >= r.config.MaxAttempts {
+		r.deadLetter(path, dataType, state)
+		return
+	}
+
+	if err := r.cacheManager.SaveRetryState(path, dataType, state); err != nil {
+		log.Error().Err(err).Str("file", path).Msg("Failed to save retry state")
+	}
+
+	log.Warn().
+		Str("file", path).
+		Str("dataType", dataType).
+		Int("attempts", state.Attempts).
+		Time("nextAttempt", state.NextAttempt).
+		Str("error", state.LastError).
+		Msg("Retried upload failed")
+}
+
+// upload uploads a file from the uploading directory
+func (r *Retrier) upload(path string, dataType string) error {
+	if dataType == "specimen" {
+		return sink.PutUploadingSpecimen(r.storage, r.cacheManager, path)
+	}
+	return r.aggregator.UploadFile(path, dataType)
+}
+
+// deadLetter moves a file that exhausted its attempts to the deadletter
+// directory, aborting what its failed uploads left in storage
+func (r *Retrier) deadLetter(path string, dataType string, state *cache.RetryState) {
+	if err := r.storage.AbortUpload(path); err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Failed to abort upload")
+	}
+
+	dest, err := r.cacheManager.MoveToDeadLetter(path, dataType)
+	if err != nil {
+		log.Error().Err(err).Str("file", path).Msg("Failed to move file to deadletter")
+		return
+	}
+	if err := r.cacheManager.RemoveRetryState(path, dataType); err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Failed to remove retry state")
+	}
+	if err := r.cacheManager.RemoveMultipartState(path); err != nil {
+		log.Warn().Err(err).Str("file", path).Msg("Failed to remove multipart upload state")
+	}
+
+	log.Error().
+		Str("file", dest).
+		Str("dataType", dataType).
+		Int("attempts", state.Attempts).
+		Str("error", state.LastError).
+		Msg("Upload moved to deadletter after maximum attempts")
+}
+
+// backoff returns the jittered delay before the next attempt
+func (r *Retrier) backoff(attempts int) time.Duration {
+	delay := r.config.InitialBackoff
+	for i := 1; i < attempts && delay < r.config.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > r.config.MaxBackoff {
+		delay = r.config.MaxBackoff
+	}
+
+	// Equal jitter: keep half of the delay and randomize the rest
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + rand.N(half)
+}
@@ -0,0 +1,210 @@
+package worker
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/s3"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockSink is a sink whose uploads fail until fail is cleared
+type mockSink struct {
+	mu         sync.Mutex
+	fail       bool
+	aggregated int
+	specimens  []sink.Specimen
+	aborted    []string
+}
+
+func (m *mockSink) PutAggregated(aggregate sink.Aggregate) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return errors.New("storage unavailable")
+	}
+	m.aggregated++
+	return nil
+}
+
+func (m *mockSink) PutSpecimen(specimen sink.Specimen) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fail {
+		return errors.New("storage unavailable")
+	}
+	m.specimens = append(m.specimens, specimen)
+	return nil
+}
+
+func (m *mockSink) AbortUpload(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.aborted = append(m.aborted, path)
+	return nil
+}
+
+func (m *mockSink) HealthCheck() error {
+	return nil
+}
+
+func (m *mockSink) setFail(fail bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.fail = fail
+}
+
+func setupRetrier(t *testing.T) (*Retrier, *cache.Manager, *mockSink) {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+
+	cfg := &config.Config{}
+	cfg.SetDefaults()
+	cfg.Retry.MaxAttempts = 3
+
+	storage := &mockSink{fail: true}
+	aggregator := s3.NewAggregator(cacheManager, storage, cfg)
+	return NewRetrier(cacheManager, storage, aggregator, cfg), cacheManager, storage
+}
+
+func writeUploadingFile(t *testing.T, cacheManager *cache.Manager, dataType string) string {
+	path := filepath.Join(cacheManager.BaseDir, dataType, "uploading", "aggregate_1.gz")
+	require.NoError(t, os.WriteFile(path, []byte("data"), 0644))
+	return path
+}
+
+func TestRetrier_RetryAll(t *testing.T) {
+	retrier, cacheManager, storage := setupRetrier(t)
+	path := writeUploadingFile(t, cacheManager, "usage")
+	now := time.Now()
+
+	// A fresh file is not retried before the initial backoff
+	retrier.now = func() time.Time { return now }
+	retrier.RetryAll()
+	state, err := cacheManager.ReadRetryState(path, "usage")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	// A due file that fails again records the attempt
+	now = now.Add(2 * time.Minute)
+	retrier.RetryAll()
+	state, err = cacheManager.ReadRetryState(path, "usage")
+	require.NoError(t, err)
+	require.NotNil(t, state)
+	assert.Equal(t, 1, state.Attempts)
+	assert.Equal(t, "failed to upload aggregated file: storage unavailable", state.LastError)
+	assert.True(t, state.NextAttempt.After(now))
+
+	// Not retried again before the next attempt is due
+	retrier.RetryAll()
+	state, err = cacheManager.ReadRetryState(path, "usage")
+	require.NoError(t, err)
+	assert.Equal(t, 1, state.Attempts)
+
+	// Succeeds once storage is back
+	storage.setFail(false)
+	now = state.NextAttempt
+	retrier.RetryAll()
+	assert.Equal(t, 1, storage.aggregated)
+
+	uploadingFiles, err := cacheManager.GetUploadingFiles("usage")
+	require.NoError(t, err)
+	assert.Empty(t, uploadingFiles)
+
+	state, err = cacheManager.ReadRetryState(path, "usage")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestRetrier_DeadLetter(t *testing.T) {
+	retrier, cacheManager, storage := setupRetrier(t)
+	path := writeUploadingFile(t, cacheManager, "error")
+	now := time.Now().Add(2 * time.Minute)
+	retrier.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		retrier.RetryAll()
+		now = now.Add(2 * time.Hour)
+	}
+
+	uploadingFiles, err := cacheManager.GetUploadingFiles("error")
+	require.NoError(t, err)
+	assert.Empty(t, uploadingFiles)
+
+	deadLetterFiles, err := cacheManager.GetDeadLetterFiles("error")
+	require.NoError(t, err)
+	assert.Len(t, deadLetterFiles, 1)
+
+	// The upload left in storage is aborted
+	assert.Equal(t, []string{path}, storage.aborted)
+
+	state, err := cacheManager.ReadRetryState(path, "error")
+	require.NoError(t, err)
+	assert.Nil(t, state)
+}
+
+func TestRetrier_Specimen(t *testing.T) {
+	retrier, cacheManager, storage := setupRetrier(t)
+	storage.setFail(false)
+
+	_, _, err := cacheManager.SaveSpecimen(cache.SpecimenMeta{
+		User: "testuser",
+		URI:  "http://example.com/test.png",
+	}, strings.NewReader("specimen"))
+	require.NoError(t, err)
+	files, err := cacheManager.GetSpecimenFiles()
+	require.NoError(t, err)
+	_, err = cacheManager.MoveToUploading(files[0], "specimen")
+	require.NoError(t, err)
+
+	retrier.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	retrier.RetryAll()
+
+	require.Len(t, storage.specimens, 1)
+	assert.Equal(t, "testuser", storage.specimens[0].User)
+}
+
+func TestRetrier_SkipsClaimedFiles(t *testing.T) {
+	retrier, cacheManager, storage := setupRetrier(t)
+	storage.setFail(false)
+	path := writeUploadingFile(t, cacheManager, "usage")
+
+	require.True(t, cacheManager.ClaimFile(path))
+	retrier.now = func() time.Time { return time.Now().Add(2 * time.Minute) }
+	retrier.RetryAll()
+	assert.Equal(t, 0, storage.aggregated)
+
+	cacheManager.ReleaseFile(path)
+	retrier.RetryAll()
+	assert.Equal(t, 1, storage.aggregated)
+}
+
+func TestRetrier_backoff(t *testing.T) {
+	retrier, _, _ := setupRetrier(t)
+
+	tests := []struct {
+		attempts int
+		max      time.Duration
+	}{
+		{attempts: 1, max: time.Minute},
+		{attempts: 2, max: 2 * time.Minute},
+		{attempts: 3, max: 4 * time.Minute},
+		{attempts: 10, max: time.Hour},
+		{attempts: 100, max: time.Hour},
+	}
+
+	for _, tt := range tests {
+		delay := retrier.backoff(tt.attempts)
+		assert.GreaterOrEqual(t, delay, tt.max/2)
+		assert.LessOrEqual(t, delay, tt.max)
+	}
+}
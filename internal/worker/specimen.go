@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/sink"
+	"github.com/rs/zerolog/log"
+)
+
+// SpecimenPool uploads saved specimens with a bounded number of workers.
+// Specimens are queued by path; anything that does not fit in the queue
+// stays in the cache and is picked up by Sweep.
+type SpecimenPool struct {
+	cacheManager *cache.Manager
+	storage      sink.Sink
+	config       config.SpecimenUploadConfig
+	queue        chan string
+	wg           sync.WaitGroup
+
+	mu     sync.Mutex
+	queued map[string]bool
+}
+
+// NewSpecimenPool creates a new specimen upload pool
+func NewSpecimenPool(cacheManager *cache.Manager, storage sink.Sink, cfg config.SpecimenUploadConfig) *SpecimenPool {
+	return &SpecimenPool{
+		cacheManager: cacheManager,
+		storage:      storage,
+		config:       cfg,
+		queue:        make(chan string, max(cfg.QueueSize, 1)),
+		queued:       make(map[string]bool),
+	}
+}
+
+// Start starts the upload workers
+func (p *SpecimenPool) Start(ctx context.Context) {
+	for i := 0; i < max(p.config.Concurrency, 1); i++ {
+		p.wg.Add(1)
+		go p.run(ctx)
+	}
+}
+
+// Wait waits for all workers to finish
+func (p *SpecimenPool) Wait() {
+	p.wg.Wait()
+}
+
+// Enqueue queues a cached specimen for upload. It never blocks and returns
+// false when the queue is full; paths already queued are accepted as is.
+func (p *SpecimenPool) Enqueue(path string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.queued[path] {
+		return true
+	}
+
+	select {
+	case p.queue <- path:
+		p.queued[path] = true
+		return true
+	default:
+		return false
+	}
+}
+
+// Sweep queues specimens left in the cache, such as those saved while the
+// queue was full or before a restart
+func (p *SpecimenPool) Sweep() {
+	files, err := p.cacheManager.GetSpecimenFiles()
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to get specimen files")
+		return
+	}
+
+	for _, file := range files {
+		if !p.Enqueue(file) {
+			log.Warn().Str("file", file).Msg("Specimen upload queue full, deferring sweep")
+			return
+		}
+	}
+}
+
+// run uploads queued specimens until the context is cancelled
+func (p *SpecimenPool) run(ctx context.Context) {
+	defer p.wg.Done()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case path := <-p.queue:
+			p.upload(path)
+		}
+	}
+}
+
+// upload uploads a single specimen. Failed uploads stay in the uploading
+// directory for the retrier.
+func (p *SpecimenPool) upload(path string) {
+	defer func() {
+		p.mu.Lock()
+		delete(p.queued, path)
+		p.mu.Unlock()
+	}()
+
+	// A sweep may have queued a specimen that was uploaded in the meantime
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return
+	}
+
+	if err := sink.UploadSpecimenFile(p.storage, p.cacheManager, path); err != nil {
+		log.Error().Err(err).Str("file", path).Msg("Failed to upload specimen")
+		return
+	}
+	log.Info().Str("file", path).Msg("Specimen uploaded successfully")
+}
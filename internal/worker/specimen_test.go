@@ -0,0 +1,87 @@
+package worker
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ideamans/lightfile6-insights-gateway/internal/cache"
+	"github.com/ideamans/lightfile6-insights-gateway/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func saveSpecimen(t *testing.T, cacheManager *cache.Manager, uri string) string {
+	path, _, err := cacheManager.SaveSpecimen(cache.SpecimenMeta{User: "user1", URI: uri}, strings.NewReader("data"))
+	require.NoError(t, err)
+	return path
+}
+
+func TestSpecimenPool_UploadsQueuedPaths(t *testing.T) {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+	storage := &mockSink{}
+
+	pool := NewSpecimenPool(cacheManager, storage, config.SpecimenUploadConfig{Concurrency: 2, QueueSize: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	pool.Start(ctx)
+	defer func() {
+		cancel()
+		pool.Wait()
+	}()
+
+	first := saveSpecimen(t, cacheManager, "a.png")
+	second := saveSpecimen(t, cacheManager, "b.png")
+	assert.True(t, pool.Enqueue(first))
+	assert.True(t, pool.Enqueue(second))
+
+	assert.Eventually(t, func() bool {
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+		return len(storage.specimens) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	files, err := cacheManager.GetSpecimenFiles()
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+func TestSpecimenPool_QueueFull(t *testing.T) {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+
+	// Workers are not started, so nothing leaves the queue
+	pool := NewSpecimenPool(cacheManager, &mockSink{}, config.SpecimenUploadConfig{Concurrency: 1, QueueSize: 1})
+
+	first := saveSpecimen(t, cacheManager, "a.png")
+	second := saveSpecimen(t, cacheManager, "b.png")
+	assert.True(t, pool.Enqueue(first))
+	assert.True(t, pool.Enqueue(first), "a queued path is accepted again")
+	assert.False(t, pool.Enqueue(second))
+}
+
+func TestSpecimenPool_Sweep(t *testing.T) {
+	cacheManager := cache.NewManager(t.TempDir())
+	require.NoError(t, cacheManager.Init())
+	storage := &mockSink{}
+
+	saveSpecimen(t, cacheManager, "a.png")
+	saveSpecimen(t, cacheManager, "b.png")
+
+	pool := NewSpecimenPool(cacheManager, storage, config.SpecimenUploadConfig{Concurrency: 1, QueueSize: 10})
+	ctx, cancel := context.WithCancel(context.Background())
+	pool.Start(ctx)
+	defer func() {
+		cancel()
+		pool.Wait()
+	}()
+
+	pool.Sweep()
+
+	assert.Eventually(t, func() bool {
+		storage.mu.Lock()
+		defer storage.mu.Unlock()
+		return len(storage.specimens) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -7,6 +7,8 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -191,6 +193,17 @@ func writeConfig() (string, error) {
 	configDir := filepath.Join(os.TempDir(), "lightfile6-test")
 	os.MkdirAll(configDir, 0755)
 	
+	// Tokens are the test user names
+	tokensPath := filepath.Join(configDir, "tokens.yml")
+	tokens := "tokens:\n"
+	for _, user := range []string{"testuser", "shutdownuser"} {
+		sum := sha256.Sum256([]byte(user))
+		tokens += fmt.Sprintf("  - sha256: %s\n    user: %s\n", hex.EncodeToString(sum[:]), user)
+	}
+	if err := os.WriteFile(tokensPath, []byte(tokens), 0600); err != nil {
+		return "", err
+	}
+	
 	configPath := filepath.Join(configDir, "config.yml")
 	config := fmt.Sprintf(`
 cache_dir: %s/cache
@@ -209,7 +222,10 @@ s3:
 aggregation:
   usage_interval: 2s
   error_interval: 2s
-`, configDir, minioAccessKey, minioSecretKey, minioEndpoint)
+
+auth:
+  tokens_file: %s
+`, configDir, minioAccessKey, minioSecretKey, minioEndpoint, tokensPath)
 
 	return configPath, os.WriteFile(configPath, []byte(config), 0644)
 }